@@ -5,33 +5,52 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
+	"text/tabwriter"
 	"time"
 
+	qcow2fmt "disk-stream-convert/format/qcow2"
 	"disk-stream-convert/pkg/converter"
 	"disk-stream-convert/pkg/diskfmt"
+	_ "disk-stream-convert/pkg/diskfmt/all"
 	"disk-stream-convert/pkg/diskfmt/qcow2"
-	"disk-stream-convert/pkg/diskfmt/raw"
-	"disk-stream-convert/pkg/diskfmt/vmdk"
 	"disk-stream-convert/pkg/transferio"
 )
 
 func main() {
 	src := flag.String("src", "", "Source file path or URL")
 	dst := flag.String("dst", "", "Destination file path")
-	srcFmt := flag.String("src-fmt", "", "Source format (vmdk, raw)")
-	dstFmt := flag.String("dst-fmt", "raw", "Destination format (raw)")
+	srcFmt := flag.String("src-fmt", "", "Source format ("+diskfmt.Auto+", "+strings.Join(diskfmt.Names(diskfmt.Readable), ", ")+"); auto detects it from the image header")
+	dstFmt := flag.String("dst-fmt", "raw", "Destination format ("+strings.Join(diskfmt.Names(diskfmt.Writable), ", ")+")")
 	prealloc := flag.Bool("prealloc", false, "Preallocate destination file")
+	compress := flag.String("compress", "", "Compress the destination (raw: gzip, xz or zstd; qcow2: deflate clusters)")
+	compressLevel := flag.Int("compress-level", 0, "Compression level of raw output (gzip, xz: 1-9; zstd: 1-22; default: encoder default)")
+	compressThreads := flag.Int("compress-threads", 0, "zstd encoder threads of raw output (default: one per CPU)")
+	subformat := flag.String("subformat", "", "Destination subformat (vhd: fixed or dynamic, default dynamic; vmdk: streamOptimized or monolithicSparse, default streamOptimized)")
+	srcSubformat := flag.String("src-subformat", "", "Source subformat (streamOptimized, monolithicSparse or descriptor, vmdk only; default streamOptimized)")
+	blockSize := flag.Int("block-size", 0, "Block size of simg output, a multiple of 4 (default 4096)")
+	diskIndex := flag.Int("disk-index", 0, "Disk of a multi-disk appliance to convert, counted from 0 (ova only)")
+	decompress := flag.String("decompress", "auto", "Compression of the source (auto, none, gzip, xz, zstd, bzip2); auto detects it from the magic bytes")
+	dataFile := flag.String("data-file", "", "External data file of a qcow2 source (default: resolved next to the image)")
+	snapshot := flag.String("snapshot", "", "Convert the internal snapshot with this ID or name (qcow2 only)")
+	listSnapshots := flag.Bool("list-snapshots", false, "List the internal snapshots of a qcow2 source and exit")
+	allowCorrupt := flag.Bool("allow-corrupt", false, "Convert qcow2 sources that are marked corrupt")
+	keyFile := flag.String("key-file", "", "File holding the passphrase of a LUKS encrypted qcow2 source")
 
 	flag.Parse()
 
-	if *src == "" || *dst == "" {
+	if *listSnapshots {
+		if *src == "" || (*srcFmt != "" && *srcFmt != "qcow2" && *srcFmt != diskfmt.Auto) {
+			fmt.Println("Error: -list-snapshots requires a qcow2 -src")
+			flag.Usage()
+			os.Exit(1)
+		}
+	} else if *src == "" || *dst == "" {
 		fmt.Println("Error: -src and -dst are required")
 		flag.Usage()
 		os.Exit(1)
-	}
-
-	if *srcFmt == "" {
+	} else if *srcFmt == "" {
 		fmt.Println("Error: -src-fmt is required")
 		flag.Usage()
 		os.Exit(1)
@@ -39,46 +58,108 @@ func main() {
 
 	ctx := context.Background()
 
-	var source transferio.StreamRead
-	if strings.HasPrefix(*src, "http://") || strings.HasPrefix(*src, "https://") {
-		source = transferio.NewHTTPImport(*src)
-	} else {
-		var err error
-		source, err = transferio.NewFileReadStorage(*src)
+	source, err := openSource(*src)
+	if err != nil {
+		fmt.Printf("Error opening source file: %v\n", err)
+		os.Exit(1)
+	}
+	readerParams := diskfmt.Params{
+		"subformat":         *srcSubformat,
+		"resolve":           resolver(*src),
+		"snapshot":          *snapshot,
+		"allowCorrupt":      *allowCorrupt,
+		"diskIndex":         *diskIndex,
+		"bufferUnknownSize": true,
+	}
+	if f, ok := diskfmt.Lookup(*dstFmt); ok && f.Name == "raw" {
+		readerParams["bufferUnknownSize"] = false
+	}
+	if *keyFile != "" {
+		// The passphrase is read verbatim, like cryptsetup does.
+		passphrase, err := os.ReadFile(*keyFile)
 		if err != nil {
-			fmt.Printf("Error opening source file: %v\n", err)
+			fmt.Printf("Error: failed to read key file: %v\n", err)
 			os.Exit(1)
 		}
+		readerParams["passphrase"] = passphrase
+	}
+	if *dataFile != "" {
+		df, err := openSource(*dataFile)
+		if err != nil {
+			fmt.Printf("Error opening data file: %v\n", err)
+			os.Exit(1)
+		}
+		readerParams["dataFile"] = df
 	}
 
-	sink, err := transferio.NewFileWriteStorage(*dst, false)
+	if *srcFmt == "" {
+		// Only -list-snapshots gets here without a source format.
+		*srcFmt = "qcow2"
+	}
+	resolved, err := diskfmt.ResolveSource(ctx, *srcFmt, source, *decompress, readerParams)
 	if err != nil {
-		fmt.Printf("Error opening destination file: %v\n", err)
+		fmt.Printf("Error opening source: %v\n", err)
 		os.Exit(1)
 	}
-	defer sink.Close()
+	if *srcFmt == diskfmt.Auto {
+		fmt.Printf("Detected source format: %s\n", describeProbe(resolved))
+	}
+	*srcFmt = resolved.Format
+	source = resolved.Source
 
-	var reader diskfmt.StreamReader
-	switch *srcFmt {
-	case "raw":
-		reader = raw.NewReader(source)
-	case "vmdk":
-		reader = vmdk.NewReader(source)
-	case "qcow2":
-		reader = qcow2.NewReader(source)
-	default:
-		fmt.Println("Error: unsupported source format:", *srcFmt)
+	if *listSnapshots {
+		// An auto source has been probed by now and must have turned out
+		// to be qcow2.
+		if *srcFmt != "qcow2" {
+			fmt.Printf("Error: -list-snapshots requires a qcow2 -src, detected %s\n", *srcFmt)
+			os.Exit(1)
+		}
+		readerParams["snapshot"] = ""
+		reader, err := diskfmt.NewReader(*srcFmt, source, readerParams)
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		qr := reader.(*qcow2.Reader)
+		if err := qr.Open(ctx); err != nil {
+			fmt.Printf("Error opening source: %v\n", err)
+			os.Exit(1)
+		}
+		snapshots, err := qr.Snapshots()
+		qr.Close()
+		if err != nil {
+			fmt.Printf("Error reading snapshots: %v\n", err)
+			os.Exit(1)
+		}
+		printSnapshots(snapshots)
+		return
+	}
+
+	reader, err := diskfmt.NewReader(*srcFmt, source, readerParams)
+	if err != nil {
+		fmt.Println("Error:", err)
 		os.Exit(1)
 	}
 
-	var writer diskfmt.StreamWriter
-	switch *dstFmt {
-	case "raw":
-		writer = raw.NewWriter(sink, *prealloc)
-	case "vmdk":
-		writer = vmdk.NewWriter(sink)
-	default:
-		fmt.Println("Error: unsupported source format:", *srcFmt)
+	sink, err := transferio.NewFileWriteStorage(*dst, false)
+	if err != nil {
+		fmt.Printf("Error opening destination file: %v\n", err)
+		os.Exit(1)
+	}
+	defer sink.Close()
+
+	name := filepath.Base(*dst)
+	writer, err := diskfmt.NewWriter(*dstFmt, sink, diskfmt.Params{
+		"subformat":       *subformat,
+		"prealloc":        *prealloc,
+		"compress":        *compress,
+		"compressLevel":   *compressLevel,
+		"compressThreads": *compressThreads,
+		"name":            strings.TrimSuffix(name, filepath.Ext(name)),
+		"blockSize":       *blockSize,
+	})
+	if err != nil {
+		fmt.Println("Error:", err)
 		os.Exit(1)
 	}
 
@@ -100,5 +181,56 @@ func main() {
 	fmt.Printf("Conversion successful!\n")
 	fmt.Printf("Written: %d bytes\n", written)
 	fmt.Printf("Capacity: %d bytes\n", capacity)
+	if fr, ok := reader.(diskfmt.FeatureReporter); ok {
+		if features := fr.Features(); len(features) > 0 {
+			fmt.Printf("Source features: %s\n", strings.Join(features, ", "))
+		}
+	}
 	fmt.Printf("Elapsed: %v\n", elapsed)
 }
+
+// describeProbe returns the detected format with its subformat and
+// compression, e.g. "vmdk (streamOptimized, gzip compressed)".
+func describeProbe(p *diskfmt.Probed) string {
+	var details []string
+	if p.Subformat != "" {
+		details = append(details, p.Subformat)
+	}
+	if p.Compression != transferio.CompressionNone {
+		details = append(details, p.Compression+" compressed")
+	}
+	if len(details) == 0 {
+		return p.Format
+	}
+	return fmt.Sprintf("%s (%s)", p.Format, strings.Join(details, ", "))
+}
+
+func isURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+// openSource opens a local file or, for http(s) URLs, a streaming import.
+func openSource(s string) (transferio.StreamRead, error) {
+	if isURL(s) {
+		return transferio.NewHTTPImport(s), nil
+	}
+	return transferio.NewFileReadStorage(s)
+}
+
+// resolver opens the files an image at src refers to, such as backing files
+// and extents, next to it.
+func resolver(src string) qcow2.BackingResolver {
+	if isURL(src) {
+		return qcow2.URLResolver(src)
+	}
+	return qcow2.FileResolver(filepath.Dir(src))
+}
+
+func printSnapshots(snapshots []qcow2fmt.Snapshot) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tTAG\tVM SIZE\tDISK SIZE\tDATE")
+	for _, s := range snapshots {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\n", s.ID, s.Name, s.VMStateSize, s.DiskSize, s.Date.Format("2006-01-02 15:04:05"))
+	}
+	tw.Flush()
+}
@@ -11,46 +11,33 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
 	"disk-stream-convert/pkg/converter"
 	"disk-stream-convert/pkg/diskfmt"
-	"disk-stream-convert/pkg/diskfmt/raw"
+	_ "disk-stream-convert/pkg/diskfmt/all"
 	"disk-stream-convert/pkg/diskfmt/qcow2"
-	"disk-stream-convert/pkg/diskfmt/vmdk"
 	"disk-stream-convert/pkg/transferio"
 )
 
-func getReader(srcFmt string, source transferio.StreamRead) (diskfmt.StreamReader, error) {
-	switch srcFmt {
-	case "raw":
-		return raw.NewReader(source), nil
-	case "vmdk":
-		return vmdk.NewReader(source), nil
-	case "qcow2":
-		return qcow2.NewReader(source), nil
-	default:
-		return nil, errors.New("unsupported source format: " + srcFmt)
-	}
-}
-
-func getWriter(dstFmt string, sink transferio.WriteAtStorage, prealloc bool) (diskfmt.StreamWriter, error) {
-	switch dstFmt {
-	case "raw":
-		return raw.NewWriter(sink, prealloc), nil
-	case "vmdk":
-		return vmdk.NewWriter(sink), nil
-	default:
-		return nil, errors.New("unsupported destination format: " + dstFmt)
-	}
-}
-
 type importRequest struct {
-	URL      string `json:"url"`
-	Prealloc bool   `json:"prealloc"`
-	Src      string `json:"src"`
-	Dst      string `json:"dst"`
+	URL             string `json:"url"`
+	Prealloc        bool   `json:"prealloc"`
+	Src             string `json:"src"`
+	Dst             string `json:"dst"`
+	Compress        string `json:"compress"`
+	CompressLevel   int    `json:"compressLevel"`
+	CompressThreads int    `json:"compressThreads"`
+	Subformat       string `json:"subformat"`
+	BlockSize       int    `json:"blockSize"`
+	SrcSubformat    string `json:"srcSubformat"`
+	DiskIndex       int    `json:"diskIndex"`
+	Decompress      string `json:"decompress"`
+	Snapshot        string `json:"snapshot"`
+	AllowCorrupt    bool   `json:"allowCorrupt"`
+	Passphrase      string `json:"passphrase"`
 }
 
 type importResponse struct {
@@ -58,13 +45,52 @@ type importResponse struct {
 	WrittenBytes   uint64 `json:"writtenBytes"`
 	CapacityBytes  uint64 `json:"capacityBytes"`
 	ElapsedSeconds int64  `json:"elapsedSeconds"`
+	// SourceFeatures lists the feature bits found in the source image header.
+	SourceFeatures []string `json:"sourceFeatures,omitempty"`
+	// DetectedFormat is the source format found by probing when src is auto.
+	DetectedFormat string `json:"detectedFormat,omitempty"`
+}
+
+// sourceFeatures returns the feature bits reported by the reader, if any.
+func sourceFeatures(reader diskfmt.StreamReader) []string {
+	if fr, ok := reader.(diskfmt.FeatureReporter); ok {
+		return fr.Features()
+	}
+	return nil
+}
+
+// passphraseHeader returns the passphrase for encrypted sources. It is sent as
+// a header so that it does not end up in access logs with the query string.
+func passphraseHeader(r *http.Request) []byte {
+	if p := r.Header.Get("X-Passphrase"); p != "" {
+		return []byte(p)
+	}
+	return nil
+}
+
+// intParams parses the integer query parameters names into the matching
+// dst pointers. Absent parameters leave them unchanged.
+func intParams(r *http.Request, names []string, dst ...*int) error {
+	for i, name := range names {
+		v := r.URL.Query().Get(name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %s", name, v)
+		}
+		*dst[i] = n
+	}
+	return nil
 }
 
 func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	prealloc := r.URL.Query().Get("prealloc") == "true"
 	src := r.URL.Query().Get("src")
-	dst := r.URL.Query().Get("dst")
+	dst := formatName(r.URL.Query().Get("dst"))
+	compress := r.URL.Query().Get("compress")
 	if src == "" || dst == "" {
 		writeErr(w, http.StatusBadRequest, errors.New("missing src or dst"))
 		return
@@ -114,13 +140,40 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 
 	dataSource := transferio.NewHTTPUpload(rc, knownSize)
 
-	reader, err := getReader(src, dataSource)
+	var diskIndex, compressLevel, compressThreads, blockSize int
+	if err := intParams(r, []string{"diskIndex", "compressLevel", "compressThreads", "blockSize"}, &diskIndex, &compressLevel, &compressThreads, &blockSize); err != nil {
+		writeErr(w, http.StatusBadRequest, err)
+		return
+	}
+	readerParams := diskfmt.Params{
+		"resolve":           qcow2.DirResolver(outDir),
+		"snapshot":          r.URL.Query().Get("snapshot"),
+		"allowCorrupt":      r.URL.Query().Get("allowCorrupt") == "true",
+		"passphrase":        passphraseHeader(r),
+		"subformat":         r.URL.Query().Get("srcSubformat"),
+		"diskIndex":         diskIndex,
+		"bufferUnknownSize": dst != "raw",
+	}
+	resolved, err := diskfmt.ResolveSource(ctx, src, dataSource, r.URL.Query().Get("decompress"), readerParams)
+	if err != nil {
+		writeErr(w, http.StatusBadRequest, err)
+		return
+	}
+	reader, err := diskfmt.NewReader(resolved.Format, resolved.Source, readerParams)
 	if err != nil {
 		writeErr(w, http.StatusBadRequest, err)
 		return
 	}
 
-	writer, err := getWriter(dst, sink, prealloc)
+	writer, err := diskfmt.NewWriter(dst, sink, diskfmt.Params{
+		"prealloc":        prealloc,
+		"compress":        compress,
+		"compressLevel":   compressLevel,
+		"compressThreads": compressThreads,
+		"subformat":       r.URL.Query().Get("subformat"),
+		"name":            baseName(outPath),
+		"blockSize":       blockSize,
+	})
 	if err != nil {
 		writeErr(w, http.StatusBadRequest, err)
 		return
@@ -142,6 +195,10 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 		WrittenBytes:   written,
 		CapacityBytes:  capacity,
 		ElapsedSeconds: int64(time.Since(start).Seconds()),
+		SourceFeatures: sourceFeatures(reader),
+	}
+	if src == "auto" {
+		resp.DetectedFormat = resolved.Format
 	}
 	json.NewEncoder(w).Encode(resp)
 }
@@ -162,6 +219,16 @@ func importHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		req.Src = r.URL.Query().Get("src")
 		req.Dst = r.URL.Query().Get("dst")
+		req.Compress = r.URL.Query().Get("compress")
+		req.Subformat = r.URL.Query().Get("subformat")
+		req.SrcSubformat = r.URL.Query().Get("srcSubformat")
+		if err := intParams(r, []string{"diskIndex", "compressLevel", "compressThreads", "blockSize"}, &req.DiskIndex, &req.CompressLevel, &req.CompressThreads, &req.BlockSize); err != nil {
+			writeErr(w, http.StatusBadRequest, err)
+			return
+		}
+		req.Decompress = r.URL.Query().Get("decompress")
+		req.Snapshot = r.URL.Query().Get("snapshot")
+		req.AllowCorrupt = r.URL.Query().Get("allowCorrupt") == "true"
 	}
 
 	if req.URL == "" {
@@ -172,6 +239,7 @@ func importHandler(w http.ResponseWriter, r *http.Request) {
 		writeErr(w, http.StatusBadRequest, errors.New("missing src or dst"))
 		return
 	}
+	req.Dst = formatName(req.Dst)
 
 	outDir := serverOutputDir
 	if outDir == "" {
@@ -199,14 +267,40 @@ func importHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	start := time.Now()
 
-	source := transferio.NewHTTPImport(req.URL)
-	reader, err := getReader(req.Src, source)
+	passphrase := passphraseHeader(r)
+	if req.Passphrase != "" {
+		passphrase = []byte(req.Passphrase)
+	}
+
+	readerParams := diskfmt.Params{
+		"resolve":           qcow2.URLResolver(req.URL),
+		"snapshot":          req.Snapshot,
+		"allowCorrupt":      req.AllowCorrupt,
+		"passphrase":        passphrase,
+		"subformat":         req.SrcSubformat,
+		"diskIndex":         req.DiskIndex,
+		"bufferUnknownSize": req.Dst != "raw",
+	}
+	resolved, err := diskfmt.ResolveSource(ctx, req.Src, transferio.NewHTTPImport(req.URL), req.Decompress, readerParams)
+	if err != nil {
+		writeErr(w, http.StatusBadGateway, err)
+		return
+	}
+	reader, err := diskfmt.NewReader(resolved.Format, resolved.Source, readerParams)
 	if err != nil {
 		writeErr(w, http.StatusBadRequest, err)
 		return
 	}
 
-	writer, err := getWriter(req.Dst, sink, req.Prealloc)
+	writer, err := diskfmt.NewWriter(req.Dst, sink, diskfmt.Params{
+		"prealloc":        req.Prealloc,
+		"compress":        req.Compress,
+		"compressLevel":   req.CompressLevel,
+		"compressThreads": req.CompressThreads,
+		"subformat":       req.Subformat,
+		"name":            baseName(outPath),
+		"blockSize":       req.BlockSize,
+	})
 	if err != nil {
 		writeErr(w, http.StatusBadRequest, err)
 		return
@@ -223,17 +317,23 @@ func importHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	json.NewEncoder(w).Encode(importResponse{
+	resp := importResponse{
 		Output:         outPath,
 		WrittenBytes:   written,
 		CapacityBytes:  capacity,
 		ElapsedSeconds: int64(time.Since(start).Seconds()),
-	})
+		SourceFeatures: sourceFeatures(reader),
+	}
+	if req.Src == "auto" {
+		resp.DetectedFormat = resolved.Format
+	}
+	json.NewEncoder(w).Encode(resp)
 }
 
 func exportHandler(w http.ResponseWriter, r *http.Request) {
 	src := r.URL.Query().Get("src")
-	dst := r.URL.Query().Get("dst")
+	dst := formatName(r.URL.Query().Get("dst"))
+	compress := r.URL.Query().Get("compress")
 	filePath := r.URL.Query().Get("path")
 
 	if src == "" || dst == "" || filePath == "" {
@@ -247,14 +347,20 @@ func exportHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	filename := filepath.Base(filePath)
-	if dst == "vmdk" {
-		ext := filepath.Ext(filename)
-		if ext != "" {
-			filename = strings.TrimSuffix(filename, ext) + ".vmdk"
-		} else {
-			filename += ".vmdk"
+	if f, ok := diskfmt.Lookup(dst); ok {
+		// The download is streamed, so formats that patch their metadata
+		// afterwards can only be exported in subformats that do not.
+		if f.Has(diskfmt.Writable) && f.NeedsSeekableSink(r.URL.Query().Get("subformat")) {
+			writeErr(w, http.StatusBadRequest, fmt.Errorf("%s output needs a seekable destination and cannot be exported", dst))
+			return
+		}
+		if f.Extension != "" {
+			filename = strings.TrimSuffix(filename, filepath.Ext(filename)) + f.Extension
 		}
 	}
+	if ext, ok := compressExt[compress]; ok && dst == "raw" {
+		filename += ext
+	}
 
 	w.Header().Set("Content-Type", "application/octet-stream")
 	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
@@ -264,14 +370,40 @@ func exportHandler(w http.ResponseWriter, r *http.Request) {
 		writeErr(w, http.StatusInternalServerError, err)
 		return
 	}
-	reader, err := getReader(src, source)
+	var diskIndex, compressLevel, compressThreads, blockSize int
+	if err := intParams(r, []string{"diskIndex", "compressLevel", "compressThreads", "blockSize"}, &diskIndex, &compressLevel, &compressThreads, &blockSize); err != nil {
+		writeErr(w, http.StatusBadRequest, err)
+		return
+	}
+	readerParams := diskfmt.Params{
+		"resolve":           qcow2.DirResolver(filepath.Dir(filePath)),
+		"snapshot":          r.URL.Query().Get("snapshot"),
+		"allowCorrupt":      r.URL.Query().Get("allowCorrupt") == "true",
+		"passphrase":        passphraseHeader(r),
+		"subformat":         r.URL.Query().Get("srcSubformat"),
+		"diskIndex":         diskIndex,
+		"bufferUnknownSize": dst != "raw",
+	}
+	resolved, err := diskfmt.ResolveSource(r.Context(), src, source, r.URL.Query().Get("decompress"), readerParams)
+	if err != nil {
+		writeErr(w, http.StatusBadRequest, err)
+		return
+	}
+	reader, err := diskfmt.NewReader(resolved.Format, resolved.Source, readerParams)
 	if err != nil {
 		writeErr(w, http.StatusBadRequest, err)
 		return
 	}
 
 	sink := &transferio.HTTPDownload{W: w}
-	writer, err := getWriter(dst, sink, false)
+	writer, err := diskfmt.NewWriter(dst, sink, diskfmt.Params{
+		"compress":        compress,
+		"compressLevel":   compressLevel,
+		"compressThreads": compressThreads,
+		"subformat":       r.URL.Query().Get("subformat"),
+		"name":            baseName(filePath),
+		"blockSize":       blockSize,
+	})
 	if err != nil {
 		writeErr(w, http.StatusBadRequest, err)
 		return
@@ -283,6 +415,14 @@ func exportHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if _, _, err := c.Run(r.Context()); err != nil {
+		// Nothing has been streamed yet (e.g. the writer needs a seekable
+		// destination), so the status can still be changed.
+		if n, _ := sink.Size(); n == 0 {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Del("Content-Disposition")
+			writeErr(w, http.StatusBadRequest, err)
+			return
+		}
 		// Log error to stdout since we can't change HTTP status effectively after streaming starts
 		// In a real app, we might use a trailer or log it.
 		// fmt.Println("Export failed:", err)
@@ -291,6 +431,28 @@ func exportHandler(w http.ResponseWriter, r *http.Request) {
 
 var serverOutputDir string
 
+// compressExt holds the file extensions of compressed raw output.
+var compressExt = map[string]string{
+	transferio.CompressionGzip: ".gz",
+	transferio.CompressionXz:   ".xz",
+	transferio.CompressionZstd: ".zst",
+}
+
+// formatName returns the canonical name of a registered format, so that its
+// aliases behave like it, or name itself if it is not registered.
+func formatName(name string) string {
+	if f, ok := diskfmt.Lookup(name); ok {
+		return f.Name
+	}
+	return name
+}
+
+// baseName returns the file name of p without its extension.
+func baseName(p string) string {
+	name := filepath.Base(p)
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
 func deriveOutputPath(baseDir string, src string) (string, error) {
 	u, err := url.Parse(src)
 	if err != nil {
@@ -1,20 +1,40 @@
 package main
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	vdifmt "disk-stream-convert/format/vdi"
+	vhdfmt "disk-stream-convert/format/vhd"
+	vhdxfmt "disk-stream-convert/format/vhdx"
+	vmdkstream "disk-stream-convert/format/vmdk-stream"
 	"disk-stream-convert/pkg/converter"
+	"disk-stream-convert/pkg/diskfmt"
+	"disk-stream-convert/pkg/diskfmt/qcow2"
 	"disk-stream-convert/pkg/diskfmt/raw"
+	"disk-stream-convert/pkg/diskfmt/vdi"
+	"disk-stream-convert/pkg/diskfmt/vhd"
+	"disk-stream-convert/pkg/diskfmt/vhdx"
 	"disk-stream-convert/pkg/diskfmt/vmdk"
 	"disk-stream-convert/pkg/transferio"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"hash/crc32"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
 )
 
 func createVMDKFromRaw(t *testing.T, dir string, name string, data []byte) string {
@@ -223,6 +243,314 @@ func TestUploadVMDKToRaw(t *testing.T) {
 	}
 }
 
+// buildSparseVMDK lays out data as a monolithicSparse extent with 8 KiB
+// grains: header, redundant GD and GT, primary GD and GT, then the grains that
+// are not all zeros, in reverse disk order if reverse is set.
+func buildSparseVMDK(data []byte, reverse bool) []byte {
+	const grainSize = 8 << 10
+	grains := (len(data) + grainSize - 1) / grainSize
+	hdr := vmdkstream.SparseExtentHeader{
+		MagicNumber:  vmdkstream.VMDKMagic,
+		Version:      1,
+		Flags:        vmdkstream.SPARSEFLAG_VALID_NEWLINE_DETECTOR | vmdkstream.SPARSEFLAG_USE_REDUNDANT,
+		Capacity:     vmdkstream.SectorType(len(data) / 512),
+		GrainSize:    grainSize / 512,
+		NumGTEsPerGT: 512,
+		RgdOffset:    1,
+		GdOffset:     6,
+		Overhead:     11,
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, hdr)
+	img := make([]byte, 11*512)
+	copy(img, buf.Bytes())
+	for _, gd := range []int{1, 6} {
+		binary.LittleEndian.PutUint32(img[gd*512:], uint32(gd+1))
+	}
+
+	var order []int
+	for i := 0; i < grains; i++ {
+		chunk := make([]byte, grainSize)
+		copy(chunk, data[i*grainSize:])
+		if !bytes.Equal(chunk, make([]byte, grainSize)) {
+			order = append(order, i)
+		}
+	}
+	if reverse {
+		for i, j := 0, len(order)-1; i < j; i, j = i+1, j-1 {
+			order[i], order[j] = order[j], order[i]
+		}
+	}
+	for _, i := range order {
+		for _, gt := range []int{2, 7} {
+			binary.LittleEndian.PutUint32(img[gt*512+i*4:], uint32(len(img)/512))
+		}
+		chunk := make([]byte, grainSize)
+		copy(chunk, data[i*grainSize:])
+		img = append(img, chunk...)
+	}
+	return img
+}
+
+func TestMonolithicSparseVMDKToRaw(t *testing.T) {
+	dir := t.TempDir()
+	serverOutputDir = dir
+
+	data := make([]byte, 64<<10+4096)
+	copy(data[8<<10:], bytes.Repeat([]byte{0x5a}, 8<<10))
+	copy(data[40<<10+100:], bytes.Repeat([]byte{0x5b}, 1000))
+	copy(data[64<<10:], bytes.Repeat([]byte{0x5c}, 4096))
+
+	upload := func(img []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/upload?src=vmdk&srcSubformat=monolithicSparse&dst=raw&name=disk.raw", bytes.NewReader(img))
+		req.Header.Set("Content-Type", "application/octet-stream")
+		rr := httptest.NewRecorder()
+		uploadHandler(rr, req)
+		return rr
+	}
+
+	// A stream is read through the primary GD, or the redundant one when
+	// there is no primary one.
+	img := buildSparseVMDK(data, false)
+	noPrimary := append([]byte(nil), img...)
+	binary.LittleEndian.PutUint64(noPrimary[56:], 0)
+	for _, img := range [][]byte{img, noPrimary} {
+		rr := upload(img)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+		}
+		var resp importResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decode resp: %v", err)
+		}
+		b, err := os.ReadFile(resp.Output)
+		if err != nil {
+			t.Fatalf("read output: %v", err)
+		}
+		if !bytes.Equal(b, data) {
+			t.Fatalf("vmdk content mismatch")
+		}
+	}
+
+	// Grains stored out of disk order are read from a seekable source, to
+	// which uploads are spooled.
+	reversed := buildSparseVMDK(data, true)
+	srcPath := filepath.Join(dir, "disk.vmdk")
+	if err := os.WriteFile(srcPath, reversed, 0644); err != nil {
+		t.Fatalf("write src: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/export?src=vmdk&srcSubformat=monolithicSparse&dst=raw&path="+srcPath, nil)
+	rr := httptest.NewRecorder()
+	exportHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+	}
+	if !bytes.Equal(rr.Body.Bytes(), data) {
+		t.Fatalf("vmdk content mismatch")
+	}
+	if rr := upload(reversed); rr.Code != http.StatusOK {
+		t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, "disk.raw")); err != nil || !bytes.Equal(b, data) {
+		t.Fatalf("vmdk content mismatch: %v", err)
+	}
+
+	// The reader itself only streams grains stored in disk order.
+	vr := vmdk.NewReader(streamSource(reversed))
+	vr.Subformat = vmdk.SubformatMonolithicSparse
+	if err := vr.Open(context.Background()); err == nil || !strings.Contains(err.Error(), "seekable source") {
+		t.Fatalf("streamed reversed grains: %v", err)
+	}
+}
+
+// streamSource returns img as a source without random access or known size.
+func streamSource(img []byte) transferio.StreamRead {
+	return transferio.NewHTTPUpload(io.NopCloser(bytes.NewReader(img)), 0)
+}
+
+func TestVMDKDescriptorExtents(t *testing.T) {
+	dir := t.TempDir()
+	serverOutputDir = dir
+
+	flat := bytes.Repeat([]byte{0x71}, 8<<10)
+	sparse := make([]byte, 32<<10)
+	copy(sparse[16<<10:], bytes.Repeat([]byte{0x72}, 8<<10))
+	files := map[string][]byte{
+		"disk-flat.vmdk": append(make([]byte, 1024), flat...),
+		"disk s002.vmdk": buildSparseVMDK(sparse, false),
+		"disk.vmdk": []byte(`# Disk DescriptorFile
+version=1
+CID=fffffffe
+parentCID=ffffffff
+createType="twoGbMaxExtentFlat"
+
+# Extent description
+RW 16 FLAT "disk-flat.vmdk" 2
+RDONLY 8 ZERO
+RW 64 SPARSE "disk s002.vmdk"
+NOACCESS 8 FLAT "missing.vmdk" 0
+
+# The Disk Data Base
+#DDB
+
+ddb.adapterType = "lsilogic"
+`),
+	}
+	for name, b := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), b, 0644); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	want := append(append(append(append([]byte(nil), flat...), make([]byte, 4096)...), sparse...), make([]byte, 4096)...)
+
+	req := httptest.NewRequest(http.MethodGet, "/export?src=vmdk&srcSubformat=descriptor&dst=raw&path="+filepath.Join(dir, "disk.vmdk"), nil)
+	rr := httptest.NewRecorder()
+	exportHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+	}
+	if !bytes.Equal(rr.Body.Bytes(), want) {
+		t.Fatalf("vmdk content mismatch")
+	}
+
+	// An uploaded descriptor refers to extents already in the output dir.
+	req = httptest.NewRequest(http.MethodPost, "/upload?src=vmdk&srcSubformat=descriptor&dst=raw&name=disk.raw", bytes.NewReader(files["disk.vmdk"]))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	rr = httptest.NewRecorder()
+	uploadHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+	}
+	var resp importResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode resp: %v", err)
+	}
+	b, err := os.ReadFile(resp.Output)
+	if err != nil {
+		t.Fatalf("read output: %v", err)
+	}
+	if !bytes.Equal(b, want) {
+		t.Fatalf("vmdk content mismatch")
+	}
+}
+
+func TestVMDKCraftedGrainDirectory(t *testing.T) {
+	dir := t.TempDir()
+	serverOutputDir = dir
+
+	upload := func(img []byte, knownSize bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/upload?src=auto&dst=raw&name=disk.raw", bytes.NewReader(img))
+		req.Header.Set("Content-Type", "application/octet-stream")
+		if !knownSize {
+			req.ContentLength = -1
+		}
+		rr := httptest.NewRecorder()
+		uploadHandler(rr, req)
+		return rr
+	}
+
+	// A capacity whose grain directory is far larger than the image is
+	// refused up front, or once a stream ends, without allocating tables for
+	// the whole disk.
+	img := buildSparseVMDK(make([]byte, 64<<10), false)
+	img = append(img, make([]byte, 1<<20)...)
+	binary.LittleEndian.PutUint64(img[12:], 1<<50)
+	for _, knownSize := range []bool{true, false} {
+		if rr := upload(img, knownSize); rr.Code != http.StatusBadGateway || !strings.Contains(rr.Body.String(), "does not fit in the") {
+			t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+		}
+	}
+	vr := vmdk.NewReader(streamSource(img))
+	vr.Subformat = vmdk.SubformatMonolithicSparse
+	if err := vr.Open(context.Background()); err == nil || !strings.Contains(err.Error(), "failed to read vmdk grain directory") {
+		t.Fatalf("streamed grain directory: %v", err)
+	}
+
+	// Grain tables other than 512 entries are refused.
+	img = buildSparseVMDK(make([]byte, 64<<10), false)
+	binary.LittleEndian.PutUint32(img[44:], 4096)
+	if rr := upload(img, true); rr.Code != http.StatusBadGateway || !strings.Contains(rr.Body.String(), "unsupported vmdk grain table size") {
+		t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+	}
+
+	// Grain tables that overlap are refused rather than read twice.
+	img = buildSparseVMDK(bytes.Repeat([]byte{0x5a}, 64<<10), false)
+	binary.LittleEndian.PutUint64(img[12:], 2*512*16)
+	binary.LittleEndian.PutUint32(img[1*512+4:], 2)
+	binary.LittleEndian.PutUint32(img[6*512+4:], 7)
+	if rr := upload(img, true); rr.Code != http.StatusBadGateway || !strings.Contains(rr.Body.String(), "overlaps another grain table") {
+		t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestUploadRawToMonolithicSparseVMDK(t *testing.T) {
+	dir := t.TempDir()
+	serverOutputDir = dir
+
+	// Grains in the first and the second grain table, and a partial last one.
+	data := make([]byte, 40<<20+1024)
+	copy(data[64<<10:], bytes.Repeat([]byte{0x3c}, 4096))
+	copy(data[33<<20:], bytes.Repeat([]byte{0x3d}, 70<<10))
+	copy(data[40<<20:], bytes.Repeat([]byte{0x3e}, 1024))
+	req := httptest.NewRequest(http.MethodPost, "/upload?src=raw&dst=vmdk&subformat=monolithicSparse&name=disk.vmdk", bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.ContentLength = int64(len(data))
+	rr := httptest.NewRecorder()
+	uploadHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+	}
+	var resp importResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode resp: %v", err)
+	}
+	img, err := os.ReadFile(resp.Output)
+	if err != nil {
+		t.Fatalf("read output: %v", err)
+	}
+	hdr, err := vmdkstream.ParseSparseExtentHeader(img)
+	if err != nil {
+		t.Fatalf("parse header: %v", err)
+	}
+	if hdr.Flags&vmdkstream.SPARSEFLAG_COMPRESSED != 0 || hdr.GdOffset == vmdkstream.SPARSE_GD_AT_END || hdr.RgdOffset == 0 {
+		t.Fatalf("unexpected header %+v", hdr)
+	}
+	if !bytes.Contains(img[512:hdr.Overhead*512], []byte(`createType="monolithicSparse"`)) {
+		t.Fatalf("descriptor lacks the createType")
+	}
+	// Four grains are stored.
+	if len(img) != int(hdr.Overhead*512)+4*64<<10 {
+		t.Fatalf("image is %d bytes", len(img))
+	}
+
+	// Both grain directories read back the data.
+	noPrimary := append([]byte(nil), img...)
+	binary.LittleEndian.PutUint64(noPrimary[56:], 0)
+	for _, img := range [][]byte{img, noPrimary} {
+		srcPath := filepath.Join(dir, "roundtrip.vmdk")
+		if err := os.WriteFile(srcPath, img, 0644); err != nil {
+			t.Fatalf("write src: %v", err)
+		}
+		req = httptest.NewRequest(http.MethodGet, "/export?src=vmdk&srcSubformat=monolithicSparse&dst=raw&path="+srcPath, nil)
+		rr = httptest.NewRecorder()
+		exportHandler(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+		}
+		if !bytes.Equal(rr.Body.Bytes(), data) {
+			t.Fatalf("vmdk content mismatch")
+		}
+	}
+
+	// Grain tables are filled in place, which a download cannot do.
+	req = httptest.NewRequest(http.MethodGet, "/export?src=raw&dst=vmdk&subformat=monolithicSparse&path="+resp.Output, nil)
+	rr = httptest.NewRecorder()
+	exportHandler(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+	}
+}
+
 func TestImportRawToVMDK(t *testing.T) {
 	dir := t.TempDir()
 	serverOutputDir = dir
@@ -320,3 +648,1594 @@ func TestExportVMDKToRaw(t *testing.T) {
 		t.Fatalf("exported body mismatch")
 	}
 }
+
+func TestUploadRawToQcow2(t *testing.T) {
+	dir := t.TempDir()
+	serverOutputDir = dir
+
+	data := make([]byte, 1024*1024+4096)
+	copy(data[1<<20:], bytes.Repeat([]byte{0x42}, 4096))
+	req := httptest.NewRequest(http.MethodPost, "/upload?src=raw&dst=qcow2&compress=deflate&name=disk.qcow2", bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.ContentLength = int64(len(data))
+	rr := httptest.NewRecorder()
+	uploadHandler(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+	}
+	var resp importResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode resp: %v", err)
+	}
+
+	source, err := transferio.NewFileReadStorage(resp.Output)
+	if err != nil {
+		t.Fatalf("open output: %v", err)
+	}
+	out := filepath.Join(dir, "out.raw")
+	sink, err := transferio.NewFileWriteStorage(out, false)
+	if err != nil {
+		t.Fatalf("new sink: %v", err)
+	}
+	c := &converter.StreamConverter{Reader: qcow2.NewReader(source), Writer: raw.NewWriter(sink, false)}
+	if _, _, err := c.Run(context.Background()); err != nil {
+		t.Fatalf("convert back: %v", err)
+	}
+	b, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("read output: %v", err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Fatalf("qcow2 round trip mismatch")
+	}
+}
+
+func TestExportRawToQcow2Rejected(t *testing.T) {
+	dir := t.TempDir()
+	serverOutputDir = dir
+
+	srcPath := filepath.Join(dir, "disk.raw")
+	if err := os.WriteFile(srcPath, bytes.Repeat([]byte{0x01}, 4096), 0644); err != nil {
+		t.Fatalf("write src: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/export?src=raw&dst=qcow2&path="+srcPath, nil)
+	rr := httptest.NewRecorder()
+	exportHandler(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestUploadDirtyQcow2ReportsFeatures(t *testing.T) {
+	dir := t.TempDir()
+	serverOutputDir = dir
+
+	data := bytes.Repeat([]byte{0x24}, 1<<16)
+	qcowPath := filepath.Join(dir, "dirty.qcow2")
+	sink, err := transferio.NewFileWriteStorage(qcowPath, false)
+	if err != nil {
+		t.Fatalf("new sink: %v", err)
+	}
+	src := transferio.NewHTTPUpload(io.NopCloser(bytes.NewReader(data)), int64(len(data)))
+	c := &converter.StreamConverter{Reader: raw.NewReader(src), Writer: qcow2.NewWriter(sink, false)}
+	if _, _, err := c.Run(context.Background()); err != nil {
+		t.Fatalf("convert: %v", err)
+	}
+	img, err := os.ReadFile(qcowPath)
+	if err != nil {
+		t.Fatalf("read qcow2: %v", err)
+	}
+	// Set the dirty incompatible feature bit, as a crashed VM would leave it.
+	img[79] |= 1
+
+	req := httptest.NewRequest(http.MethodPost, "/upload?src=qcow2&dst=raw&name=out.img", bytes.NewReader(img))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.ContentLength = int64(len(img))
+	rr := httptest.NewRecorder()
+	uploadHandler(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+	}
+	var resp importResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode resp: %v", err)
+	}
+	if len(resp.SourceFeatures) != 1 || resp.SourceFeatures[0] != "dirty" {
+		t.Fatalf("sourceFeatures=%v", resp.SourceFeatures)
+	}
+	out, err := os.ReadFile(resp.Output)
+	if err != nil {
+		t.Fatalf("read output: %v", err)
+	}
+	if !bytes.Equal(out, data) {
+		t.Fatalf("decoded raw mismatch")
+	}
+}
+
+// buildVHD lays out data as a fixed or dynamic VHD image the way Hyper-V does,
+// with all-zero blocks left unallocated.
+func buildVHD(data []byte, dynamic bool, blockSize int) []byte {
+	footer := vhdfmt.Footer{
+		Features:          vhdfmt.FeaturesReserved,
+		FileFormatVersion: vhdfmt.FileFormatVersion,
+		DataOffset:        vhdfmt.FixedDataOffset,
+		OriginalSize:      uint64(len(data)),
+		CurrentSize:       uint64(len(data)),
+		DiskType:          vhdfmt.DiskTypeFixed,
+	}
+	copy(footer.Cookie[:], vhdfmt.FooterCookie)
+	encode := func(v interface{}, checksumOffset int) []byte {
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.BigEndian, v)
+		b := buf.Bytes()
+		binary.BigEndian.PutUint32(b[checksumOffset:], vhdfmt.Checksum(b, checksumOffset))
+		return b
+	}
+
+	if !dynamic {
+		return append(append([]byte(nil), data...), encode(footer, 64)...)
+	}
+
+	footer.DataOffset = vhdfmt.FooterSize
+	footer.DiskType = vhdfmt.DiskTypeDynamic
+	blocks := (len(data) + blockSize - 1) / blockSize
+	batOffset := vhdfmt.FooterSize + vhdfmt.DynamicHeaderSize
+	header := vhdfmt.DynamicHeader{
+		DataOffset:      vhdfmt.FixedDataOffset,
+		TableOffset:     uint64(batOffset),
+		HeaderVersion:   vhdfmt.DynamicHeaderVersion,
+		MaxTableEntries: uint32(blocks),
+		BlockSize:       uint32(blockSize),
+	}
+	copy(header.Cookie[:], vhdfmt.DynamicHeaderCookie)
+
+	var out bytes.Buffer
+	out.Write(encode(footer, 64))
+	out.Write(encode(header, 36))
+	bat := make([]byte, (blocks*4+511)/512*512)
+	for i := range bat {
+		bat[i] = 0xff
+	}
+	batStart := out.Len()
+	out.Write(bat)
+
+	bitmap := bytes.Repeat([]byte{0xff}, int(header.BitmapSize()))
+	for i := 0; i < blocks; i++ {
+		chunk := make([]byte, blockSize)
+		copy(chunk, data[i*blockSize:])
+		if bytes.Equal(chunk, make([]byte, blockSize)) {
+			continue
+		}
+		binary.BigEndian.PutUint32(out.Bytes()[batStart+i*4:], uint32(out.Len()/512))
+		out.Write(bitmap)
+		out.Write(chunk)
+	}
+	out.Write(encode(footer, 64))
+	return out.Bytes()
+}
+
+func TestUploadVHDToRaw(t *testing.T) {
+	dir := t.TempDir()
+	serverOutputDir = dir
+
+	blockSize := 64 * 1024
+	data := make([]byte, blockSize*5+4096)
+	copy(data[blockSize:], bytes.Repeat([]byte{0x11}, blockSize))
+	copy(data[blockSize*3+512:], bytes.Repeat([]byte{0x22}, 1000))
+	copy(data[blockSize*5:], bytes.Repeat([]byte{0x33}, 4096))
+
+	for _, dynamic := range []bool{false, true} {
+		img := buildVHD(data, dynamic, blockSize)
+		name := "fixed.raw"
+		if dynamic {
+			name = "dynamic.raw"
+		}
+		req := httptest.NewRequest(http.MethodPost, "/upload?src=vhd&dst=raw&name="+name, bytes.NewReader(img))
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.ContentLength = int64(len(img))
+		rr := httptest.NewRecorder()
+		uploadHandler(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("dynamic=%v status=%d body=%s", dynamic, rr.Code, rr.Body.String())
+		}
+		var resp importResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decode resp: %v", err)
+		}
+		if resp.CapacityBytes != uint64(len(data)) {
+			t.Fatalf("dynamic=%v capacity=%d, want %d", dynamic, resp.CapacityBytes, len(data))
+		}
+		b, err := os.ReadFile(resp.Output)
+		if err != nil {
+			t.Fatalf("read output: %v", err)
+		}
+		if !bytes.Equal(b, data) {
+			t.Fatalf("dynamic=%v: vhd content mismatch", dynamic)
+		}
+	}
+}
+
+func TestVHDBlocksOutOfDiskOrder(t *testing.T) {
+	dir := t.TempDir()
+	serverOutputDir = dir
+
+	blockSize := 64 * 1024
+	data := make([]byte, blockSize*4)
+	copy(data[blockSize:], bytes.Repeat([]byte{0x11}, blockSize))
+	copy(data[blockSize*3:], bytes.Repeat([]byte{0x22}, blockSize))
+
+	// Swap the two stored blocks, as Hyper-V does when blocks are allocated
+	// in a different order than their disk offsets.
+	img := buildVHD(data, true, blockSize)
+	bat := img[vhdfmt.FooterSize+vhdfmt.DynamicHeaderSize:]
+	first, second := binary.BigEndian.Uint32(bat[4:]), binary.BigEndian.Uint32(bat[12:])
+	binary.BigEndian.PutUint32(bat[4:], second)
+	binary.BigEndian.PutUint32(bat[12:], first)
+	blockLen := 512 + blockSize
+	a := append([]byte(nil), img[first*512:int(first*512)+blockLen]...)
+	copy(img[first*512:], img[second*512:int(second*512)+blockLen])
+	copy(img[second*512:], a)
+
+	// A seekable source reads the blocks in disk order.
+	srcPath := filepath.Join(dir, "disk.vhd")
+	if err := os.WriteFile(srcPath, img, 0644); err != nil {
+		t.Fatalf("write src: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/export?src=vhd&dst=raw&path="+srcPath, nil)
+	rr := httptest.NewRecorder()
+	exportHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+	}
+	if !bytes.Equal(rr.Body.Bytes(), data) {
+		t.Fatalf("vhd content mismatch")
+	}
+
+	// Uploads are spooled to a seekable file, while a stream read directly
+	// cannot seek back to the first block.
+	req = httptest.NewRequest(http.MethodPost, "/upload?src=vhd&dst=raw&name=disk.raw", bytes.NewReader(img))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.ContentLength = int64(len(img))
+	rr = httptest.NewRecorder()
+	uploadHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, "disk.raw")); err != nil || !bytes.Equal(b, data) {
+		t.Fatalf("vhd content mismatch: %v", err)
+	}
+	if err := vhd.NewReader(streamSource(img)).Open(context.Background()); err == nil || !strings.Contains(err.Error(), "seekable source") {
+		t.Fatalf("streamed vhd: %v", err)
+	}
+}
+
+func TestVHDCraftedTableSize(t *testing.T) {
+	dir := t.TempDir()
+	serverOutputDir = dir
+
+	blockSize := 64 * 1024
+	data := make([]byte, blockSize*3)
+	copy(data[blockSize:], bytes.Repeat([]byte{0x11}, blockSize))
+	upload := func(img []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/upload?src=vhd&dst=raw&name=disk.raw", bytes.NewReader(img))
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.ContentLength = int64(len(img))
+		rr := httptest.NewRecorder()
+		uploadHandler(rr, req)
+		return rr
+	}
+	resum := func(b []byte, checksumOffset int) {
+		binary.BigEndian.PutUint32(b[checksumOffset:], 0)
+		binary.BigEndian.PutUint32(b[checksumOffset:], vhdfmt.Checksum(b, checksumOffset))
+	}
+
+	// A table far larger than the disk needs is not read beyond the disk.
+	img := buildVHD(data, true, blockSize)
+	header := img[vhdfmt.FooterSize : vhdfmt.FooterSize+vhdfmt.DynamicHeaderSize]
+	binary.BigEndian.PutUint32(header[28:], 0xffffffff)
+	resum(header, 36)
+	if rr := upload(img); rr.Code != http.StatusOK {
+		t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "disk.raw"))
+	if err != nil || !bytes.Equal(b, data) {
+		t.Fatalf("vhd content mismatch: %v", err)
+	}
+
+	// A disk size the table cannot cover is refused before reading it.
+	footer := img[:vhdfmt.FooterSize]
+	binary.BigEndian.PutUint64(footer[48:], 1<<50)
+	resum(footer, 64)
+	if rr := upload(img); rr.Code != http.StatusBadGateway || !strings.Contains(rr.Body.String(), "does not cover the disk") {
+		t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestUploadVMDKToVDI(t *testing.T) {
+	dir := t.TempDir()
+	serverOutputDir = dir
+
+	// Three 1 MiB blocks, of which the middle one is all zeros.
+	data := make([]byte, 3<<20)
+	copy(data, bytes.Repeat([]byte{0x2a}, 4096))
+	copy(data[2<<20+512:], bytes.Repeat([]byte{0x2b}, 4096))
+	vmdkBytes, err := os.ReadFile(createVMDKFromRaw(t, dir, "src.vmdk", data))
+	if err != nil {
+		t.Fatalf("read vmdk: %v", err)
+	}
+
+	upload := func(query string, body []byte) importResponse {
+		req := httptest.NewRequest(http.MethodPost, "/upload?"+query, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.ContentLength = int64(len(body))
+		rr := httptest.NewRecorder()
+		uploadHandler(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+		}
+		var resp importResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decode resp: %v", err)
+		}
+		return resp
+	}
+
+	resp := upload("src=vmdk&dst=vdi&name=disk.vdi", vmdkBytes)
+	img, err := os.ReadFile(resp.Output)
+	if err != nil {
+		t.Fatalf("read output: %v", err)
+	}
+	h, err := vdifmt.ParseHeader(img)
+	if err != nil {
+		t.Fatalf("parse header: %v", err)
+	}
+	if h.DiskSize != uint64(len(data)) || h.BlocksAllocated != 2 {
+		t.Fatalf("disk size %d, %d blocks allocated", h.DiskSize, h.BlocksAllocated)
+	}
+
+	resp = upload("src=vdi&dst=raw&name=disk.raw", img)
+	b, err := os.ReadFile(resp.Output)
+	if err != nil {
+		t.Fatalf("read output: %v", err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Fatalf("vdi content mismatch")
+	}
+
+	// Blocks marked as zero read as zeros.
+	binary.LittleEndian.PutUint32(img[h.OffsetBlocks:], vdifmt.BlockZero)
+	resp = upload("src=vdi&dst=raw&name=zero.raw", img)
+	if b, err = os.ReadFile(resp.Output); err != nil {
+		t.Fatalf("read output: %v", err)
+	}
+	if !bytes.Equal(b[:4096], make([]byte, 4096)) || !bytes.Equal(b[4096:], data[4096:]) {
+		t.Fatalf("vdi zero block mismatch")
+	}
+}
+
+func TestVDICraftedBlockMap(t *testing.T) {
+	dir := t.TempDir()
+	serverOutputDir = dir
+
+	data := bytes.Repeat([]byte{0x2c}, 2<<20)
+	srcPath := filepath.Join(dir, "disk.raw")
+	if err := os.WriteFile(srcPath, data, 0644); err != nil {
+		t.Fatalf("write src: %v", err)
+	}
+	vdiPath := filepath.Join(dir, "disk.vdi")
+	sink, err := transferio.NewFileWriteStorage(vdiPath, false)
+	if err != nil {
+		t.Fatalf("new sink: %v", err)
+	}
+	source, err := transferio.NewFileReadStorage(srcPath)
+	if err != nil {
+		t.Fatalf("new source: %v", err)
+	}
+	c := &converter.StreamConverter{Reader: raw.NewReader(source), Writer: vdi.NewWriter(sink)}
+	if _, _, err := c.Run(context.Background()); err != nil {
+		t.Fatalf("convert: %v", err)
+	}
+	img, err := os.ReadFile(vdiPath)
+	if err != nil {
+		t.Fatalf("read vdi: %v", err)
+	}
+	h, err := vdifmt.ParseHeader(img)
+	if err != nil {
+		t.Fatalf("parse header: %v", err)
+	}
+
+	for _, tc := range []struct {
+		diskSize uint64
+		blocks   uint32
+		want     string
+	}{
+		// The map must match the disk size.
+		{2 << 20, 0xffffffff, "does not match the disk size"},
+		// A huge disk needs a huge map, which is not allocated up front but
+		// runs out of data.
+		{1 << 50, 1 << 30, "failed to read VDI block map"},
+	} {
+		crafted := *h
+		crafted.DiskSize = tc.diskSize
+		crafted.BlocksInImage = tc.blocks
+		b := append(crafted.Bytes(), img[vdifmt.HeaderSize:]...)
+		req := httptest.NewRequest(http.MethodPost, "/upload?src=vdi&dst=raw&name=crafted.raw", bytes.NewReader(b))
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.ContentLength = int64(len(b))
+		rr := httptest.NewRecorder()
+		uploadHandler(rr, req)
+		if rr.Code != http.StatusBadGateway || !strings.Contains(rr.Body.String(), tc.want) {
+			t.Fatalf("disk size %d: status=%d body=%s", tc.diskSize, rr.Code, rr.Body.String())
+		}
+	}
+}
+
+func TestUploadRawToVHD(t *testing.T) {
+	dir := t.TempDir()
+	serverOutputDir = dir
+
+	data := make([]byte, 3*1024*1024+4096)
+	copy(data[2<<20:], bytes.Repeat([]byte{0x5c}, 8192))
+	for _, subformat := range []string{"fixed", "dynamic"} {
+		req := httptest.NewRequest(http.MethodPost, "/upload?src=raw&dst=vhd&subformat="+subformat+"&name="+subformat+".vhd", bytes.NewReader(data))
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.ContentLength = int64(len(data))
+		rr := httptest.NewRecorder()
+		uploadHandler(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+		}
+		var resp importResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decode resp: %v", err)
+		}
+
+		source, err := transferio.NewFileReadStorage(resp.Output)
+		if err != nil {
+			t.Fatalf("open output: %v", err)
+		}
+		out := filepath.Join(dir, subformat+".raw")
+		sink, err := transferio.NewFileWriteStorage(out, false)
+		if err != nil {
+			t.Fatalf("new sink: %v", err)
+		}
+		c := &converter.StreamConverter{Reader: vhd.NewReader(source), Writer: raw.NewWriter(sink, false)}
+		_, capacity, err := c.Run(context.Background())
+		if err != nil {
+			t.Fatalf("convert back: %v", err)
+		}
+		b, err := os.ReadFile(out)
+		if err != nil {
+			t.Fatalf("read output: %v", err)
+		}
+
+		// Fixed images are padded to a whole MiB for Azure.
+		want := data
+		if subformat == "fixed" {
+			want = append(append([]byte(nil), data...), make([]byte, 4*1024*1024-len(data))...)
+		}
+		if capacity != uint64(len(want)) || !bytes.Equal(b, want) {
+			t.Fatalf("%s vhd round trip mismatch (capacity %d)", subformat, capacity)
+		}
+	}
+}
+
+func TestExportRawToVHD(t *testing.T) {
+	dir := t.TempDir()
+	serverOutputDir = dir
+
+	srcPath := filepath.Join(dir, "disk.raw")
+	data := bytes.Repeat([]byte{0x01}, 4096)
+	if err := os.WriteFile(srcPath, data, 0644); err != nil {
+		t.Fatalf("write src: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/export?src=raw&dst=vhd&subformat=fixed&path="+srcPath, nil)
+	rr := httptest.NewRecorder()
+	exportHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+	}
+	if cd := rr.Header().Get("Content-Disposition"); cd != `attachment; filename="disk.vhd"` {
+		t.Fatalf("Content-Disposition=%q", cd)
+	}
+	body := rr.Body.Bytes()
+	if len(body) != 1<<20+512 || !bytes.Equal(body[:len(data)], data) {
+		t.Fatalf("unexpected fixed vhd of %d bytes", len(body))
+	}
+
+	// Dynamic images need random writes.
+	req = httptest.NewRequest(http.MethodGet, "/export?src=raw&dst=vhd&subformat=dynamic&path="+srcPath, nil)
+	rr = httptest.NewRecorder()
+	exportHandler(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+	}
+}
+
+// buildVHDX lays out data as a dynamic VHDX image with 1 MiB blocks, leaving
+// all-zero blocks not present. A non-zero logGUID marks the log as unreplayed.
+func buildVHDX(data []byte, logGUID byte) []byte {
+	const (
+		blockSize      = 1 << 20
+		metadataOffset = 2 << 20
+		batOffset      = 3 << 20
+		blocksOffset   = 4 << 20
+	)
+	blocks := (len(data) + blockSize - 1) / blockSize
+	img := make([]byte, blocksOffset, blocksOffset+len(data)+blockSize)
+	copy(img, vhdxfmt.FileSignature)
+
+	le := binary.LittleEndian
+	for i, off := range []int{vhdxfmt.Header1Offset, vhdxfmt.Header2Offset} {
+		h := img[off : off+vhdxfmt.HeaderSize]
+		copy(h, vhdxfmt.HeaderSignature)
+		le.PutUint64(h[8:], uint64(i+1))
+		h[48] = logGUID
+		le.PutUint16(h[66:], vhdxfmt.Version)
+		le.PutUint32(h[4:], vhdxfmt.Checksum(h))
+	}
+
+	for _, off := range []int{vhdxfmt.RegionTable1Offset, vhdxfmt.RegionTable2Offset} {
+		rt := img[off : off+vhdxfmt.RegionTableSize]
+		copy(rt, vhdxfmt.RegionTableSignature)
+		le.PutUint32(rt[8:], 2)
+		for i, region := range []struct {
+			guid vhdxfmt.GUID
+			off  uint64
+		}{{vhdxfmt.MetadataRegion, metadataOffset}, {vhdxfmt.BATRegion, batOffset}} {
+			e := rt[16+i*32:]
+			copy(e, region.guid[:])
+			le.PutUint64(e[16:], region.off)
+			le.PutUint32(e[24:], 1<<20)
+			le.PutUint32(e[28:], 1)
+		}
+		le.PutUint32(rt[4:], vhdxfmt.Checksum(rt))
+	}
+
+	md := img[metadataOffset : metadataOffset+1<<20]
+	copy(md, vhdxfmt.MetadataSignature)
+	items := []struct {
+		guid  vhdxfmt.GUID
+		value []byte
+	}{
+		{vhdxfmt.FileParametersItem, le.AppendUint32(le.AppendUint32(nil, blockSize), 0)},
+		{vhdxfmt.VirtualDiskSizeItem, le.AppendUint64(nil, uint64(len(data)))},
+		{vhdxfmt.LogicalSectorSizeItem, le.AppendUint32(nil, 512)},
+		{vhdxfmt.PhysicalSectorSizeItem, le.AppendUint32(nil, 4096)},
+	}
+	le.PutUint16(md[10:], uint16(len(items)))
+	for i, item := range items {
+		e := md[32+i*32:]
+		copy(e, item.guid[:])
+		le.PutUint32(e[16:], uint32(64<<10+i*8))
+		le.PutUint32(e[20:], uint32(len(item.value)))
+		le.PutUint32(e[24:], vhdxfmt.MetadataIsRequired)
+		copy(md[64<<10+i*8:], item.value)
+	}
+
+	for i := 0; i < blocks; i++ {
+		chunk := make([]byte, blockSize)
+		copy(chunk, data[i*blockSize:])
+		state := uint64(vhdxfmt.PayloadBlockZero)
+		if !bytes.Equal(chunk, make([]byte, blockSize)) {
+			state = vhdxfmt.PayloadBlockFullyPresent | uint64(len(img))
+			img = append(img, chunk...)
+		}
+		le.PutUint64(img[batOffset+i*8:], state)
+	}
+	return img
+}
+
+func TestUploadVHDXToRaw(t *testing.T) {
+	dir := t.TempDir()
+	serverOutputDir = dir
+
+	data := make([]byte, 3<<20+4096)
+	copy(data[1<<20:], bytes.Repeat([]byte{0x6b}, 1<<20))
+	copy(data[3<<20:], bytes.Repeat([]byte{0x6c}, 4096))
+
+	req := httptest.NewRequest(http.MethodPost, "/upload?src=vhdx&dst=raw&name=disk.raw", bytes.NewReader(buildVHDX(data, 0)))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	rr := httptest.NewRecorder()
+	uploadHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+	}
+	var resp importResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode resp: %v", err)
+	}
+	b, err := os.ReadFile(resp.Output)
+	if err != nil {
+		t.Fatalf("read output: %v", err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Fatalf("vhdx content mismatch")
+	}
+
+	// Images whose log still has to be replayed are refused.
+	req = httptest.NewRequest(http.MethodPost, "/upload?src=vhdx&dst=raw&name=dirty.raw", bytes.NewReader(buildVHDX(data, 1)))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	rr = httptest.NewRecorder()
+	uploadHandler(rr, req)
+	if rr.Code == http.StatusOK || !strings.Contains(rr.Body.String(), "log") {
+		t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestVHDXBlocksOutOfDiskOrder(t *testing.T) {
+	dir := t.TempDir()
+	serverOutputDir = dir
+
+	data := make([]byte, 3<<20+4096)
+	copy(data[1<<20:], bytes.Repeat([]byte{0x6b}, 1<<20))
+	copy(data[3<<20:], bytes.Repeat([]byte{0x6c}, 4096))
+
+	// Swap the payload of the two present blocks and their BAT entries.
+	img := buildVHDX(data, 0)
+	bat := img[3<<20:]
+	first, second := binary.LittleEndian.Uint64(bat[8:]), binary.LittleEndian.Uint64(bat[24:])
+	binary.LittleEndian.PutUint64(bat[8:], second)
+	binary.LittleEndian.PutUint64(bat[24:], first)
+	firstOff, secondOff := vhdxfmt.BATEntry(first).FileOffset(), vhdxfmt.BATEntry(second).FileOffset()
+	a := append([]byte(nil), img[firstOff:firstOff+1<<20]...)
+	copy(img[firstOff:], img[secondOff:secondOff+1<<20])
+	copy(img[secondOff:], a)
+
+	srcPath := filepath.Join(dir, "disk.vhdx")
+	if err := os.WriteFile(srcPath, img, 0644); err != nil {
+		t.Fatalf("write src: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/export?src=vhdx&dst=raw&path="+srcPath, nil)
+	rr := httptest.NewRecorder()
+	exportHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+	}
+	if !bytes.Equal(rr.Body.Bytes(), data) {
+		t.Fatalf("vhdx content mismatch")
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/upload?src=vhdx&dst=raw&name=disk.raw", bytes.NewReader(img))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	rr = httptest.NewRecorder()
+	uploadHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, "disk.raw")); err != nil || !bytes.Equal(b, data) {
+		t.Fatalf("vhdx content mismatch: %v", err)
+	}
+	if err := vhdx.NewReader(streamSource(img)).Open(context.Background()); err == nil || !strings.Contains(err.Error(), "seekable source") {
+		t.Fatalf("streamed vhdx: %v", err)
+	}
+}
+
+func TestVHDXCraftedRegions(t *testing.T) {
+	dir := t.TempDir()
+	serverOutputDir = dir
+
+	data := bytes.Repeat([]byte{0x6d}, 1<<20)
+	// setRegion rewrites region i (0 is the metadata, 1 the BAT) in both
+	// region tables.
+	setRegion := func(img []byte, i int, off uint64, length uint32) {
+		le := binary.LittleEndian
+		for _, rtOff := range []int{vhdxfmt.RegionTable1Offset, vhdxfmt.RegionTable2Offset} {
+			rt := img[rtOff : rtOff+vhdxfmt.RegionTableSize]
+			le.PutUint64(rt[16+i*32+16:], off)
+			le.PutUint32(rt[16+i*32+24:], length)
+			le.PutUint32(rt[4:], 0)
+			le.PutUint32(rt[4:], vhdxfmt.Checksum(rt))
+		}
+	}
+	for _, tc := range []struct {
+		name   string
+		region int
+		off    uint64
+		length uint32
+		want   string
+	}{
+		{"metadata too large", 0, 2 << 20, 0xffffffff, "exceeds the maximum"},
+		{"metadata outside", 0, 1 << 40, 1 << 20, "lies outside the"},
+		{"bat too large", 1, 3 << 20, 0xfff00000, "bytes the disk needs"},
+		{"bat outside", 1, 1 << 40, 1 << 20, "lies outside the"},
+	} {
+		img := buildVHDX(data, 0)
+		setRegion(img, tc.region, tc.off, tc.length)
+		req := httptest.NewRequest(http.MethodPost, "/upload?src=vhdx&dst=raw&name=disk.raw", bytes.NewReader(img))
+		req.Header.Set("Content-Type", "application/octet-stream")
+		rr := httptest.NewRecorder()
+		uploadHandler(rr, req)
+		if rr.Code == http.StatusOK || !strings.Contains(rr.Body.String(), tc.want) {
+			t.Fatalf("%s: status=%d body=%s", tc.name, rr.Code, rr.Body.String())
+		}
+	}
+}
+
+func TestUploadRawToVHDX(t *testing.T) {
+	dir := t.TempDir()
+	serverOutputDir = dir
+
+	// Two 32 MiB blocks, of which only the second holds data.
+	data := make([]byte, 40<<20)
+	copy(data[36<<20:], bytes.Repeat([]byte{0x9a}, 8192))
+	req := httptest.NewRequest(http.MethodPost, "/upload?src=raw&dst=vhdx&name=disk.vhdx", bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.ContentLength = int64(len(data))
+	rr := httptest.NewRecorder()
+	uploadHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+	}
+	var resp importResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode resp: %v", err)
+	}
+	if fi, err := os.Stat(resp.Output); err != nil || fi.Size() != 4<<20+32<<20 {
+		t.Fatalf("vhdx output size: %v %v", fi, err)
+	}
+
+	source, err := transferio.NewFileReadStorage(resp.Output)
+	if err != nil {
+		t.Fatalf("open output: %v", err)
+	}
+	out := filepath.Join(dir, "out.raw")
+	sink, err := transferio.NewFileWriteStorage(out, false)
+	if err != nil {
+		t.Fatalf("new sink: %v", err)
+	}
+	c := &converter.StreamConverter{Reader: vhdx.NewReader(source), Writer: raw.NewWriter(sink, false)}
+	if _, _, err := c.Run(context.Background()); err != nil {
+		t.Fatalf("convert back: %v", err)
+	}
+	b, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("read output: %v", err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Fatalf("vhdx round trip mismatch")
+	}
+}
+
+func TestExportRawToOVA(t *testing.T) {
+	dir := t.TempDir()
+	serverOutputDir = dir
+
+	data := make([]byte, 2<<20+4096)
+	copy(data[1<<20:], bytes.Repeat([]byte{0x3c}, 8192))
+	srcPath := filepath.Join(dir, "appliance.raw")
+	if err := os.WriteFile(srcPath, data, 0644); err != nil {
+		t.Fatalf("write src: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/export?src=raw&dst=ova&path="+srcPath, nil)
+	rr := httptest.NewRecorder()
+	exportHandler(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+	}
+	if cd := rr.Header().Get("Content-Disposition"); cd != "attachment; filename=\"appliance.ova\"" {
+		t.Fatalf("content-disposition=%s", cd)
+	}
+
+	var names []string
+	files := map[string][]byte{}
+	tr := tar.NewReader(rr.Body)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("read tar: %v", err)
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("read %s: %v", hdr.Name, err)
+		}
+		names = append(names, hdr.Name)
+		files[hdr.Name] = b
+	}
+	want := []string{"appliance.ovf", "appliance-disk1.vmdk", "appliance.mf"}
+	if strings.Join(names, ",") != strings.Join(want, ",") {
+		t.Fatalf("entries=%v", names)
+	}
+
+	disk := files["appliance-disk1.vmdk"]
+	envelope := string(files["appliance.ovf"])
+	for _, attr := range []string{
+		`ovf:href="appliance-disk1.vmdk"`,
+		`ovf:size="` + strconv.Itoa(len(disk)) + `"`,
+		`ovf:capacity="` + strconv.Itoa(len(data)) + `"`,
+		`vmdk.html#streamOptimized"`,
+	} {
+		if !strings.Contains(envelope, attr) {
+			t.Fatalf("envelope lacks %s:\n%s", attr, envelope)
+		}
+	}
+	var manifest strings.Builder
+	for _, name := range want[:2] {
+		fmt.Fprintf(&manifest, "SHA256(%s)= %x\n", name, sha256.Sum256(files[name]))
+	}
+	if got := string(files["appliance.mf"]); got != manifest.String() {
+		t.Fatalf("manifest=%q want %q", got, manifest.String())
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/upload?src=vmdk&dst=raw&name=disk.raw", bytes.NewReader(disk))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.ContentLength = int64(len(disk))
+	rr = httptest.NewRecorder()
+	uploadHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "disk.raw"))
+	if err != nil {
+		t.Fatalf("read output: %v", err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Fatalf("ova disk content mismatch")
+	}
+}
+
+func TestUploadOVAToRaw(t *testing.T) {
+	dir := t.TempDir()
+	serverOutputDir = dir
+
+	data1 := make([]byte, 1<<20)
+	copy(data1[4096:], bytes.Repeat([]byte{0x11}, 4096))
+	data2 := make([]byte, 2<<20)
+	copy(data2[1<<20:], bytes.Repeat([]byte{0x22}, 8192))
+	disk1, err := os.ReadFile(createVMDKFromRaw(t, dir, "d1.vmdk", data1))
+	if err != nil {
+		t.Fatalf("read vmdk: %v", err)
+	}
+	disk2, err := os.ReadFile(createVMDKFromRaw(t, dir, "d2.vmdk", data2))
+	if err != nil {
+		t.Fatalf("read vmdk: %v", err)
+	}
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(disk2)
+	zw.Close()
+
+	// A blank disk comes first; the second data disk is gzip compressed and
+	// the manifest is stored before the disks.
+	envelope := `<?xml version="1.0"?>
+<Envelope xmlns="http://schemas.dmtf.org/ovf/envelope/2" xmlns:ovf="http://schemas.dmtf.org/ovf/envelope/2">
+  <References>
+    <File ovf:href="vm-disk2.vmdk.gz" ovf:id="f2" ovf:compression="gzip"/>
+    <File ovf:href="vm-disk1.vmdk" ovf:id="f1"/>
+  </References>
+  <DiskSection>
+    <Info>Disks</Info>
+    <Disk ovf:diskId="blank" ovf:capacity="1073741824"/>
+    <Disk ovf:diskId="d1" ovf:fileRef="f1" ovf:format="http://www.vmware.com/interfaces/specifications/vmdk.html#streamOptimized"/>
+    <Disk ovf:diskId="d2" ovf:fileRef="f2" ovf:format="http://www.vmware.com/specifications/vmdk.html#streamOptimized"/>
+  </DiskSection>
+</Envelope>`
+	var ovaBuf bytes.Buffer
+	tw := tar.NewWriter(&ovaBuf)
+	for _, f := range []struct {
+		name string
+		data []byte
+	}{
+		{"vm.ovf", []byte(envelope)},
+		{"vm.mf", []byte("SHA256(vm.ovf)= 00\n")},
+		{"vm-disk1.vmdk", disk1},
+		{"vm-disk2.vmdk.gz", gz.Bytes()},
+	} {
+		tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0o644, Size: int64(len(f.data))})
+		tw.Write(f.data)
+	}
+	tw.Close()
+	img := ovaBuf.Bytes()
+
+	upload := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/upload?src=ova&dst=raw&"+query, bytes.NewReader(img))
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.ContentLength = int64(len(img))
+		rr := httptest.NewRecorder()
+		uploadHandler(rr, req)
+		return rr
+	}
+	for _, tc := range []struct {
+		index string
+		want  []byte
+	}{{"1", data1}, {"2", data2}} {
+		rr := upload("diskIndex=" + tc.index + "&name=disk" + tc.index + ".raw")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+		}
+		b, err := os.ReadFile(filepath.Join(dir, "disk"+tc.index+".raw"))
+		if err != nil {
+			t.Fatalf("read output: %v", err)
+		}
+		if !bytes.Equal(b, tc.want) {
+			t.Fatalf("disk %s content mismatch", tc.index)
+		}
+	}
+	for _, query := range []string{"diskIndex=0", "diskIndex=3"} {
+		if rr := upload(query + "&name=bad.raw"); rr.Code != http.StatusBadGateway {
+			t.Fatalf("%s: status=%d body=%s", query, rr.Code, rr.Body.String())
+		}
+	}
+	if rr := upload("diskIndex=x&name=bad.raw"); rr.Code != http.StatusBadRequest {
+		t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+	}
+
+	// Appliances written by the ova destination read back.
+	srcPath := filepath.Join(dir, "src.raw")
+	if err := os.WriteFile(srcPath, data2, 0644); err != nil {
+		t.Fatalf("write src: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/export?src=raw&dst=ova&path="+srcPath, nil)
+	rr := httptest.NewRecorder()
+	exportHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+	}
+	ovaPath := filepath.Join(dir, "src.ova")
+	if err := os.WriteFile(ovaPath, rr.Body.Bytes(), 0644); err != nil {
+		t.Fatalf("write ova: %v", err)
+	}
+	req = httptest.NewRequest(http.MethodGet, "/export?src=ova&dst=raw&path="+ovaPath, nil)
+	rr = httptest.NewRecorder()
+	exportHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+	}
+	if !bytes.Equal(rr.Body.Bytes(), data2) {
+		t.Fatalf("ova round trip mismatch")
+	}
+}
+
+func TestUploadCompressedSources(t *testing.T) {
+	dir := t.TempDir()
+	serverOutputDir = dir
+
+	data := make([]byte, 1<<20)
+	copy(data[4096:], bytes.Repeat([]byte{0x5a}, 8192))
+	copy(data[len(data)-512:], bytes.Repeat([]byte("end!"), 128))
+
+	compressed := map[string][]byte{}
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Write(data)
+	gw.Close()
+	compressed["gzip"] = append([]byte(nil), buf.Bytes()...)
+	buf.Reset()
+	xw, err := xz.NewWriter(&buf)
+	if err != nil {
+		t.Fatalf("xz writer: %v", err)
+	}
+	xw.Write(data)
+	xw.Close()
+	compressed["xz"] = append([]byte(nil), buf.Bytes()...)
+	zw, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatalf("zstd writer: %v", err)
+	}
+	compressed["zstd"] = zw.EncodeAll(data, nil)
+	// The same data compressed with bzip2 -9.
+	compressed["bzip2"], _ = hex.DecodeString("425a6839314159265359391ef6910000107302c0040004200000100601002000082000722006014a918993a0ce2515567d5455535b018b20df80b803eaaaef407152aab410c5dc914e14240e47bda440")
+
+	upload := func(query string, body []byte) importResponse {
+		req := httptest.NewRequest(http.MethodPost, "/upload?"+query, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.ContentLength = int64(len(body))
+		rr := httptest.NewRecorder()
+		uploadHandler(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: status=%d body=%s", query, rr.Code, rr.Body.String())
+		}
+		var resp importResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decode resp: %v", err)
+		}
+		return resp
+	}
+	for name, body := range compressed {
+		for _, decompress := range []string{"", "&decompress=" + name} {
+			resp := upload("src=raw&dst=raw&name="+name+".raw"+decompress, body)
+			b, err := os.ReadFile(resp.Output)
+			if err != nil {
+				t.Fatalf("read output: %v", err)
+			}
+			if !bytes.Equal(b, data) {
+				t.Fatalf("%s content mismatch", name)
+			}
+			// Only zstd records the size in a header at the start; the
+			// compressed size is never taken as the capacity.
+			want := uint64(0)
+			if name == "zstd" {
+				want = uint64(len(data))
+			}
+			if resp.CapacityBytes != want {
+				t.Fatalf("%s capacity=%d want %d", name, resp.CapacityBytes, want)
+			}
+		}
+	}
+
+	// Raw sources of unknown size are buffered for destinations that need
+	// the capacity up front.
+	resp := upload("src=raw&dst=vmdk&name=gzip.vmdk", compressed["gzip"])
+	if resp.CapacityBytes != uint64(len(data)) {
+		t.Fatalf("capacity=%d", resp.CapacityBytes)
+	}
+	vmdkBytes, err := os.ReadFile(resp.Output)
+	if err != nil {
+		t.Fatalf("read output: %v", err)
+	}
+	resp = upload("src=vmdk&dst=raw&name=gzip-vmdk.raw", vmdkBytes)
+	if b, err := os.ReadFile(resp.Output); err != nil || !bytes.Equal(b, data) {
+		t.Fatalf("gzip vmdk content mismatch: %v", err)
+	}
+
+	// Image formats are decompressed before they are parsed.
+	resp = upload("src=raw&dst=qcow2&name=disk.qcow2", data)
+	img, err := os.ReadFile(resp.Output)
+	if err != nil {
+		t.Fatalf("read output: %v", err)
+	}
+	buf.Reset()
+	gw = gzip.NewWriter(&buf)
+	gw.Write(img)
+	gw.Close()
+	resp = upload("src=qcow2&dst=raw&name=qcow2.raw", buf.Bytes())
+	if b, err := os.ReadFile(resp.Output); err != nil || !bytes.Equal(b, data) {
+		t.Fatalf("qcow2.gz content mismatch: %v", err)
+	}
+
+	// Local xz files have their size read from the index.
+	xzPath := filepath.Join(dir, "disk.raw.xz")
+	if err := os.WriteFile(xzPath, compressed["xz"], 0644); err != nil {
+		t.Fatalf("write src: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/export?src=raw&dst=vmdk&path="+xzPath, nil)
+	rr := httptest.NewRecorder()
+	exportHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+	}
+	resp = upload("src=vmdk&dst=raw&name=xz.raw", rr.Body.Bytes())
+	if b, err := os.ReadFile(resp.Output); err != nil || !bytes.Equal(b, data) {
+		t.Fatalf("xz vmdk content mismatch: %v", err)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/upload?src=raw&dst=raw&decompress=xz&name=bad.raw", bytes.NewReader(compressed["gzip"]))
+	rr = httptest.NewRecorder()
+	uploadHandler(rr, req)
+	if rr.Code != http.StatusBadGateway || !strings.Contains(rr.Body.String(), "not xz compressed") {
+		t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestExportCompressedRaw(t *testing.T) {
+	dir := t.TempDir()
+	serverOutputDir = dir
+
+	data := make([]byte, 3<<20)
+	for i := 1 << 20; i < 2<<20; i++ {
+		data[i] = byte(i * 7)
+	}
+	srcPath := createVMDKFromRaw(t, dir, "disk.vmdk", data)
+
+	for _, tc := range []struct {
+		query string
+		name  string
+	}{
+		{"compress=gzip&compressLevel=1", "disk.vmdk.gz"},
+		{"compress=xz", "disk.vmdk.xz"},
+		{"compress=zstd&compressLevel=19&compressThreads=4", "disk.vmdk.zst"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/export?src=vmdk&dst=raw&"+tc.query+"&path="+srcPath, nil)
+		rr := httptest.NewRecorder()
+		exportHandler(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: status=%d body=%s", tc.query, rr.Code, rr.Body.String())
+		}
+		if cd := rr.Header().Get("Content-Disposition"); cd != "attachment; filename=\""+tc.name+"\"" {
+			t.Fatalf("content-disposition=%s", cd)
+		}
+		if rr.Body.Len() >= len(data)/2 {
+			t.Fatalf("%s: %d bytes not compressed", tc.query, rr.Body.Len())
+		}
+
+		// The output decompresses back to the disk.
+		body := rr.Body.Bytes()
+		req = httptest.NewRequest(http.MethodPost, "/upload?src=raw&dst=raw&name=out.raw", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.ContentLength = int64(len(body))
+		rr = httptest.NewRecorder()
+		uploadHandler(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+		}
+		b, err := os.ReadFile(filepath.Join(dir, "out.raw"))
+		if err != nil {
+			t.Fatalf("read output: %v", err)
+		}
+		if !bytes.Equal(b, data) {
+			t.Fatalf("%s: content mismatch", tc.query)
+		}
+	}
+
+	for _, query := range []string{
+		"dst=raw&compress=deflate",
+		"dst=raw&compress=gzip&compressThreads=2",
+		"dst=raw&compress=gzip&compressLevel=10",
+		"dst=vmdk&compressLevel=3",
+		"dst=raw&compressLevel=x",
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/export?src=vmdk&"+query+"&path="+srcPath, nil)
+		rr := httptest.NewRecorder()
+		exportHandler(rr, req)
+		if rr.Code != http.StatusBadRequest {
+			t.Fatalf("%s: status=%d body=%s", query, rr.Code, rr.Body.String())
+		}
+	}
+}
+
+func TestExportRawToGCETar(t *testing.T) {
+	dir := t.TempDir()
+	serverOutputDir = dir
+
+	// More data regions than fit in the tar header, so the sparse map needs
+	// an extension block, and a hole at the end.
+	data := make([]byte, 8<<20)
+	for i := 0; i < 10; i++ {
+		copy(data[i*(512<<10)+4096:], bytes.Repeat([]byte{byte(i + 1)}, 8192+i*4096))
+	}
+	srcPath := filepath.Join(dir, "disk.img")
+	if err := os.WriteFile(srcPath, data, 0o644); err != nil {
+		t.Fatalf("write source: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/export?src=raw&dst=gce-tar&path="+srcPath, nil)
+	rr := httptest.NewRecorder()
+	exportHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+	}
+	if cd := rr.Header().Get("Content-Disposition"); cd != "attachment; filename=\"disk.tar.gz\"" {
+		t.Fatalf("content-disposition=%s", cd)
+	}
+	img := rr.Body.Bytes()
+
+	zr, err := gzip.NewReader(bytes.NewReader(img))
+	if err != nil {
+		t.Fatalf("gzip: %v", err)
+	}
+	var archive bytes.Buffer
+	if _, err := io.Copy(&archive, zr); err != nil {
+		t.Fatalf("gunzip: %v", err)
+	}
+	if archive.Len() > 1<<20 {
+		t.Fatalf("tarball of %d bytes is not sparse", archive.Len())
+	}
+	tr := tar.NewReader(bytes.NewReader(archive.Bytes()))
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatalf("tar: %v", err)
+	}
+	if hdr.Name != "disk.raw" || hdr.Typeflag != tar.TypeGNUSparse || hdr.Size != int64(len(data)) {
+		t.Fatalf("header name=%s type=%c size=%d", hdr.Name, hdr.Typeflag, hdr.Size)
+	}
+	b, err := io.ReadAll(tr)
+	if err != nil {
+		t.Fatalf("read disk.raw: %v", err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Fatalf("disk.raw mismatch")
+	}
+	if _, err := tr.Next(); err != io.EOF {
+		t.Fatalf("expected a single file, got %v", err)
+	}
+
+	// The tarball converts back to the disk.
+	req = httptest.NewRequest(http.MethodPost, "/upload?src=gce-tar&dst=raw&name=out.raw", bytes.NewReader(img))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.ContentLength = int64(len(img))
+	rr = httptest.NewRecorder()
+	uploadHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+	}
+	b, err = os.ReadFile(filepath.Join(dir, "out.raw"))
+	if err != nil {
+		t.Fatalf("read output: %v", err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Fatalf("content mismatch")
+	}
+
+	// Without decompression the tarball is not found in the gzip stream.
+	req = httptest.NewRequest(http.MethodPost, "/upload?src=gce-tar&dst=raw&decompress=none&name=none.raw", bytes.NewReader(img))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.ContentLength = int64(len(img))
+	rr = httptest.NewRecorder()
+	uploadHandler(rr, req)
+	if rr.Code != http.StatusBadGateway || !strings.Contains(rr.Body.String(), "image tarball") {
+		t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/export?src=raw&dst=gce-tar&compressThreads=2&path="+srcPath, nil)
+	rr = httptest.NewRecorder()
+	exportHandler(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+	}
+}
+
+// buildSimg builds an Android sparse image with 16-byte chunk headers and a
+// 32-byte file header, as some tools write them, and returns it with the disk
+// it holds.
+func buildSimg(t *testing.T, blockSize int, corruptCRC bool) ([]byte, []byte) {
+	t.Helper()
+	var disk, body bytes.Buffer
+	chunks := 0
+	chunk := func(typ uint16, blocks int, data []byte) {
+		hdr := make([]byte, 16)
+		binary.LittleEndian.PutUint16(hdr[0:], typ)
+		binary.LittleEndian.PutUint32(hdr[4:], uint32(blocks))
+		binary.LittleEndian.PutUint32(hdr[8:], uint32(16+len(data)))
+		body.Write(hdr)
+		body.Write(data)
+		chunks++
+	}
+	checksum := func() {
+		sum := crc32.ChecksumIEEE(disk.Bytes())
+		if corruptCRC {
+			sum++
+		}
+		chunk(0xcac4, 0, binary.LittleEndian.AppendUint32(nil, sum))
+	}
+
+	raw := make([]byte, 2*blockSize)
+	for i := range raw {
+		raw[i] = byte(i*13 + 5)
+	}
+	chunk(0xcac1, 2, raw)
+	disk.Write(raw)
+	checksum()
+	chunk(0xcac3, 3, nil)
+	disk.Write(make([]byte, 3*blockSize))
+	chunk(0xcac2, 2, []byte{0x44, 0x33, 0x22, 0x11})
+	disk.Write(bytes.Repeat([]byte{0x44, 0x33, 0x22, 0x11}, 2*blockSize/4))
+	chunk(0xcac2, 1, make([]byte, 4))
+	disk.Write(make([]byte, blockSize))
+	checksum()
+	chunk(0xcac1, 1, raw[:blockSize])
+	disk.Write(raw[:blockSize])
+
+	hdr := make([]byte, 32)
+	binary.LittleEndian.PutUint32(hdr[0:], 0xed26ff3a)
+	binary.LittleEndian.PutUint16(hdr[4:], 1)
+	binary.LittleEndian.PutUint16(hdr[8:], 32)
+	binary.LittleEndian.PutUint16(hdr[10:], 16)
+	binary.LittleEndian.PutUint32(hdr[12:], uint32(blockSize))
+	binary.LittleEndian.PutUint32(hdr[16:], uint32(disk.Len()/blockSize))
+	binary.LittleEndian.PutUint32(hdr[20:], uint32(chunks))
+	return append(hdr, body.Bytes()...), disk.Bytes()
+}
+
+func TestUploadSimgToRaw(t *testing.T) {
+	dir := t.TempDir()
+	serverOutputDir = dir
+
+	upload := func(img []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/upload?src=simg&dst=raw&name=out.raw", bytes.NewReader(img))
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.ContentLength = int64(len(img))
+		rr := httptest.NewRecorder()
+		uploadHandler(rr, req)
+		return rr
+	}
+
+	img, data := buildSimg(t, 4096, false)
+	rr := upload(img)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+	}
+	var resp importResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if resp.CapacityBytes != uint64(len(data)) {
+		t.Fatalf("capacity=%d, want %d", resp.CapacityBytes, len(data))
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "out.raw"))
+	if err != nil {
+		t.Fatalf("read output: %v", err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Fatalf("content mismatch")
+	}
+
+	img, _ = buildSimg(t, 4096, true)
+	rr = upload(img)
+	if rr.Code != http.StatusBadGateway || !strings.Contains(rr.Body.String(), "checksum mismatch") {
+		t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestExportRawToSimg(t *testing.T) {
+	dir := t.TempDir()
+	serverOutputDir = dir
+
+	data := make([]byte, 1<<20+300)
+	for i := 64 << 10; i < 128<<10; i++ {
+		data[i] = byte(i * 7)
+	}
+	for i := 512 << 10; i < 768<<10; i += 4 {
+		binary.LittleEndian.PutUint32(data[i:], 0xcafef00d)
+	}
+	copy(data[1<<20:], bytes.Repeat([]byte{0x99}, 300))
+	srcPath := filepath.Join(dir, "disk.img")
+	if err := os.WriteFile(srcPath, data, 0o644); err != nil {
+		t.Fatalf("write source: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/export?src=raw&dst=simg&blockSize=1024&path="+srcPath, nil)
+	rr := httptest.NewRecorder()
+	exportHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+	}
+	if cd := rr.Header().Get("Content-Disposition"); cd != "attachment; filename=\"disk.simg\"" {
+		t.Fatalf("content-disposition=%s", cd)
+	}
+	img := rr.Body.Bytes()
+	if binary.LittleEndian.Uint32(img) != 0xed26ff3a || binary.LittleEndian.Uint32(img[12:]) != 1024 {
+		t.Fatalf("unexpected header % x", img[:28])
+	}
+	// Only the data that is neither zeros nor a fill pattern is stored.
+	if len(img) > 80<<10 {
+		t.Fatalf("image of %d bytes is not sparse", len(img))
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/upload?src=simg&dst=raw&name=out.raw", bytes.NewReader(img))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.ContentLength = int64(len(img))
+	rr = httptest.NewRecorder()
+	uploadHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "out.raw"))
+	if err != nil {
+		t.Fatalf("read output: %v", err)
+	}
+	// The disk is padded to a whole block.
+	if len(b) != 1<<20+1024 || !bytes.Equal(b[:len(data)], data) || !bytes.Equal(b[len(data):], make([]byte, len(b)-len(data))) {
+		t.Fatalf("content mismatch")
+	}
+
+	for _, query := range []string{"dst=simg&blockSize=1001", "dst=raw&blockSize=4096"} {
+		req := httptest.NewRequest(http.MethodGet, "/export?src=raw&"+query+"&path="+srcPath, nil)
+		rr := httptest.NewRecorder()
+		exportHandler(rr, req)
+		if rr.Code != http.StatusBadRequest {
+			t.Fatalf("%s: status=%d body=%s", query, rr.Code, rr.Body.String())
+		}
+	}
+}
+
+func TestAutoDetectSourceFormat(t *testing.T) {
+	dir := t.TempDir()
+	serverOutputDir = dir
+
+	data := make([]byte, 2<<20)
+	for i := 512 << 10; i < 640<<10; i++ {
+		data[i] = byte(i*31 + 7)
+	}
+	upload := func(query string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/upload?"+query, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.ContentLength = int64(len(body))
+		rr := httptest.NewRecorder()
+		uploadHandler(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: status=%d body=%s", query, rr.Code, rr.Body.String())
+		}
+		return rr
+	}
+	convert := func(query string) []byte {
+		upload("src=raw&name=image&"+query, data)
+		img, err := os.ReadFile(filepath.Join(dir, "image"))
+		if err != nil {
+			t.Fatalf("read image: %v", err)
+		}
+		return img
+	}
+	check := func(name string, img []byte, want string) {
+		rr := upload("src=auto&dst=raw&name=out.raw", img)
+		var resp importResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decode response: %v", err)
+		}
+		if resp.DetectedFormat != want {
+			t.Fatalf("%s: detected %q, want %q", name, resp.DetectedFormat, want)
+		}
+		b, err := os.ReadFile(filepath.Join(dir, "out.raw"))
+		if err != nil {
+			t.Fatalf("read output: %v", err)
+		}
+		if !bytes.Equal(b, data) {
+			t.Fatalf("%s: content mismatch", name)
+		}
+	}
+
+	for _, tc := range []struct {
+		query string
+		want  string
+	}{
+		{"dst=qcow2", "qcow2"},
+		{"dst=vmdk", "vmdk"},
+		{"dst=vmdk&subformat=monolithicSparse", "vmdk"},
+		{"dst=vhd&subformat=dynamic", "vhd"},
+		{"dst=vhdx", "vhdx"},
+		{"dst=vdi", "vdi"},
+		{"dst=simg", "simg"},
+		{"dst=ova", "ova"},
+		{"dst=gce-tar", "gce-tar"},
+		{"dst=raw", "raw"},
+	} {
+		check(tc.query, convert(tc.query), tc.want)
+	}
+
+	// Compressed wrappers are looked through.
+	var xzBuf bytes.Buffer
+	xw, err := xz.NewWriter(&xzBuf)
+	if err != nil {
+		t.Fatalf("xz: %v", err)
+	}
+	xw.Write(convert("dst=qcow2"))
+	xw.Close()
+	check("xz qcow2", xzBuf.Bytes(), "qcow2")
+
+	// Fixed vhd images are recognized by the footer at their end, which needs
+	// a local source.
+	fixed := convert("dst=vhd&subformat=fixed")
+	fixedPath := filepath.Join(dir, "fixed.vhd")
+	if err := os.WriteFile(fixedPath, fixed, 0o644); err != nil {
+		t.Fatalf("write image: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/export?src=auto&dst=raw&path="+fixedPath, nil)
+	rr := httptest.NewRecorder()
+	exportHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+	}
+	if !bytes.Equal(rr.Body.Bytes(), data) {
+		t.Fatalf("fixed vhd: content mismatch")
+	}
+}
+
+func TestFormatRegistry(t *testing.T) {
+	dir := t.TempDir()
+	serverOutputDir = dir
+	srcPath := filepath.Join(dir, "disk.img")
+	data := bytes.Repeat([]byte{0x5a}, 1<<20)
+	if err := os.WriteFile(srcPath, data, 0644); err != nil {
+		t.Fatalf("write src: %v", err)
+	}
+	export := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/export?"+query+"&path="+srcPath, nil)
+		rr := httptest.NewRecorder()
+		exportHandler(rr, req)
+		return rr
+	}
+
+	// Aliases resolve to the registered format, including its extension.
+	rr := export("src=img&dst=vpc&subformat=fixed")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status=%d body=%s", rr.Code, rr.Body.String())
+	}
+	if cd := rr.Header().Get("Content-Disposition"); cd != `attachment; filename="disk.vhd"` {
+		t.Fatalf("Content-Disposition=%q", cd)
+	}
+	if body := rr.Body.Bytes(); len(body) != len(data)+512 || !bytes.Equal(body[:len(data)], data) {
+		t.Fatalf("unexpected fixed vhd of %d bytes", len(body))
+	}
+
+	for _, tc := range []struct {
+		query string
+		want  string
+	}{
+		{"src=raw&dst=foo", "unsupported destination format: foo"},
+		{"src=foo&dst=raw", "unsupported source format: foo"},
+		{"src=raw&dst=vhd&subformat=fixed&blockSize=8192", "blockSize is only supported for simg destinations"},
+		{"src=raw&dst=vmdk&compressLevel=3", "compressLevel is only supported for gce-tar and raw destinations"},
+		{"src=raw&dst=raw&subformat=fixed", "subformat is only supported for vhd and vmdk destinations"},
+		{"src=raw&dst=raw&snapshot=1", "snapshot is only supported for qcow2 sources"},
+		{"src=raw&dst=vdi", "vdi output needs a seekable destination"},
+	} {
+		rr := export(tc.query)
+		if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), tc.want) {
+			t.Fatalf("%s: status=%d body=%s", tc.query, rr.Code, rr.Body.String())
+		}
+	}
+
+	if got := strings.Join(diskfmt.Names(diskfmt.Writable|diskfmt.NeedsSeekableSink), ","); got != "qcow2,vdi,vhdx" {
+		t.Fatalf("formats needing a seekable sink: %s", got)
+	}
+	if got := strings.Join(diskfmt.Names(diskfmt.Readable|diskfmt.NeedsRandomAccessSource), ","); got != "qcow2,vdi,vhd,vhdx" {
+		t.Fatalf("formats needing a random access source: %s", got)
+	}
+	if f, _ := diskfmt.Lookup("vmdk"); !f.NeedsRandomAccessSource(vmdk.SubformatMonolithicSparse) || f.NeedsRandomAccessSource(vmdk.SubformatStreamOptimized) {
+		t.Fatalf("vmdk subformats needing a random access source")
+	}
+
+	// Embedding applications pass the options type of the format itself.
+	writer, err := diskfmt.NewWriter("vpc", nil, &vhd.WriterOptions{Subformat: vhd.SubformatFixed})
+	if err != nil {
+		t.Fatalf("typed options: %v", err)
+	}
+	if vw := writer.(*vhd.Writer); vw.Subformat != vhd.SubformatFixed {
+		t.Fatalf("subformat=%q", vw.Subformat)
+	}
+	if _, err := diskfmt.NewWriter("vhd", nil, &vmdk.WriterOptions{}); err == nil || !strings.Contains(err.Error(), "vhd destinations take options of type *vhd.WriterOptions") {
+		t.Fatalf("options of another format: %v", err)
+	}
+}
+
+// failingSink is a seekable sink whose writes fail once fail is set and which
+// records whether it was closed.
+type failingSink struct {
+	fail   bool
+	closed bool
+}
+
+func (s *failingSink) WriteAt(p []byte, off int64) (int, error) {
+	if s.fail {
+		return 0, fmt.Errorf("disk full")
+	}
+	return len(p), nil
+}
+
+func (s *failingSink) Preallocate(ctx context.Context, size int64) error { return nil }
+func (s *failingSink) Size() (int64, bool)                               { return 0, false }
+func (s *failingSink) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestWriterCloseErrorClosesSink(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts diskfmt.Params
+	}{
+		{"qcow2", nil},
+		{"vhd", diskfmt.Params{"subformat": "dynamic"}},
+		{"vhdx", nil},
+		{"vdi", nil},
+		{"vmdk", diskfmt.Params{"subformat": "monolithicSparse"}},
+		{"vmdk", nil},
+	} {
+		sink := &failingSink{}
+		w, err := diskfmt.NewWriter(tc.name, sink, tc.opts)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if err := w.Open(context.Background(), 1<<20); err != nil {
+			t.Fatalf("%s: open: %v", tc.name, err)
+		}
+		if _, err := w.Write(bytes.Repeat([]byte{0x5a}, 1<<20-512)); err != nil {
+			t.Fatalf("%s: write: %v", tc.name, err)
+		}
+		sink.fail = true
+		if err := w.Close(); err == nil || !sink.closed {
+			t.Fatalf("%s %v: close err=%v closed=%v", tc.name, tc.opts, err, sink.closed)
+		}
+	}
+}
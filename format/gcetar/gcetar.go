@@ -0,0 +1,117 @@
+package format
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// DiskName is the name of the only file of a Compute Engine image
+	// tarball.
+	DiskName = "disk.raw"
+
+	// BlockSize is the size of tar headers and the unit file data is padded to.
+	BlockSize = 512
+
+	// MaxSparseEntries bounds the sparse map. Go's archive/tar refuses maps of
+	// more than about 43000 entries.
+	MaxSparseEntries = 32768
+
+	typeGNUSparse = 'S'
+	// Number of sparse entries in the header and in each extension block.
+	headerEntries    = 4
+	extensionEntries = 21
+	entrySize        = 24
+)
+
+// SparseEntry is a region of a sparse file whose data is stored in the
+// archive. Everything outside the entries reads as zeros.
+type SparseEntry struct {
+	Offset int64
+	Length int64
+}
+
+// SparseHeader returns the header blocks of a sparse file stored in the old
+// GNU format, as written by tar --format=oldgnu -S: the header with the first
+// entries of the sparse map, followed by extension blocks with the others.
+// The data of the entries follows the header blocks, one after the other,
+// padded to BlockSize. When the file ends with a hole, an empty entry at
+// realSize marks its end, like GNU tar does.
+func SparseHeader(name string, realSize int64, entries []SparseEntry, modTime time.Time) ([]byte, error) {
+	if len(name) >= 100 {
+		return nil, fmt.Errorf("tar file name %q is too long", name)
+	}
+	var stored int64
+	end := int64(0)
+	for _, e := range entries {
+		if e.Offset < end || e.Length <= 0 || e.Offset+e.Length > realSize {
+			return nil, fmt.Errorf("invalid sparse entry %d+%d", e.Offset, e.Length)
+		}
+		end = e.Offset + e.Length
+		stored += e.Length
+	}
+	if end < realSize || len(entries) == 0 {
+		entries = append(entries[:len(entries):len(entries)], SparseEntry{Offset: realSize})
+	}
+
+	extensions := 0
+	if len(entries) > headerEntries {
+		extensions = (len(entries) - headerEntries + extensionEntries - 1) / extensionEntries
+	}
+	b := make([]byte, BlockSize*(1+extensions))
+	h := b[:BlockSize]
+	copy(h[0:100], name)
+	formatNumeric(h[100:108], 0o644)
+	formatNumeric(h[108:116], 0)
+	formatNumeric(h[116:124], 0)
+	formatNumeric(h[124:136], stored)
+	formatNumeric(h[136:148], modTime.Unix())
+	h[156] = typeGNUSparse
+	copy(h[257:265], "ustar  \x00")
+	formatNumeric(h[483:495], realSize)
+
+	putEntries := func(area []byte, entries []SparseEntry) {
+		for i, e := range entries {
+			formatNumeric(area[i*entrySize:][:12], e.Offset)
+			formatNumeric(area[i*entrySize+12:][:12], e.Length)
+		}
+	}
+	n := min(len(entries), headerEntries)
+	putEntries(h[386:], entries[:n])
+	if extensions > 0 {
+		h[482] = 1
+	}
+	entries = entries[n:]
+	for i := 0; i < extensions; i++ {
+		ext := b[BlockSize*(1+i):][:BlockSize]
+		n := min(len(entries), extensionEntries)
+		putEntries(ext, entries[:n])
+		entries = entries[n:]
+		if i < extensions-1 {
+			ext[extensionEntries*entrySize] = 1
+		}
+	}
+
+	// The checksum is computed with the checksum field set to spaces.
+	copy(h[148:156], "        ")
+	var sum int64
+	for _, c := range h {
+		sum += int64(c)
+	}
+	copy(h[148:156], fmt.Sprintf("%06o\x00 ", sum))
+	return b, nil
+}
+
+// formatNumeric stores n as a NUL terminated octal number, or in the GNU
+// base-256 encoding when it does not fit.
+func formatNumeric(b []byte, n int64) {
+	if n < 1<<(3*(len(b)-1)) {
+		copy(b, fmt.Sprintf("%0*o\x00", len(b)-1, n))
+		return
+	}
+	for i := len(b) - 1; i > 0; i-- {
+		b[i] = byte(n)
+		n >>= 8
+	}
+	b[0] = 0x80
+}
@@ -0,0 +1,63 @@
+package format
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestSparseHeaderReadsBack(t *testing.T) {
+	// Enough entries for two extension blocks and a size that needs the
+	// base-256 encoding.
+	realSize := int64(1) << 40
+	var entries []SparseEntry
+	var data bytes.Buffer
+	for i := int64(0); i < 30; i++ {
+		e := SparseEntry{Offset: i * 3 << 30, Length: 512 + i}
+		entries = append(entries, e)
+		data.Write(bytes.Repeat([]byte{byte(i + 1)}, int(e.Length)))
+	}
+	hdr, err := SparseHeader(DiskName, realSize, entries, time.Unix(1700000000, 0))
+	if err != nil {
+		t.Fatalf("SparseHeader: %v", err)
+	}
+	if len(hdr) != 3*BlockSize {
+		t.Fatalf("header of %d bytes", len(hdr))
+	}
+
+	var archive bytes.Buffer
+	archive.Write(hdr)
+	archive.Write(data.Bytes())
+	archive.Write(make([]byte, (BlockSize-data.Len()%BlockSize)%BlockSize+2*BlockSize))
+
+	tr := tar.NewReader(&archive)
+	h, err := tr.Next()
+	if err != nil {
+		t.Fatalf("Next: %v", err)
+	}
+	if h.Name != DiskName || h.Typeflag != tar.TypeGNUSparse || h.Size != realSize || h.ModTime.Unix() != 1700000000 {
+		t.Fatalf("header %+v", h)
+	}
+	// Read the first regions and the hole between them.
+	buf := make([]byte, entries[1].Offset+entries[1].Length)
+	if _, err := io.ReadFull(tr, buf); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	for i, e := range entries[:2] {
+		if !bytes.Equal(buf[e.Offset:e.Offset+e.Length], bytes.Repeat([]byte{byte(i + 1)}, int(e.Length))) {
+			t.Fatalf("entry %d mismatch", i)
+		}
+	}
+	if !bytes.Equal(buf[entries[0].Length:entries[1].Offset], make([]byte, entries[1].Offset-entries[0].Length)) {
+		t.Fatalf("hole is not zero")
+	}
+}
+
+func TestSparseHeaderRejectsOverlap(t *testing.T) {
+	entries := []SparseEntry{{Offset: 0, Length: 1024}, {Offset: 512, Length: 512}}
+	if _, err := SparseHeader(DiskName, 4096, entries, time.Now()); err == nil {
+		t.Fatalf("overlapping entries accepted")
+	}
+}
@@ -0,0 +1,163 @@
+package format
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+)
+
+const (
+	// DiskFormatStreamOptimized is the ovf:format of streamOptimized VMDK disks.
+	DiskFormatStreamOptimized = "http://www.vmware.com/interfaces/specifications/vmdk.html#streamOptimized"
+
+	// EnvelopeExt and ManifestExt are the extensions of the descriptor and the
+	// manifest of an appliance.
+	EnvelopeExt = ".ovf"
+	ManifestExt = ".mf"
+)
+
+// envelopeTemplate is a minimal OVF 1.0 envelope describing a virtual machine
+// with a single disk attached to a SCSI controller, which VMware and
+// VirtualBox both import.
+const envelopeTemplate = `<?xml version="1.0" encoding="UTF-8"?>
+<Envelope vmw:buildId="build-0" xmlns="http://schemas.dmtf.org/ovf/envelope/1" xmlns:cim="http://schemas.dmtf.org/wbem/wscim/1/common" xmlns:ovf="http://schemas.dmtf.org/ovf/envelope/1" xmlns:rasd="http://schemas.dmtf.org/wbem/wscim/1/cim-schema/2/CIM_ResourceAllocationSettingData" xmlns:vmw="http://www.vmware.com/schema/ovf" xmlns:vssd="http://schemas.dmtf.org/wbem/wscim/1/cim-schema/2/CIM_VirtualSystemSettingData" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">
+  <References>
+    <File ovf:href="%[2]s" ovf:id="file1" ovf:size="%[3]d"/>
+  </References>
+  <DiskSection>
+    <Info>Virtual disk information</Info>
+    <Disk ovf:capacity="%[4]d" ovf:capacityAllocationUnits="byte" ovf:diskId="vmdisk1" ovf:fileRef="file1" ovf:format="%[5]s"/>
+  </DiskSection>
+  <VirtualSystem ovf:id="%[1]s">
+    <Info>A virtual machine</Info>
+    <Name>%[1]s</Name>
+    <OperatingSystemSection ovf:id="1">
+      <Info>The kind of installed guest operating system</Info>
+    </OperatingSystemSection>
+    <VirtualHardwareSection>
+      <Info>Virtual hardware requirements</Info>
+      <System>
+        <vssd:ElementName>Virtual Hardware Family</vssd:ElementName>
+        <vssd:InstanceID>0</vssd:InstanceID>
+        <vssd:VirtualSystemIdentifier>%[1]s</vssd:VirtualSystemIdentifier>
+        <vssd:VirtualSystemType>vmx-07</vssd:VirtualSystemType>
+      </System>
+      <Item>
+        <rasd:AllocationUnits>hertz * 10^6</rasd:AllocationUnits>
+        <rasd:Description>Number of Virtual CPUs</rasd:Description>
+        <rasd:ElementName>1 virtual CPU(s)</rasd:ElementName>
+        <rasd:InstanceID>1</rasd:InstanceID>
+        <rasd:ResourceType>3</rasd:ResourceType>
+        <rasd:VirtualQuantity>1</rasd:VirtualQuantity>
+      </Item>
+      <Item>
+        <rasd:AllocationUnits>byte * 2^20</rasd:AllocationUnits>
+        <rasd:Description>Memory Size</rasd:Description>
+        <rasd:ElementName>1024MB of memory</rasd:ElementName>
+        <rasd:InstanceID>2</rasd:InstanceID>
+        <rasd:ResourceType>4</rasd:ResourceType>
+        <rasd:VirtualQuantity>1024</rasd:VirtualQuantity>
+      </Item>
+      <Item>
+        <rasd:Address>0</rasd:Address>
+        <rasd:Description>SCSI Controller</rasd:Description>
+        <rasd:ElementName>SCSI Controller 0</rasd:ElementName>
+        <rasd:InstanceID>3</rasd:InstanceID>
+        <rasd:ResourceSubType>lsilogic</rasd:ResourceSubType>
+        <rasd:ResourceType>6</rasd:ResourceType>
+      </Item>
+      <Item>
+        <rasd:AddressOnParent>0</rasd:AddressOnParent>
+        <rasd:ElementName>Hard Disk 1</rasd:ElementName>
+        <rasd:HostResource>ovf:/disk/vmdisk1</rasd:HostResource>
+        <rasd:InstanceID>4</rasd:InstanceID>
+        <rasd:Parent>3</rasd:Parent>
+        <rasd:ResourceType>17</rasd:ResourceType>
+      </Item>
+    </VirtualHardwareSection>
+  </VirtualSystem>
+</Envelope>
+`
+
+// Disk describes the disk file of an appliance.
+type Disk struct {
+	// FileName is the name of the file in the package.
+	FileName string
+	// FileSize is the size of the file, Capacity the size of the virtual disk.
+	FileSize int64
+	Capacity int64
+	// Format is the ovf:format of the file, e.g. DiskFormatStreamOptimized.
+	Format string
+}
+
+// MakeEnvelope returns the OVF descriptor of a virtual machine called name
+// with a single disk.
+func MakeEnvelope(name string, disk Disk) string {
+	return fmt.Sprintf(
+		envelopeTemplate,
+		escape(name),
+		escape(disk.FileName),
+		disk.FileSize,
+		disk.Capacity,
+		escape(disk.Format),
+	)
+}
+
+// ManifestEntry returns the manifest line of a file with the given SHA-256
+// digest.
+func ManifestEntry(fileName string, sum []byte) string {
+	return fmt.Sprintf("SHA256(%s)= %s\n", fileName, hex.EncodeToString(sum))
+}
+
+func escape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+// Envelope holds the parts of an OVF descriptor that locate the disks of an
+// appliance. Elements and attributes are matched by local name, so OVF 1.x and
+// 2.x descriptors are both understood.
+type Envelope struct {
+	XMLName xml.Name      `xml:"Envelope"`
+	Files   []File        `xml:"References>File"`
+	Disks   []VirtualDisk `xml:"DiskSection>Disk"`
+}
+
+// File is a file reference of the envelope.
+type File struct {
+	ID   string `xml:"id,attr"`
+	Href string `xml:"href,attr"`
+	Size int64  `xml:"size,attr"`
+	// Compression is "gzip" for files compressed as a whole.
+	Compression string `xml:"compression,attr"`
+	// ChunkSize is set for files split into numbered chunks.
+	ChunkSize int64 `xml:"chunkSize,attr"`
+}
+
+// VirtualDisk is a disk of the disk section. Blank disks have no FileRef.
+type VirtualDisk struct {
+	DiskID  string `xml:"diskId,attr"`
+	FileRef string `xml:"fileRef,attr"`
+	Format  string `xml:"format,attr"`
+}
+
+// ParseEnvelope decodes an OVF descriptor.
+func ParseEnvelope(b []byte) (*Envelope, error) {
+	var e Envelope
+	if err := xml.Unmarshal(b, &e); err != nil {
+		return nil, fmt.Errorf("invalid OVF descriptor: %w", err)
+	}
+	return &e, nil
+}
+
+// File returns the file reference with the given ID, or nil.
+func (e *Envelope) File(id string) *File {
+	for i := range e.Files {
+		if e.Files[i].ID == id {
+			return &e.Files[i]
+		}
+	}
+	return nil
+}
@@ -10,37 +10,156 @@ import (
 	"unsafe"
 
 	"github.com/goburrow/cache"
+	"github.com/klauspost/compress/zstd"
 )
 
 const (
 	// Each table is going to be around a single cluster in size.
 	// So this will store up to 64MB of tables in memory.
 	maxCachedTables = 1000
+
+	// Longest chain of backing files that will be followed.
+	maxBackingChainDepth = 64
+
+	// Longest backing file name, as qemu limits it.
+	maxBackingFileSize = 1023
+
+	// Incompatible features this reader understands. Refcounts are never used
+	// for reading, so images left dirty (e.g. with lazy refcounts after a
+	// crash) are safe to convert. Corrupt images need Options.AllowCorrupt.
+	supportedIncompatibleFeatures = IncompatibleDirty | IncompatibleExternalData |
+		IncompatibleCompressionType | IncompatibleExtendedL2
 )
 
+var zstdDecoderPool = sync.Pool{
+	New: func() interface{} {
+		zr, _ := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+		return zr
+	},
+}
+
 type ReadAndReadAt interface {
 	io.Reader
 	io.ReaderAt
 }
 
+// Options controls how NewQcow2FormatWithOptions opens an image.
+type Options struct {
+	// OpenBacking opens a backing file by the name stored in the image header.
+	// It is called for every image in the chain. Images with a backing file are
+	// rejected when it is nil.
+	OpenBacking func(name string) (ReadAndReadAt, error)
+	// OpenDataFile opens the external data file of an image, by the name from
+	// the ExternalDataFileName extension (which may be empty). It is called
+	// for an image before its backing files. Images with an external data file
+	// are rejected when it is nil.
+	OpenDataFile func(name string) (ReadAndReadAt, error)
+	// Snapshot selects an internal snapshot by ID or name. The image then reads
+	// as it was when the snapshot was taken instead of its current state.
+	Snapshot string
+	// AllowCorrupt opens images that qemu marked corrupt. Their metadata may be
+	// inconsistent, so the converted data is not guaranteed to be correct.
+	AllowCorrupt bool
+	// Passphrase unlocks LUKS encrypted images. Every encrypted image in the
+	// backing chain is unlocked with it.
+	Passphrase []byte
+}
+
 type Qcow2Format struct {
 	header      *HeaderAndAdditionalFields
 	table       cache.LoadingCache
 	reader      ReadAndReadAt
+	data        io.ReaderAt
+	backing     io.ReaderAt
 	clusterSize int64
 	clusterPool *sync.Pool
+	snapshots   []Snapshot
+	// crypt decrypts guest clusters of LUKS encrypted images.
+	crypt *luksCipher
+
+	// The L1 table and guest size being read: the active ones, or those of the
+	// selected snapshot.
+	l1TableOffset int64
+	l1Size        int
+	size          uint64
 }
 
 func NewQcow2Format(r ReadAndReadAt) (*Qcow2Format, error) {
+	return NewQcow2FormatWithOptions(r, Options{})
+}
+
+// NewQcow2FormatWithOptions opens an image and, if it is an overlay, its chain
+// of backing files. Reads of clusters not allocated in the overlay fall through
+// to the backing file, so the result is the flattened image.
+func NewQcow2FormatWithOptions(r ReadAndReadAt, opts Options) (*Qcow2Format, error) {
+	return newQcow2Format(r, opts, 0)
+}
+
+func newQcow2Format(r ReadAndReadAt, opts Options, depth int) (*Qcow2Format, error) {
 	hdr, err := readHeader(r)
 	if err != nil {
 		return nil, err
 	}
 
+	if hdr.IncompatibleFeatures&IncompatibleCorrupt != 0 && !opts.AllowCorrupt {
+		return nil, fmt.Errorf("image is marked corrupt")
+	}
+
 	q := &Qcow2Format{
-		header:      hdr,
-		reader:      r,
-		clusterSize: int64(1 << hdr.ClusterBits),
+		header:        hdr,
+		reader:        r,
+		clusterSize:   int64(1 << hdr.ClusterBits),
+		l1TableOffset: int64(hdr.L1TableOffset),
+		l1Size:        int(hdr.L1Size),
+		size:          hdr.Size,
+	}
+
+	if hdr.NbSnapshots > 0 {
+		if err := q.checkSnapshotTable(); err != nil {
+			return nil, err
+		}
+	}
+	// Backing files are always read in their current state.
+	if opts.Snapshot != "" && depth == 0 {
+		snapshot, err := q.findSnapshot(opts.Snapshot)
+		if err != nil {
+			return nil, err
+		}
+		q.l1TableOffset = int64(snapshot.L1TableOffset)
+		q.l1Size = int(snapshot.L1Size)
+		q.size = snapshot.DiskSize
+	}
+
+	if hdr.CryptMethod == LuksEncryption {
+		if hdr.EncryptionHeaderOffset == 0 {
+			return nil, fmt.Errorf("encrypted image has no LUKS header")
+		}
+		if opts.Passphrase == nil {
+			return nil, fmt.Errorf("image is encrypted, a passphrase is required")
+		}
+		if q.crypt, err = openLuks(r, int64(hdr.EncryptionHeaderOffset), opts.Passphrase); err != nil {
+			return nil, err
+		}
+	}
+
+	// Guest clusters are read from the image file itself unless they live in
+	// an external data file.
+	q.data = r
+	if hdr.IncompatibleFeatures&IncompatibleExternalData != 0 {
+		if opts.OpenDataFile == nil {
+			return nil, fmt.Errorf("external data file %q cannot be resolved", hdr.DataFile)
+		}
+		data, err := opts.OpenDataFile(hdr.DataFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open external data file %q: %w", hdr.DataFile, err)
+		}
+		q.data = data
+	}
+
+	if hdr.BackingFileOffset != 0 {
+		if err := q.openBacking(opts, depth); err != nil {
+			return nil, err
+		}
 	}
 
 	q.clusterPool = &sync.Pool{
@@ -55,45 +174,84 @@ func NewQcow2Format(r ReadAndReadAt) (*Qcow2Format, error) {
 }
 
 func readHeader(r io.Reader) (*HeaderAndAdditionalFields, error) {
-	var hdr Header
-	if err := binary.Read(r, binary.BigEndian, &hdr); err != nil {
+	// Version 2 headers end after the snapshot fields, version 3 headers carry
+	// the feature bitmasks, refcount order and header length as well.
+	raw := make([]byte, unsafe.Sizeof(Header{}))
+	if _, err := io.ReadFull(r, raw[:HeaderSizeV2]); err != nil {
 		return nil, fmt.Errorf("failed to read image header: %w", err)
 	}
-
-	if hdr.Magic != Magic {
+	if magic := binary.BigEndian.Uint32(raw[0:4]); magic != Magic {
 		return nil, fmt.Errorf("invalid magic bytes")
 	}
 
-	if hdr.Version != Version3 {
-		return nil, fmt.Errorf("only version 3 is supported")
+	version := Version(binary.BigEndian.Uint32(raw[4:8]))
+	if version != Version2 && version != Version3 {
+		return nil, fmt.Errorf("unsupported version %d", version)
+	}
+	if version == Version3 {
+		if _, err := io.ReadFull(r, raw[HeaderSizeV2:]); err != nil {
+			return nil, fmt.Errorf("failed to read image header: %w", err)
+		}
 	}
 
-	if hdr.BackingFileOffset != 0 {
-		return nil, fmt.Errorf("backing files are not supported")
+	var hdr Header
+	if err := binary.Read(bytes.NewReader(raw), binary.BigEndian, &hdr); err != nil {
+		return nil, fmt.Errorf("failed to read image header: %w", err)
+	}
+	if version == Version2 {
+		hdr.RefcountOrder = RefcountOrder16
+		hdr.HeaderLength = HeaderSizeV2
+	}
+	if hdr.HeaderLength < uint32(len(raw)) && version == Version3 {
+		return nil, fmt.Errorf("invalid header length %d", hdr.HeaderLength)
 	}
 
-	if hdr.CryptMethod != NoEncryption {
-		return nil, fmt.Errorf("encryption is not supported")
+	if hdr.CryptMethod != NoEncryption && hdr.CryptMethod != LuksEncryption {
+		return nil, fmt.Errorf("encryption method %d is not supported", hdr.CryptMethod)
 	}
 
-	if hdr.IncompatibleFeatures != 0 {
+	if hdr.IncompatibleFeatures&^(supportedIncompatibleFeatures|IncompatibleCorrupt) != 0 {
 		return nil, fmt.Errorf("incompatible features are not supported")
 	}
 
+	// Subclusters must be at least one sector.
+	if hdr.IncompatibleFeatures&IncompatibleExtendedL2 != 0 && hdr.ClusterBits < 14 {
+		return nil, fmt.Errorf("extended L2 entries need a cluster size of at least 16k")
+	}
+
+	offset := uint64(hdr.HeaderLength)
 	var additionalFields *HeaderAdditionalFields
 	if hdr.HeaderLength > uint32(unsafe.Sizeof(hdr)) {
 		additionalFields = &HeaderAdditionalFields{}
 		if err := binary.Read(r, binary.BigEndian, additionalFields); err != nil {
 			return nil, fmt.Errorf("failed to read additional header fields: %w", err)
 		}
+		// Skip fields added by later revisions of the specification.
+		known := uint64(unsafe.Sizeof(hdr) + unsafe.Sizeof(*additionalFields))
+		if offset > known {
+			if _, err := io.CopyN(io.Discard, r, int64(offset-known)); err != nil {
+				return nil, fmt.Errorf("failed to read additional header fields: %w", err)
+			}
+		} else {
+			offset = known
+		}
+	}
+
+	// The extension area ends at the backing file name or the end of the first
+	// cluster, whichever comes first.
+	extensionsEnd := uint64(1) << hdr.ClusterBits
+	if hdr.BackingFileOffset != 0 && hdr.BackingFileOffset < extensionsEnd {
+		extensionsEnd = hdr.BackingFileOffset
 	}
 
-	if additionalFields != nil && additionalFields.CompressionType != CompressionTypeDeflate {
+	if additionalFields != nil &&
+		additionalFields.CompressionType != CompressionTypeDeflate &&
+		additionalFields.CompressionType != CompressionTypeZstd {
 		return nil, fmt.Errorf("unsupported compression type")
 	}
 
 	var extensions []HeaderExtension
-	for {
+	for offset+8 <= extensionsEnd {
 		var headerExtension HeaderExtension
 		if err := binary.Read(r, binary.BigEndian, &headerExtension.HeaderExtensionMetadata); err != nil {
 			return nil, fmt.Errorf("failed to read header extension type and length: %w", err)
@@ -103,25 +261,117 @@ func readHeader(r io.Reader) (*HeaderAndAdditionalFields, error) {
 			break
 		}
 
-		if headerExtension.Type == BackingFileFormatName ||
-			headerExtension.Type == ExternalDataFileName ||
-			headerExtension.Type == FullDiskEncryptionHeader {
-			return nil, fmt.Errorf("unsupported header extension")
-		}
-
-		headerExtension.Data = make([]byte, headerExtension.Length)
+		// Extension data is padded to a multiple of 8 bytes.
+		headerExtension.Data = make([]byte, (headerExtension.Length+7)&^7)
 		if _, err := io.ReadFull(r, headerExtension.Data); err != nil {
 			return nil, fmt.Errorf("failed to read header extension data: %w", err)
 		}
+		headerExtension.Data = headerExtension.Data[:headerExtension.Length]
+		offset += 8 + uint64((headerExtension.Length+7)&^7)
 
 		extensions = append(extensions, headerExtension)
 	}
 
-	return &HeaderAndAdditionalFields{
+	result := &HeaderAndAdditionalFields{
 		Header:           hdr,
 		AdditionalFields: additionalFields,
 		Extensions:       extensions,
-	}, nil
+	}
+	for _, ext := range extensions {
+		switch ext.Type {
+		case BackingFileFormatName:
+			result.BackingFormat = string(ext.Data)
+		case ExternalDataFileName:
+			result.DataFile = string(ext.Data)
+		case FullDiskEncryptionHeader:
+			if len(ext.Data) < 16 {
+				return nil, fmt.Errorf("invalid full disk encryption header extension")
+			}
+			result.EncryptionHeaderOffset = binary.BigEndian.Uint64(ext.Data[0:8])
+			result.EncryptionHeaderLength = binary.BigEndian.Uint64(ext.Data[8:16])
+		}
+	}
+
+	return result, nil
+}
+
+func (q *Qcow2Format) openBacking(opts Options, depth int) error {
+	if q.header.BackingFileSize > maxBackingFileSize {
+		return fmt.Errorf("backing file name of %d bytes is longer than %d", q.header.BackingFileSize, maxBackingFileSize)
+	}
+	// The name is stored after the header in the first cluster.
+	if q.header.BackingFileOffset > uint64(q.clusterSize) || uint64(q.header.BackingFileSize) > uint64(q.clusterSize)-q.header.BackingFileOffset {
+		return fmt.Errorf("backing file name at %d does not fit in the first cluster", q.header.BackingFileOffset)
+	}
+	name := make([]byte, q.header.BackingFileSize)
+	if _, err := q.reader.ReadAt(name, int64(q.header.BackingFileOffset)); err != nil {
+		return fmt.Errorf("failed to read backing file name: %w", err)
+	}
+	q.header.BackingFile = string(name)
+
+	if opts.OpenBacking == nil {
+		return fmt.Errorf("backing file %q cannot be resolved", q.header.BackingFile)
+	}
+	if depth >= maxBackingChainDepth {
+		return fmt.Errorf("backing file chain is longer than %d images", maxBackingChainDepth)
+	}
+
+	br, err := opts.OpenBacking(q.header.BackingFile)
+	if err != nil {
+		return fmt.Errorf("failed to open backing file %q: %w", q.header.BackingFile, err)
+	}
+
+	format := q.header.BackingFormat
+	if format == "" {
+		// Without a format extension, probe like qemu does.
+		var magic [4]byte
+		if _, err := br.ReadAt(magic[:], 0); err == nil && binary.BigEndian.Uint32(magic[:]) == Magic {
+			format = "qcow2"
+		} else {
+			format = "raw"
+		}
+	}
+
+	switch format {
+	case "qcow2":
+		parent, err := newQcow2Format(br, opts, depth+1)
+		if err != nil {
+			return fmt.Errorf("backing file %q: %w", q.header.BackingFile, err)
+		}
+		q.backing = parent
+	case "raw":
+		q.backing = br
+	default:
+		return fmt.Errorf("unsupported backing file format %q", format)
+	}
+	return nil
+}
+
+// Features returns the names of the feature bits set in the image header.
+func (q *Qcow2Format) Features() []string {
+	return q.header.FeatureNames()
+}
+
+// BackingFile returns the backing file name, or an empty string.
+func (q *Qcow2Format) BackingFile() string {
+	return q.header.BackingFile
+}
+
+// readBacking reads guest data from the backing file. Areas beyond the end of
+// the backing file, or of an image without one, read as zeros.
+func (q *Qcow2Format) readBacking(p []byte, off int64) error {
+	n := 0
+	if q.backing != nil {
+		var err error
+		n, err = q.backing.ReadAt(p, off)
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("failed to read backing file: %w", err)
+		}
+	}
+	for i := n; i < len(p); i++ {
+		p[i] = 0
+	}
+	return nil
 }
 
 type tableKey struct {
@@ -155,47 +405,68 @@ func (q *Qcow2Format) readTable(imageOffset int64, n int) ([]uint64, error) {
 	return t.([]uint64), nil
 }
 
-func (q *Qcow2Format) getL2Entry(offset int64) (L2TableEntry, error) {
+// getL2Entry returns the L2 entry of the cluster containing offset. For images
+// with extended L2 entries it also returns the subcluster bitmap.
+func (q *Qcow2Format) getL2Entry(offset int64) (L2TableEntry, L2SubclusterBitmap, error) {
 	var l2entry L2TableEntry
 	l2Entries := q.clusterSize / 8
+	if q.extendedL2() {
+		l2Entries = q.clusterSize / 16
+	}
 	l2Index := (offset / q.clusterSize) % l2Entries
 	l1Index := (offset / q.clusterSize) / l2Entries
 
-	if l1Index >= int64(q.header.L1Size) {
-		return NewUnallocatedL2Entry(), nil
+	if l1Index >= int64(q.l1Size) {
+		return NewUnallocatedL2Entry(), 0, nil
 	}
 
-	l1Table, err := q.readTable(int64(q.header.L1TableOffset), int(q.header.L1Size))
+	l1Table, err := q.readTable(q.l1TableOffset, q.l1Size)
 	if err != nil {
-		return l2entry, err
+		return l2entry, 0, err
 	}
 
+	// L2 tables shared with a snapshot have a refcount above one and lack the
+	// COPIED flag, so only the offset tells whether one is allocated.
 	l1Entry := L1TableEntry(l1Table[l1Index])
-	if !l1Entry.Used() {
-		return NewUnallocatedL2Entry(), nil
-	}
 
 	l2TableOffset := l1Entry.Offset()
 	if l2TableOffset <= 0 {
-		return NewUnallocatedL2Entry(), nil
+		return NewUnallocatedL2Entry(), 0, nil
 	}
 
-	l2Table, err := q.readTable(l2TableOffset, int(l2Entries))
+	l2Table, err := q.readTable(l2TableOffset, int(q.clusterSize/8))
 	if err != nil {
-		return l2entry, err
+		return l2entry, 0, err
+	}
+
+	if q.extendedL2() {
+		return L2TableEntry(l2Table[2*l2Index]), L2SubclusterBitmap(l2Table[2*l2Index+1]), nil
 	}
 
 	l2Entry := L2TableEntry(l2Table[l2Index])
 
-	return l2Entry, nil
+	return l2Entry, 0, nil
+}
+
+// rawDataFile reports whether the external data file can be read as a raw
+// image on its own. That only holds for the current state, not for snapshots.
+func (q *Qcow2Format) rawDataFile() bool {
+	return q.header.IncompatibleFeatures&IncompatibleExternalData != 0 &&
+		q.header.AutoclearFeatures&AutoclearRaw != 0 &&
+		q.crypt == nil &&
+		q.l1TableOffset == int64(q.header.L1TableOffset)
+}
+
+func (q *Qcow2Format) extendedL2() bool {
+	return q.header.IncompatibleFeatures&IncompatibleExtendedL2 != 0
 }
 
 func (q *Qcow2Format) Size() (uint64, error) {
-	return q.header.Size, nil
+	return q.size, nil
 }
 
 func (q *Qcow2Format) ReadAt(p []byte, off int64) (int, error) {
-	if off >= int64(q.header.Size) {
+	if off >= int64(q.size) {
 		return 0, io.EOF
 	}
 
@@ -203,8 +474,24 @@ func (q *Qcow2Format) ReadAt(p []byte, off int64) (int, error) {
 	lenP := len(p)
 
 	// Limit read to image size
-	if off+int64(lenP) > int64(q.header.Size) {
-		lenP = int(int64(q.header.Size) - off)
+	if off+int64(lenP) > int64(q.size) {
+		lenP = int(int64(q.size) - off)
+	}
+
+	if q.rawDataFile() {
+		// The data file is a consistent raw image, the metadata can be ignored.
+		n, err := q.data.ReadAt(p[:lenP], off)
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+		for i := n; i < lenP; i++ {
+			p[i] = 0
+		}
+		n = lenP
+		if n < len(p) {
+			return n, io.EOF
+		}
+		return n, nil
 	}
 
 	for n < lenP {
@@ -219,17 +506,49 @@ func (q *Qcow2Format) ReadAt(p []byte, off int64) (int, error) {
 		}
 
 		// Get L2 entry
-		l2Entry, err := q.getL2Entry(clusterIndex * q.clusterSize)
+		l2Entry, bitmap, err := q.getL2Entry(clusterIndex * q.clusterSize)
 		if err != nil {
 			return n, err
 		}
 
-		if l2Entry.Unallocated() {
+		if q.extendedL2() && !l2Entry.Compressed() {
+			// Allocation is tracked per subcluster, so stop at the end of this one.
+			subclusterSize := q.clusterSize / SubclustersPerCluster
+			subcluster := uint(clusterOffset / subclusterSize)
+			if end := int(subclusterSize - clusterOffset%subclusterSize); toRead > end {
+				toRead = end
+			}
+
+			if bitmap.Zero(subcluster) {
+				for i := 0; i < toRead; i++ {
+					p[n+i] = 0
+				}
+			} else if bitmap.Allocated(subcluster) {
+				physOffset := l2Entry.Offset(q.header) + clusterOffset
+				if err := q.readData(p[n:n+toRead], physOffset); err != nil {
+					return n, err
+				}
+			} else {
+				if err := q.readBacking(p[n:n+toRead], off+int64(n)); err != nil {
+					return n, err
+				}
+			}
+		} else if l2Entry.Zero() && q.header.Version >= Version3 {
 			// Zero out the buffer
 			for i := 0; i < toRead; i++ {
 				p[n+i] = 0
 			}
+		} else if l2Entry.Unallocated() {
+			if err := q.readBacking(p[n:n+toRead], off+int64(n)); err != nil {
+				return n, err
+			}
 		} else if l2Entry.Compressed() {
+			if q.header.IncompatibleFeatures&IncompatibleExternalData != 0 {
+				return n, fmt.Errorf("compressed clusters are invalid with an external data file")
+			}
+			if q.crypt != nil {
+				return n, fmt.Errorf("compressed clusters are invalid in encrypted images")
+			}
 			// Handle compressed cluster
 			if err := q.readCompressedCluster(p[n:n+toRead], l2Entry, clusterOffset); err != nil {
 				return n, err
@@ -237,7 +556,7 @@ func (q *Qcow2Format) ReadAt(p []byte, off int64) (int, error) {
 		} else {
 			// Normal cluster
 			physOffset := l2Entry.Offset(q.header) + clusterOffset
-			if _, err := q.reader.ReadAt(p[n:n+toRead], physOffset); err != nil {
+			if err := q.readData(p[n:n+toRead], physOffset); err != nil {
 				return n, err
 			}
 		}
@@ -245,13 +564,37 @@ func (q *Qcow2Format) ReadAt(p []byte, off int64) (int, error) {
 		n += toRead
 	}
 
-	if n < len(p) && off+int64(n) >= int64(q.header.Size) {
+	if n < len(p) && off+int64(n) >= int64(q.size) {
 		return n, io.EOF
 	}
 
 	return n, nil
 }
 
+// readData reads guest data stored at physOffset, decrypting it if the image
+// is encrypted. Encryption works on whole sectors, so those covering p are read.
+func (q *Qcow2Format) readData(p []byte, physOffset int64) error {
+	if q.crypt == nil {
+		_, err := q.data.ReadAt(p, physOffset)
+		return err
+	}
+
+	start := physOffset &^ (luksSectorSize - 1)
+	end := (physOffset + int64(len(p)) + luksSectorSize - 1) &^ (luksSectorSize - 1)
+	buf := q.clusterPool.Get().([]byte)
+	defer q.clusterPool.Put(buf)
+	if int64(len(buf)) < end-start {
+		buf = make([]byte, end-start)
+	}
+	sectors := buf[:end-start]
+	if _, err := q.data.ReadAt(sectors, start); err != nil {
+		return err
+	}
+	q.crypt.decrypt(sectors, start)
+	copy(p, sectors[physOffset-start:])
+	return nil
+}
+
 func (q *Qcow2Format) readCompressedCluster(p []byte, l2Entry L2TableEntry, clusterOffset int64) error {
 	compressedSize := l2Entry.CompressedSize(q.header)
 	// Compressed data is likely small, but to be safe we could limit it or pool it if needed.
@@ -262,13 +605,26 @@ func (q *Qcow2Format) readCompressedCluster(p []byte, l2Entry L2TableEntry, clus
 		return fmt.Errorf("failed to read compressed cluster: %w", err)
 	}
 
-	// QCOW2 uses raw deflate (RFC 1951).
-	r := flate.NewReader(bytes.NewReader(compressedData))
-	defer r.Close()
-
 	fullCluster := q.clusterPool.Get().([]byte)
 	defer q.clusterPool.Put(fullCluster)
 
+	var r io.Reader
+	if q.header.AdditionalFields != nil && q.header.AdditionalFields.CompressionType == CompressionTypeZstd {
+		// The zstd frame is followed by padding up to the end of the last
+		// sector, so only read as much as one cluster from the stream.
+		zr := zstdDecoderPool.Get().(*zstd.Decoder)
+		defer zstdDecoderPool.Put(zr)
+		if err := zr.Reset(bytes.NewReader(compressedData)); err != nil {
+			return fmt.Errorf("failed to decompress cluster: %w", err)
+		}
+		r = zr
+	} else {
+		// QCOW2 uses raw deflate (RFC 1951).
+		fr := flate.NewReader(bytes.NewReader(compressedData))
+		defer fr.Close()
+		r = fr
+	}
+
 	if _, err := io.ReadFull(r, fullCluster); err != nil {
 		// io.ReadFull returns EOF only if no bytes were read.
 		// If it returns ErrUnexpectedEOF, it means we got some bytes but not enough.
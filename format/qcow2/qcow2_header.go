@@ -26,17 +26,23 @@ const (
 type Version uint32
 
 const (
+	// Version2 is the QCOW version 2, created by qemu with compat=0.10.
+	Version2 Version = 2
 	// Version3 is the QCOW version 3.
-	// Only version 3 is supported by this library.
 	Version3 Version = 3
 )
 
+// HeaderSizeV2 is the size of a version 2 header, which ends after the
+// snapshot table fields.
+const HeaderSizeV2 = 72
+
 // EncryptionMethod is the disk encryption method.
 type EncryptionMethod uint32
 
 const (
-	NoEncryption  EncryptionMethod = 0
-	AesEncryption EncryptionMethod = 1
+	NoEncryption   EncryptionMethod = 0
+	AesEncryption  EncryptionMethod = 1
+	LuksEncryption EncryptionMethod = 2
 )
 
 // RefcountOrder is the descriptor for refcount width:
@@ -66,10 +72,14 @@ const (
 	// data file. For such images, clusters in the external data file are not
 	// refcounted.
 	IncompatibleExternalData IncompatibleFeatures = 1 << 2
+	// IncompatibleCompressionType is the compression type bit. If this bit is set,
+	// a non-default compression type is used for compressed clusters and the
+	// CompressionType field is present and not zero.
+	IncompatibleCompressionType IncompatibleFeatures = 1 << 3
 	// IncompatibleExtendedL2 is the extended L2 entries bit. If this bit is set then
 	// L2 table entries use an extended format that allows subcluster-based
 	// allocation.
-	IncompatibleExtendedL2 IncompatibleFeatures = 1 << 3
+	IncompatibleExtendedL2 IncompatibleFeatures = 1 << 4
 )
 
 // CompatibleFeatures is a bitmask of compatible features.
@@ -146,6 +156,7 @@ type Header struct {
 }
 
 // HeaderAdditionalFields is the additional header fields for version 3.
+// They are present when HeaderLength is larger than the fixed header.
 type HeaderAdditionalFields struct {
 	// CompressionType is the compression method used for compressed clusters.
 	// All compressed clusters in an image use the same compression type.
@@ -153,6 +164,30 @@ type HeaderAdditionalFields struct {
 	Padding         [7]byte
 }
 
+// FeatureNames returns the names of the feature bits set in the header, as
+// qemu calls them in its create options where there is one.
+func (hdr *Header) FeatureNames() []string {
+	var names []string
+	for _, f := range []struct {
+		set  bool
+		name string
+	}{
+		{hdr.IncompatibleFeatures&IncompatibleDirty != 0, "dirty"},
+		{hdr.IncompatibleFeatures&IncompatibleCorrupt != 0, "corrupt"},
+		{hdr.IncompatibleFeatures&IncompatibleExternalData != 0, "data-file"},
+		{hdr.IncompatibleFeatures&IncompatibleCompressionType != 0, "compression-type"},
+		{hdr.IncompatibleFeatures&IncompatibleExtendedL2 != 0, "extended-l2"},
+		{hdr.CompatibleFeatures&CompatibleLazyRefcounts != 0, "lazy-refcounts"},
+		{hdr.AutoclearFeatures&AutoclearBitmaps != 0, "bitmaps"},
+		{hdr.AutoclearFeatures&AutoclearRaw != 0, "data-file-raw"},
+	} {
+		if f.set {
+			names = append(names, f.name)
+		}
+	}
+	return names
+}
+
 // HeaderExtensionType is the header extension type.
 type HeaderExtensionType uint32
 
@@ -189,6 +224,16 @@ type HeaderAndAdditionalFields struct {
 	Header
 	AdditionalFields *HeaderAdditionalFields
 	Extensions       []HeaderExtension
+	// BackingFile is the backing file name, empty if the image has none.
+	BackingFile string
+	// BackingFormat is the format named by the BackingFileFormatName extension.
+	BackingFormat string
+	// DataFile is the name from the ExternalDataFileName extension.
+	DataFile string
+	// EncryptionHeaderOffset and EncryptionHeaderLength locate the LUKS header
+	// named by the FullDiskEncryptionHeader extension.
+	EncryptionHeaderOffset uint64
+	EncryptionHeaderLength uint64
 }
 
 type L1TableEntry uint64
@@ -208,23 +253,30 @@ func (e L1TableEntry) Offset() int64 {
 type L2TableEntry uint64
 
 func NewL2TableEntry(hdr *HeaderAndAdditionalFields, offset int64, compressed bool, compressedSize int64) L2TableEntry {
-	e := L2TableEntry(1 << 63)
 	if compressed {
+		// Compressed clusters never carry the COPIED flag. The sector count is
+		// the number of sectors beyond the one containing the first byte.
 		hostClusterBits := 62 - (hdr.ClusterBits - 8)
-		additionalSectors := compressedSize / 512
-		e |= L2TableEntry(1<<62) | (L2TableEntry(additionalSectors) << hostClusterBits) | L2TableEntry(offset)&((1<<hostClusterBits)-1)
-	} else {
-		e |= L2TableEntry(offset & ((1<<48 - 1) << 9))
+		additionalSectors := (offset%512 + compressedSize - 1) / 512
+		return L2TableEntry(1<<62) | (L2TableEntry(additionalSectors) << hostClusterBits) | L2TableEntry(offset)&((1<<hostClusterBits)-1)
 	}
-	return e
+	return L2TableEntry(1<<63) | L2TableEntry(offset&((1<<48-1)<<9))
 }
 
 func NewUnallocatedL2Entry() L2TableEntry {
 	return L2TableEntry(0)
 }
 
+// Unallocated reports whether the cluster is not stored in this image, in which
+// case it is read from the backing file (or as zeros if there is none).
 func (e L2TableEntry) Unallocated() bool {
-	return e == 0 || (!e.Compressed() && e&0x1 == 1)
+	return !e.Compressed() && !e.Zero() && e.Offset(nil) == 0
+}
+
+// Zero reports whether the cluster reads as all zeros regardless of any
+// backing file.
+func (e L2TableEntry) Zero() bool {
+	return !e.Compressed() && e&0x1 == 1
 }
 
 func (e L2TableEntry) Used() bool {
@@ -247,5 +299,24 @@ func (e L2TableEntry) Offset(hdr *HeaderAndAdditionalFields) int64 {
 func (e L2TableEntry) CompressedSize(hdr *HeaderAndAdditionalFields) int64 {
 	hostClusterBits := 62 - (hdr.ClusterBits - 8)
 	additionalSectors := int64((e >> hostClusterBits) & ((1 << (61 - hostClusterBits + 1)) - 1))
-	return (additionalSectors + 1) * 512
+	// The compressed data ends with the last of the additional sectors, which is
+	// not necessarily a whole number of sectors past an unaligned offset.
+	return (additionalSectors+1)*512 - e.Offset(hdr)%512
+}
+
+// SubclustersPerCluster is the number of subclusters in images with extended
+// L2 entries.
+const SubclustersPerCluster = 32
+
+// L2SubclusterBitmap is the second half of an extended L2 entry. The low 32 bits
+// mark allocated subclusters, the high 32 bits subclusters that read as zeros.
+// Subclusters with neither bit set are read from the backing file.
+type L2SubclusterBitmap uint64
+
+func (b L2SubclusterBitmap) Allocated(subcluster uint) bool {
+	return b&(1<<subcluster) != 0
+}
+
+func (b L2SubclusterBitmap) Zero(subcluster uint) bool {
+	return b&(1<<(subcluster+32)) != 0
 }
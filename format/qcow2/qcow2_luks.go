@@ -0,0 +1,192 @@
+package format
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/xts"
+)
+
+const (
+	luksMagic         = "LUKS\xba\xbe"
+	luksVersion1      = 1
+	luksSectorSize    = 512
+	luksKeySlotActive = 0x00ac71f3
+	luksDigestSize    = 20
+	luksMaxStripes    = 1 << 16
+)
+
+// LuksKeySlot is a key slot of a LUKS1 header.
+type LuksKeySlot struct {
+	Active            uint32
+	Iterations        uint32
+	Salt              [32]byte
+	KeyMaterialOffset uint32
+	Stripes           uint32
+}
+
+// LuksHeader is the LUKS1 header that qemu embeds in encrypted qcow2 images.
+type LuksHeader struct {
+	Magic              [6]byte
+	Version            uint16
+	CipherName         [32]byte
+	CipherMode         [32]byte
+	HashSpec           [32]byte
+	PayloadOffset      uint32
+	KeyBytes           uint32
+	MKDigest           [luksDigestSize]byte
+	MKDigestSalt       [32]byte
+	MKDigestIterations uint32
+	UUID               [40]byte
+	KeySlots           [8]LuksKeySlot
+}
+
+// luksCipher decrypts image data with the master key of a LUKS header.
+type luksCipher struct {
+	c *xts.Cipher
+}
+
+// decrypt decrypts whole sectors in place. Sector numbers are derived from the
+// host offset, as qemu does for qcow2.
+func (l *luksCipher) decrypt(p []byte, hostOffset int64) {
+	sector := uint64(hostOffset / luksSectorSize)
+	for i := 0; i+luksSectorSize <= len(p); i += luksSectorSize {
+		l.c.Decrypt(p[i:i+luksSectorSize], p[i:i+luksSectorSize], sector)
+		sector++
+	}
+}
+
+// openLuks reads the LUKS header at off and unlocks the master key with the
+// passphrase.
+func openLuks(r io.ReaderAt, off int64, passphrase []byte) (*luksCipher, error) {
+	var hdr LuksHeader
+	raw := make([]byte, binary.Size(hdr))
+	if _, err := r.ReadAt(raw, off); err != nil {
+		return nil, fmt.Errorf("failed to read LUKS header: %w", err)
+	}
+	if err := binary.Read(bytes.NewReader(raw), binary.BigEndian, &hdr); err != nil {
+		return nil, fmt.Errorf("failed to read LUKS header: %w", err)
+	}
+	if string(hdr.Magic[:]) != luksMagic {
+		return nil, fmt.Errorf("invalid LUKS magic bytes")
+	}
+	if hdr.Version != luksVersion1 {
+		return nil, fmt.Errorf("unsupported LUKS version %d", hdr.Version)
+	}
+
+	cipherName, cipherMode := cString(hdr.CipherName[:]), cString(hdr.CipherMode[:])
+	if cipherName != "aes" || cipherMode != "xts-plain64" {
+		return nil, fmt.Errorf("unsupported LUKS cipher %s-%s", cipherName, cipherMode)
+	}
+	hashSpec := cString(hdr.HashSpec[:])
+	newHash, err := luksHash(hashSpec)
+	if err != nil {
+		return nil, err
+	}
+	keyBytes := int(hdr.KeyBytes)
+	if keyBytes != 32 && keyBytes != 64 {
+		return nil, fmt.Errorf("invalid LUKS key size %d", keyBytes)
+	}
+
+	for _, slot := range hdr.KeySlots {
+		if slot.Active != luksKeySlotActive {
+			continue
+		}
+		if slot.Stripes == 0 || slot.Stripes > luksMaxStripes {
+			return nil, fmt.Errorf("invalid LUKS key slot stripes %d", slot.Stripes)
+		}
+
+		// The key material is encrypted with a key derived from the passphrase,
+		// sector by sector starting at zero.
+		slotKey := pbkdf2.Key(passphrase, slot.Salt[:], int(slot.Iterations), keyBytes, newHash)
+		slotCipher, err := xts.NewCipher(aes.NewCipher, slotKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up LUKS key slot cipher: %w", err)
+		}
+		materialSize := keyBytes * int(slot.Stripes)
+		material := make([]byte, divRoundUp(int64(materialSize), luksSectorSize)*luksSectorSize)
+		if _, err := r.ReadAt(material, off+int64(slot.KeyMaterialOffset)*luksSectorSize); err != nil {
+			return nil, fmt.Errorf("failed to read LUKS key material: %w", err)
+		}
+		(&luksCipher{c: slotCipher}).decrypt(material, 0)
+
+		masterKey := afMerge(material[:materialSize], keyBytes, int(slot.Stripes), newHash)
+		digest := pbkdf2.Key(masterKey, hdr.MKDigestSalt[:], int(hdr.MKDigestIterations), luksDigestSize, newHash)
+		if subtle.ConstantTimeCompare(digest, hdr.MKDigest[:]) != 1 {
+			continue
+		}
+
+		c, err := xts.NewCipher(aes.NewCipher, masterKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up LUKS cipher: %w", err)
+		}
+		return &luksCipher{c: c}, nil
+	}
+	return nil, fmt.Errorf("no LUKS key slot matches the passphrase")
+}
+
+func luksHash(spec string) (func() hash.Hash, error) {
+	switch spec {
+	case "sha1":
+		return sha1.New, nil
+	case "sha256":
+		return sha256.New, nil
+	case "sha512":
+		return sha512.New, nil
+	default:
+		return nil, fmt.Errorf("unsupported LUKS hash %q", spec)
+	}
+}
+
+// afMerge recovers a key from the anti-forensic stripes it was split into.
+func afMerge(material []byte, keyBytes, stripes int, newHash func() hash.Hash) []byte {
+	d := make([]byte, keyBytes)
+	for i := 0; i < stripes-1; i++ {
+		xorBytes(d, material[i*keyBytes:(i+1)*keyBytes])
+		d = afDiffuse(d, newHash)
+	}
+	xorBytes(d, material[(stripes-1)*keyBytes:])
+	return d
+}
+
+// afDiffuse hashes b in digest sized blocks, each prefixed by its index.
+func afDiffuse(b []byte, newHash func() hash.Hash) []byte {
+	out := make([]byte, len(b))
+	h := newHash()
+	digestSize := h.Size()
+	var index [4]byte
+	for i := 0; i*digestSize < len(b); i++ {
+		end := (i + 1) * digestSize
+		if end > len(b) {
+			end = len(b)
+		}
+		h.Reset()
+		binary.BigEndian.PutUint32(index[:], uint32(i))
+		h.Write(index[:])
+		h.Write(b[i*digestSize : end])
+		copy(out[i*digestSize:end], h.Sum(nil))
+	}
+	return out
+}
+
+func xorBytes(dst, src []byte) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
+
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
@@ -0,0 +1,140 @@
+package format
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	// snapshotHeaderSize is the fixed part of a snapshot table entry.
+	snapshotHeaderSize = 40
+	// maxSnapshots and maxSnapshotExtraSize are the limits of qemu
+	// (QCOW_MAX_SNAPSHOTS and QCOW_MAX_SNAPSHOT_EXTRA_DATA).
+	maxSnapshots         = 65536
+	maxSnapshotExtraSize = 1024
+)
+
+// Snapshot is an internal snapshot from the snapshot table.
+type Snapshot struct {
+	// ID is the unique identifier string of the snapshot.
+	ID string
+	// Name is the snapshot name.
+	Name string
+	// Date is the wall clock time at which the snapshot was taken.
+	Date time.Time
+	// VMClock is the guest clock at the time of the snapshot.
+	VMClock time.Duration
+	// VMStateSize is the size of the saved VM state, zero for disk-only snapshots.
+	VMStateSize uint64
+	// DiskSize is the virtual disk size at the time of the snapshot.
+	DiskSize uint64
+	// L1TableOffset is the offset of the L1 table holding the snapshot state.
+	L1TableOffset uint64
+	// L1Size is the number of entries in that L1 table.
+	L1Size uint32
+}
+
+// checkSnapshotTable checks the size and the position of the snapshot table
+// without parsing it, which only happens once the snapshots are needed.
+func (q *Qcow2Format) checkSnapshotTable() error {
+	n := q.header.NbSnapshots
+	if n > maxSnapshots {
+		return fmt.Errorf("image has %d snapshots, more than the %d supported", n, maxSnapshots)
+	}
+	// Every entry has at least its fixed part, so the table cannot end before
+	// this.
+	off := q.header.SnapshotsOffset
+	end := off + uint64(n)*snapshotHeaderSize
+	if end < off || end > math.MaxInt64 {
+		return fmt.Errorf("snapshot table at %d lies outside the image", off)
+	}
+	if _, err := q.reader.ReadAt(make([]byte, 1), int64(end)-1); err != nil {
+		return fmt.Errorf("snapshot table at %d lies outside the image", off)
+	}
+	return nil
+}
+
+func (q *Qcow2Format) readSnapshots() ([]Snapshot, error) {
+	snapshots := make([]Snapshot, 0, q.header.NbSnapshots)
+	off := int64(q.header.SnapshotsOffset)
+
+	for i := uint32(0); i < q.header.NbSnapshots; i++ {
+		fixed := make([]byte, snapshotHeaderSize)
+		if _, err := q.reader.ReadAt(fixed, off); err != nil {
+			return nil, fmt.Errorf("failed to read snapshot table: %w", err)
+		}
+
+		s := Snapshot{
+			L1TableOffset: binary.BigEndian.Uint64(fixed[0:8]),
+			L1Size:        binary.BigEndian.Uint32(fixed[8:12]),
+			Date: time.Unix(int64(binary.BigEndian.Uint32(fixed[16:20])),
+				int64(binary.BigEndian.Uint32(fixed[20:24]))),
+			VMClock:     time.Duration(binary.BigEndian.Uint64(fixed[24:32])),
+			VMStateSize: uint64(binary.BigEndian.Uint32(fixed[32:36])),
+			DiskSize:    q.header.Size,
+		}
+		idSize := int64(binary.BigEndian.Uint16(fixed[12:14]))
+		nameSize := int64(binary.BigEndian.Uint16(fixed[14:16]))
+		extraSize := int64(binary.BigEndian.Uint32(fixed[36:40]))
+		if extraSize > maxSnapshotExtraSize {
+			return nil, fmt.Errorf("snapshot %d has %d bytes of extra data, more than the %d supported", i, extraSize, maxSnapshotExtraSize)
+		}
+
+		variable := make([]byte, extraSize+idSize+nameSize)
+		if _, err := q.reader.ReadAt(variable, off+snapshotHeaderSize); err != nil {
+			return nil, fmt.Errorf("failed to read snapshot table: %w", err)
+		}
+
+		// Extra data fields were added over time, older images have fewer.
+		extra := variable[:extraSize]
+		if len(extra) >= 8 {
+			s.VMStateSize = binary.BigEndian.Uint64(extra[0:8])
+		}
+		if len(extra) >= 16 {
+			s.DiskSize = binary.BigEndian.Uint64(extra[8:16])
+		}
+		s.ID = string(variable[extraSize : extraSize+idSize])
+		s.Name = string(variable[extraSize+idSize:])
+
+		snapshots = append(snapshots, s)
+
+		// Entries are padded to a multiple of 8 bytes.
+		off += (snapshotHeaderSize + int64(len(variable)) + 7) &^ 7
+	}
+
+	return snapshots, nil
+}
+
+// Snapshots returns the internal snapshots of the image. The snapshot table
+// is read the first time.
+func (q *Qcow2Format) Snapshots() ([]Snapshot, error) {
+	if q.snapshots == nil && q.header.NbSnapshots > 0 {
+		snapshots, err := q.readSnapshots()
+		if err != nil {
+			return nil, err
+		}
+		q.snapshots = snapshots
+	}
+	return q.snapshots, nil
+}
+
+// findSnapshot looks a snapshot up by ID first and then by name, like qemu-img.
+func (q *Qcow2Format) findSnapshot(idOrName string) (*Snapshot, error) {
+	snapshots, err := q.Snapshots()
+	if err != nil {
+		return nil, err
+	}
+	for i := range snapshots {
+		if snapshots[i].ID == idOrName {
+			return &snapshots[i], nil
+		}
+	}
+	for i := range snapshots {
+		if snapshots[i].Name == idOrName {
+			return &snapshots[i], nil
+		}
+	}
+	return nil, fmt.Errorf("snapshot %q not found", idOrName)
+}
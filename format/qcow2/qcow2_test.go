@@ -3,8 +3,15 @@ package format
 import (
 	"bytes"
 	"compress/flate"
+	"crypto/aes"
+	"crypto/sha256"
 	"encoding/binary"
+	"strings"
 	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/xts"
 )
 
 func TestQcow2ReadAt(t *testing.T) {
@@ -147,3 +154,680 @@ func pad(buf *bytes.Buffer, n int) {
 		buf.Write(make([]byte, n))
 	}
 }
+
+func TestQcow2WriterRoundTrip(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		clusterSize := 1 << 12
+		data := make([]byte, clusterSize*700+100)
+		for i := 0; i < len(data); i += clusterSize {
+			switch (i / clusterSize) % 3 {
+			case 0:
+				// Left as an all-zero cluster.
+			case 1:
+				for j := i; j < i+clusterSize && j < len(data); j++ {
+					data[j] = byte(j * 7)
+				}
+			case 2:
+				for j := i; j < i+clusterSize && j < len(data); j++ {
+					data[j] = 0x5A
+				}
+			}
+		}
+		data[len(data)-1] = 0xEE
+
+		img := &memImage{}
+		w, err := NewQcow2Writer(img, uint64(len(data)), WriterOptions{ClusterBits: 12, Compress: compress})
+		if err != nil {
+			t.Fatalf("NewQcow2Writer failed: %v", err)
+		}
+		for off := 0; off < len(data); off += 1000 {
+			end := off + 1000
+			if end > len(data) {
+				end = len(data)
+			}
+			if _, err := w.Write(data[off:end]); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+		// The v3 header of 104 bytes is followed by the compression type field.
+		if hl := binary.BigEndian.Uint32(img.buf[100:]); hl != 112 {
+			t.Fatalf("header length=%d want=112", hl)
+		}
+
+		q, err := NewQcow2Format(bytes.NewReader(img.buf))
+		if err != nil {
+			t.Fatalf("compress=%v: NewQcow2Format failed: %v", compress, err)
+		}
+		if size, _ := q.Size(); size != uint64(len(data)) {
+			t.Fatalf("compress=%v: size=%d want=%d", compress, size, len(data))
+		}
+		out := make([]byte, len(data))
+		if n, err := q.ReadAt(out, 0); err != nil || n != len(data) {
+			t.Fatalf("compress=%v: ReadAt n=%d err=%v", compress, n, err)
+		}
+		if !bytes.Equal(out, data) {
+			t.Fatalf("compress=%v: round trip mismatch", compress)
+		}
+		if compress && len(img.buf) >= len(data)/2 {
+			t.Errorf("compressed image is %d bytes for %d bytes of data", len(img.buf), len(data))
+		}
+	}
+}
+
+type memImage struct {
+	buf []byte
+}
+
+func (m *memImage) WriteAt(p []byte, off int64) (int, error) {
+	if end := int(off) + len(p); end > len(m.buf) {
+		m.buf = append(m.buf, make([]byte, end-len(m.buf))...)
+	}
+	return copy(m.buf[off:], p), nil
+}
+
+func TestQcow2ReadZstdCluster(t *testing.T) {
+	clusterBits := uint32(9)
+	clusterSize := uint64(1 << clusterBits)
+
+	header := Header{
+		Magic:         Magic,
+		Version:       Version3,
+		ClusterBits:   clusterBits,
+		Size:                 clusterSize,
+		L1Size:               1,
+		L1TableOffset:        clusterSize,
+		HeaderLength:         112,
+		RefcountOrder:        4,
+		IncompatibleFeatures: IncompatibleCompressionType,
+	}
+
+	rawData := bytes.Repeat([]byte{0x01, 0x02, 0x03, 0x04}, int(clusterSize/4))
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressedBytes := enc.EncodeAll(rawData, nil)
+	enc.Close()
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, header)
+	binary.Write(buf, binary.BigEndian, HeaderAdditionalFields{CompressionType: CompressionTypeZstd})
+	pad(buf, int(clusterSize)-buf.Len())
+
+	binary.Write(buf, binary.BigEndian, NewL1TableEntry(int64(clusterSize*2)))
+	pad(buf, int(clusterSize*2)-buf.Len())
+
+	l2Entries := make([]uint64, clusterSize/8)
+	mockHdr := &HeaderAndAdditionalFields{Header: header}
+	l2Entries[0] = uint64(NewL2TableEntry(mockHdr, int64(clusterSize*3), true, int64(len(compressedBytes))))
+	binary.Write(buf, binary.BigEndian, l2Entries)
+	pad(buf, int(clusterSize*3)-buf.Len())
+
+	// Sector padding after the frame must not confuse the decoder.
+	buf.Write(compressedBytes)
+	pad(buf, int(clusterSize*4)-buf.Len())
+
+	q, err := NewQcow2Format(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("NewQcow2Format failed: %v", err)
+	}
+	out := make([]byte, clusterSize)
+	if _, err := q.ReadAt(out, 0); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if !bytes.Equal(out, rawData) {
+		t.Fatalf("zstd cluster mismatch")
+	}
+}
+
+func TestQcow2BackingChain(t *testing.T) {
+	clusterBits := uint32(9)
+	clusterSize := 1 << clusterBits
+
+	// Base image: three clusters of 0xAA, one cluster shorter than the overlay.
+	base := &memImage{}
+	bw, err := NewQcow2Writer(base, uint64(clusterSize*3), WriterOptions{ClusterBits: clusterBits})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bw.Write(bytes.Repeat([]byte{0xAA}, clusterSize*3))
+	if err := bw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Overlay: cluster 1 allocated, cluster 2 zeroed, clusters 0 and 3 unallocated.
+	backingName := "base.qcow2"
+	header := Header{
+		Magic:             Magic,
+		Version:           Version3,
+		ClusterBits:       clusterBits,
+		Size:              uint64(clusterSize * 4),
+		L1Size:            1,
+		L1TableOffset:     uint64(clusterSize),
+		HeaderLength:      104,
+		RefcountOrder:     4,
+		BackingFileOffset: 104 + 8 + 8 + 8,
+		BackingFileSize:   uint32(len(backingName)),
+	}
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, header)
+	binary.Write(buf, binary.BigEndian, HeaderExtensionMetadata{Type: BackingFileFormatName, Length: 5})
+	buf.WriteString("qcow2\x00\x00\x00")
+	binary.Write(buf, binary.BigEndian, HeaderExtensionMetadata{Type: EndOfHeaderExtensionArea})
+	buf.WriteString(backingName)
+	pad(buf, clusterSize-buf.Len())
+
+	binary.Write(buf, binary.BigEndian, NewL1TableEntry(int64(clusterSize*2)))
+	pad(buf, clusterSize*2-buf.Len())
+
+	l2Entries := make([]uint64, clusterSize/8)
+	l2Entries[1] = uint64(NewL2TableEntry(nil, int64(clusterSize*3), false, 0))
+	l2Entries[2] = 1
+	binary.Write(buf, binary.BigEndian, l2Entries)
+	pad(buf, clusterSize*3-buf.Len())
+	buf.Write(bytes.Repeat([]byte{0xBB}, clusterSize))
+
+	var opened []string
+	q, err := NewQcow2FormatWithOptions(bytes.NewReader(buf.Bytes()), Options{
+		OpenBacking: func(name string) (ReadAndReadAt, error) {
+			opened = append(opened, name)
+			return bytes.NewReader(base.buf), nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewQcow2FormatWithOptions failed: %v", err)
+	}
+	if len(opened) != 1 || opened[0] != backingName || q.BackingFile() != backingName {
+		t.Fatalf("opened=%v backing=%q", opened, q.BackingFile())
+	}
+
+	out := make([]byte, clusterSize*4)
+	if _, err := q.ReadAt(out, 0); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	want := append(bytes.Repeat([]byte{0xAA}, clusterSize), bytes.Repeat([]byte{0xBB}, clusterSize)...)
+	want = append(want, make([]byte, clusterSize*2)...)
+	if !bytes.Equal(out, want) {
+		t.Fatalf("flattened image mismatch")
+	}
+
+	if _, err := NewQcow2Format(bytes.NewReader(buf.Bytes())); err == nil {
+		t.Fatalf("overlay without resolver should be rejected")
+	}
+
+	// Backing file names longer than qemu allows or outside the first
+	// cluster are refused before they are read.
+	for _, tc := range []struct {
+		offset uint64
+		size   uint32
+		want   string
+	}{
+		{header.BackingFileOffset, 1024, "longer than 1023"},
+		{header.BackingFileOffset, 0xffffffff, "longer than 1023"},
+		{uint64(clusterSize) - 4, uint32(len(backingName)), "does not fit in the first cluster"},
+		{1 << 62, uint32(len(backingName)), "does not fit in the first cluster"},
+	} {
+		img := append([]byte(nil), buf.Bytes()...)
+		binary.BigEndian.PutUint64(img[8:], tc.offset)
+		binary.BigEndian.PutUint32(img[16:], tc.size)
+		_, err := NewQcow2FormatWithOptions(bytes.NewReader(img), Options{
+			OpenBacking: func(name string) (ReadAndReadAt, error) {
+				return bytes.NewReader(base.buf), nil
+			},
+		})
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Fatalf("backing name at %d of %d bytes: %v", tc.offset, tc.size, err)
+		}
+	}
+}
+
+func TestQcow2ReadVersion2(t *testing.T) {
+	clusterBits := uint32(9)
+	clusterSize := 1 << clusterBits
+
+	header := Header{
+		Magic:         Magic,
+		Version:       Version2,
+		ClusterBits:   clusterBits,
+		Size:          uint64(clusterSize * 2),
+		L1Size:        1,
+		L1TableOffset: uint64(clusterSize),
+	}
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, header)
+	// Version 2 headers end after the snapshot fields, followed directly by
+	// the (here empty) extension area.
+	buf.Truncate(HeaderSizeV2)
+	pad(buf, clusterSize-buf.Len())
+
+	binary.Write(buf, binary.BigEndian, NewL1TableEntry(int64(clusterSize*2)))
+	pad(buf, clusterSize*2-buf.Len())
+
+	l2Entries := make([]uint64, clusterSize/8)
+	l2Entries[1] = uint64(NewL2TableEntry(nil, int64(clusterSize*3), false, 0))
+	binary.Write(buf, binary.BigEndian, l2Entries)
+	pad(buf, clusterSize*3-buf.Len())
+	buf.Write(bytes.Repeat([]byte{0xCD}, clusterSize))
+
+	q, err := NewQcow2Format(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("NewQcow2Format failed: %v", err)
+	}
+	out := make([]byte, clusterSize*2)
+	if _, err := q.ReadAt(out, 0); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	want := append(make([]byte, clusterSize), bytes.Repeat([]byte{0xCD}, clusterSize)...)
+	if !bytes.Equal(out, want) {
+		t.Fatalf("version 2 image mismatch")
+	}
+}
+
+func TestQcow2ReadExtendedL2(t *testing.T) {
+	clusterBits := uint32(14)
+	clusterSize := 1 << clusterBits
+	subclusterSize := clusterSize / SubclustersPerCluster
+
+	backingName := "base.raw"
+	header := Header{
+		Magic:                Magic,
+		Version:              Version3,
+		ClusterBits:          clusterBits,
+		Size:                 uint64(clusterSize),
+		L1Size:               1,
+		L1TableOffset:        uint64(clusterSize),
+		HeaderLength:         104,
+		RefcountOrder:        4,
+		IncompatibleFeatures: IncompatibleExtendedL2,
+		BackingFileOffset:    104 + 8,
+		BackingFileSize:      uint32(len(backingName)),
+	}
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, header)
+	binary.Write(buf, binary.BigEndian, HeaderExtensionMetadata{Type: EndOfHeaderExtensionArea})
+	buf.WriteString(backingName)
+	pad(buf, clusterSize-buf.Len())
+
+	binary.Write(buf, binary.BigEndian, NewL1TableEntry(int64(clusterSize*2)))
+	pad(buf, clusterSize*2-buf.Len())
+
+	// Subcluster 0 allocated, subcluster 1 zero, the rest from the backing file.
+	l2Entries := make([]uint64, clusterSize/8)
+	l2Entries[0] = uint64(NewL2TableEntry(nil, int64(clusterSize*3), false, 0))
+	l2Entries[1] = 1 | 1<<(1+32)
+	binary.Write(buf, binary.BigEndian, l2Entries)
+	pad(buf, clusterSize*3-buf.Len())
+	buf.Write(bytes.Repeat([]byte{0xEE}, clusterSize))
+
+	q, err := NewQcow2FormatWithOptions(bytes.NewReader(buf.Bytes()), Options{
+		OpenBacking: func(name string) (ReadAndReadAt, error) {
+			return bytes.NewReader(bytes.Repeat([]byte{0x11}, clusterSize)), nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewQcow2FormatWithOptions failed: %v", err)
+	}
+
+	out := make([]byte, clusterSize)
+	if _, err := q.ReadAt(out, 0); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	want := bytes.Repeat([]byte{0xEE}, subclusterSize)
+	want = append(want, make([]byte, subclusterSize)...)
+	want = append(want, bytes.Repeat([]byte{0x11}, clusterSize-2*subclusterSize)...)
+	if !bytes.Equal(out, want) {
+		t.Fatalf("extended L2 image mismatch")
+	}
+}
+
+func TestQcow2ReadExternalDataFile(t *testing.T) {
+	clusterBits := uint32(9)
+	clusterSize := 1 << clusterBits
+
+	dataFileName := "disk.data"
+	build := func(autoclear AutoclearFeatures) []byte {
+		header := Header{
+			Magic:                Magic,
+			Version:              Version3,
+			ClusterBits:          clusterBits,
+			Size:                 uint64(clusterSize * 2),
+			L1Size:               1,
+			L1TableOffset:        uint64(clusterSize),
+			HeaderLength:         104,
+			RefcountOrder:        4,
+			IncompatibleFeatures: IncompatibleExternalData,
+			AutoclearFeatures:    autoclear,
+		}
+		buf := new(bytes.Buffer)
+		binary.Write(buf, binary.BigEndian, header)
+		binary.Write(buf, binary.BigEndian, HeaderExtensionMetadata{Type: ExternalDataFileName, Length: uint32(len(dataFileName))})
+		buf.WriteString(dataFileName)
+		pad(buf, 7)
+		binary.Write(buf, binary.BigEndian, HeaderExtensionMetadata{Type: EndOfHeaderExtensionArea})
+		pad(buf, clusterSize-buf.Len())
+
+		binary.Write(buf, binary.BigEndian, NewL1TableEntry(int64(clusterSize*2)))
+		pad(buf, clusterSize*2-buf.Len())
+
+		// Only the second guest cluster is mapped, at the same data file offset.
+		l2Entries := make([]uint64, clusterSize/8)
+		l2Entries[1] = uint64(NewL2TableEntry(nil, int64(clusterSize), false, 0))
+		binary.Write(buf, binary.BigEndian, l2Entries)
+		pad(buf, clusterSize*3-buf.Len())
+		return buf.Bytes()
+	}
+
+	data := append(bytes.Repeat([]byte{0x33}, clusterSize), bytes.Repeat([]byte{0x44}, clusterSize)...)
+	for _, tc := range []struct {
+		autoclear AutoclearFeatures
+		want      []byte
+	}{
+		{0, append(make([]byte, clusterSize), data[clusterSize:]...)},
+		{AutoclearRaw, data},
+	} {
+		var opened string
+		q, err := NewQcow2FormatWithOptions(bytes.NewReader(build(tc.autoclear)), Options{
+			OpenDataFile: func(name string) (ReadAndReadAt, error) {
+				opened = name
+				return bytes.NewReader(data), nil
+			},
+		})
+		if err != nil {
+			t.Fatalf("NewQcow2FormatWithOptions failed: %v", err)
+		}
+		if opened != dataFileName {
+			t.Fatalf("opened data file %q, want %q", opened, dataFileName)
+		}
+		out := make([]byte, clusterSize*2)
+		if _, err := q.ReadAt(out, 0); err != nil {
+			t.Fatalf("ReadAt failed: %v", err)
+		}
+		if !bytes.Equal(out, tc.want) {
+			t.Fatalf("autoclear=%d: external data mismatch", tc.autoclear)
+		}
+	}
+}
+
+func TestQcow2ReadSnapshot(t *testing.T) {
+	clusterBits := uint32(9)
+	clusterSize := 1 << clusterBits
+
+	header := Header{
+		Magic:           Magic,
+		Version:         Version3,
+		ClusterBits:     clusterBits,
+		Size:            uint64(clusterSize),
+		L1Size:          1,
+		L1TableOffset:   uint64(clusterSize),
+		HeaderLength:    104,
+		RefcountOrder:   4,
+		NbSnapshots:     1,
+		SnapshotsOffset: uint64(clusterSize * 7),
+	}
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, header)
+	pad(buf, clusterSize-buf.Len())
+
+	// Active state: L1 at cluster 1, L2 at cluster 2, data at cluster 3.
+	// Snapshot state: L1 at cluster 4, L2 at cluster 5, data at cluster 6.
+	for i, fill := range []byte{0xBB, 0xAA} {
+		base := clusterSize * (1 + 3*i)
+		binary.Write(buf, binary.BigEndian, NewL1TableEntry(int64(base+clusterSize)))
+		pad(buf, base+clusterSize-buf.Len())
+		binary.Write(buf, binary.BigEndian, NewL2TableEntry(nil, int64(base+2*clusterSize), false, 0))
+		pad(buf, base+2*clusterSize-buf.Len())
+		buf.Write(bytes.Repeat([]byte{fill}, clusterSize))
+	}
+
+	id, name := "1", "before-upgrade"
+	binary.Write(buf, binary.BigEndian, uint64(clusterSize*4))
+	binary.Write(buf, binary.BigEndian, uint32(1))
+	binary.Write(buf, binary.BigEndian, uint16(len(id)))
+	binary.Write(buf, binary.BigEndian, uint16(len(name)))
+	binary.Write(buf, binary.BigEndian, uint32(1700000000))
+	binary.Write(buf, binary.BigEndian, uint32(0))
+	binary.Write(buf, binary.BigEndian, uint64(0))
+	binary.Write(buf, binary.BigEndian, uint32(0))
+	binary.Write(buf, binary.BigEndian, uint32(16))
+	binary.Write(buf, binary.BigEndian, uint64(0))
+	binary.Write(buf, binary.BigEndian, uint64(clusterSize*2))
+	buf.WriteString(id + name)
+	pad(buf, clusterSize*8-buf.Len())
+
+	q, err := NewQcow2Format(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("NewQcow2Format failed: %v", err)
+	}
+	snapshots, err := q.Snapshots()
+	if err != nil {
+		t.Fatalf("Snapshots failed: %v", err)
+	}
+	if len(snapshots) != 1 || snapshots[0].ID != id || snapshots[0].Name != name ||
+		snapshots[0].DiskSize != uint64(clusterSize*2) || snapshots[0].Date.Unix() != 1700000000 {
+		t.Fatalf("unexpected snapshots: %+v", snapshots)
+	}
+	out := make([]byte, clusterSize)
+	if _, err := q.ReadAt(out, 0); err != nil || !bytes.Equal(out, bytes.Repeat([]byte{0xBB}, clusterSize)) {
+		t.Fatalf("active state mismatch: %v", err)
+	}
+
+	for _, sel := range []string{id, name} {
+		q, err := NewQcow2FormatWithOptions(bytes.NewReader(buf.Bytes()), Options{Snapshot: sel})
+		if err != nil {
+			t.Fatalf("NewQcow2FormatWithOptions(%q) failed: %v", sel, err)
+		}
+		if size, _ := q.Size(); size != uint64(clusterSize*2) {
+			t.Fatalf("snapshot size=%d", size)
+		}
+		out := make([]byte, clusterSize*2)
+		if _, err := q.ReadAt(out, 0); err != nil {
+			t.Fatalf("ReadAt failed: %v", err)
+		}
+		want := append(bytes.Repeat([]byte{0xAA}, clusterSize), make([]byte, clusterSize)...)
+		if !bytes.Equal(out, want) {
+			t.Fatalf("snapshot %q mismatch", sel)
+		}
+	}
+
+	if _, err := NewQcow2FormatWithOptions(bytes.NewReader(buf.Bytes()), Options{Snapshot: "missing"}); err == nil {
+		t.Fatalf("unknown snapshot should be rejected")
+	}
+
+	// Snapshot tables larger than qemu allows or outside the image are
+	// refused when the image is opened.
+	for _, tc := range []struct {
+		nbSnapshots     uint32
+		snapshotsOffset uint64
+	}{
+		{0xffffffff, uint64(clusterSize * 7)},
+		{1, uint64(clusterSize * 8)},
+		{1, 1 << 63},
+	} {
+		img := append([]byte(nil), buf.Bytes()...)
+		binary.BigEndian.PutUint32(img[60:], tc.nbSnapshots)
+		binary.BigEndian.PutUint64(img[64:], tc.snapshotsOffset)
+		if _, err := NewQcow2Format(bytes.NewReader(img)); err == nil {
+			t.Fatalf("snapshot table of %d entries at %d should be rejected", tc.nbSnapshots, tc.snapshotsOffset)
+		}
+	}
+
+	// The table itself is only parsed when a snapshot is selected or listed.
+	img := append([]byte(nil), buf.Bytes()...)
+	binary.BigEndian.PutUint32(img[clusterSize*7+36:], 0xffffffff)
+	q, err = NewQcow2Format(bytes.NewReader(img))
+	if err != nil {
+		t.Fatalf("NewQcow2Format failed: %v", err)
+	}
+	if _, err := q.Snapshots(); err == nil || !strings.Contains(err.Error(), "extra data") {
+		t.Fatalf("oversized extra data: %v", err)
+	}
+	if _, err := NewQcow2FormatWithOptions(bytes.NewReader(img), Options{Snapshot: id}); err == nil {
+		t.Fatalf("selecting a snapshot from a broken table should fail")
+	}
+}
+
+func TestQcow2DirtyAndCorrupt(t *testing.T) {
+	img := &memImage{}
+	w, err := NewQcow2Writer(img, 4096, WriterOptions{ClusterBits: 12})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(bytes.Repeat([]byte{0x77}, 4096))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	setFeatures := func(incompatible IncompatibleFeatures, compatible CompatibleFeatures) []byte {
+		b := append([]byte(nil), img.buf...)
+		binary.BigEndian.PutUint64(b[72:80], uint64(incompatible))
+		binary.BigEndian.PutUint64(b[80:88], uint64(compatible))
+		return b
+	}
+
+	q, err := NewQcow2Format(bytes.NewReader(setFeatures(IncompatibleDirty, CompatibleLazyRefcounts)))
+	if err != nil {
+		t.Fatalf("dirty image rejected: %v", err)
+	}
+	if got := q.Features(); len(got) != 2 || got[0] != "dirty" || got[1] != "lazy-refcounts" {
+		t.Fatalf("features=%v", got)
+	}
+
+	corrupt := setFeatures(IncompatibleCorrupt, 0)
+	if _, err := NewQcow2Format(bytes.NewReader(corrupt)); err == nil {
+		t.Fatalf("corrupt image should be rejected")
+	}
+	q, err = NewQcow2FormatWithOptions(bytes.NewReader(corrupt), Options{AllowCorrupt: true})
+	if err != nil {
+		t.Fatalf("corrupt image rejected with AllowCorrupt: %v", err)
+	}
+	out := make([]byte, 4096)
+	if _, err := q.ReadAt(out, 0); err != nil || !bytes.Equal(out, bytes.Repeat([]byte{0x77}, 4096)) {
+		t.Fatalf("corrupt image read mismatch: %v", err)
+	}
+}
+
+func TestQcow2ReadLuks(t *testing.T) {
+	clusterBits := uint32(12)
+	clusterSize := 1 << clusterBits
+	luksOffset := clusterSize * 3
+	dataOffset := clusterSize * 8
+	passphrase := []byte("secret")
+	masterKey := bytes.Repeat([]byte{0x5a, 0x17}, 32)
+	stripes := 40
+
+	newCipher := func(key []byte) *xts.Cipher {
+		c, err := xts.NewCipher(aes.NewCipher, key)
+		if err != nil {
+			t.Fatalf("xts.NewCipher failed: %v", err)
+		}
+		return c
+	}
+	encrypt := func(c *xts.Cipher, p []byte, sector uint64) {
+		for i := 0; i < len(p); i += luksSectorSize {
+			c.Encrypt(p[i:i+luksSectorSize], p[i:i+luksSectorSize], sector)
+			sector++
+		}
+	}
+
+	luks := LuksHeader{Version: luksVersion1, KeyBytes: uint32(len(masterKey)), MKDigestIterations: 10}
+	copy(luks.Magic[:], luksMagic)
+	copy(luks.CipherName[:], "aes")
+	copy(luks.CipherMode[:], "xts-plain64")
+	copy(luks.HashSpec[:], "sha256")
+	copy(luks.MKDigestSalt[:], "digest salt")
+	copy(luks.MKDigest[:], pbkdf2.Key(masterKey, luks.MKDigestSalt[:], 10, luksDigestSize, sha256.New))
+	slot := &luks.KeySlots[1]
+	slot.Active = luksKeySlotActive
+	slot.Iterations = 10
+	slot.KeyMaterialOffset = 8
+	slot.Stripes = uint32(stripes)
+	copy(slot.Salt[:], "slot salt")
+
+	// Split the master key into anti-forensic stripes.
+	material := make([]byte, len(masterKey)*stripes)
+	d := make([]byte, len(masterKey))
+	for i := 0; i < stripes-1; i++ {
+		stripe := material[i*len(masterKey) : (i+1)*len(masterKey)]
+		for j := range stripe {
+			stripe[j] = byte(i*7 + j)
+		}
+		xorBytes(d, stripe)
+		d = afDiffuse(d, sha256.New)
+	}
+	xorBytes(d, masterKey)
+	copy(material[(stripes-1)*len(masterKey):], d)
+	material = append(material, make([]byte, (luksSectorSize-len(material)%luksSectorSize)%luksSectorSize)...)
+	slotKey := pbkdf2.Key(passphrase, slot.Salt[:], 10, len(masterKey), sha256.New)
+	encrypt(newCipher(slotKey), material, 0)
+
+	header := Header{
+		Magic:         Magic,
+		Version:       Version3,
+		ClusterBits:   clusterBits,
+		Size:          uint64(clusterSize * 2),
+		CryptMethod:   LuksEncryption,
+		L1Size:        1,
+		L1TableOffset: uint64(clusterSize),
+		HeaderLength:  104,
+		RefcountOrder: 4,
+	}
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, header)
+	binary.Write(buf, binary.BigEndian, HeaderExtensionMetadata{Type: FullDiskEncryptionHeader, Length: 16})
+	binary.Write(buf, binary.BigEndian, []uint64{uint64(luksOffset), uint64(clusterSize * 5)})
+	binary.Write(buf, binary.BigEndian, HeaderExtensionMetadata{Type: EndOfHeaderExtensionArea})
+	pad(buf, clusterSize-buf.Len())
+
+	binary.Write(buf, binary.BigEndian, NewL1TableEntry(int64(clusterSize*2)))
+	pad(buf, clusterSize*2-buf.Len())
+
+	l2Entries := make([]uint64, clusterSize/8)
+	l2Entries[0] = uint64(NewL2TableEntry(nil, int64(dataOffset), false, 0))
+	binary.Write(buf, binary.BigEndian, l2Entries)
+	pad(buf, luksOffset-buf.Len())
+
+	binary.Write(buf, binary.BigEndian, luks)
+	pad(buf, luksOffset+int(slot.KeyMaterialOffset)*luksSectorSize-buf.Len())
+	buf.Write(material)
+	pad(buf, dataOffset-buf.Len())
+
+	data := make([]byte, clusterSize)
+	for i := range data {
+		data[i] = byte(i * 13)
+	}
+	encrypted := append([]byte(nil), data...)
+	encrypt(newCipher(masterKey), encrypted, uint64(dataOffset/luksSectorSize))
+	buf.Write(encrypted)
+	img := buf.Bytes()
+
+	if _, err := NewQcow2Format(bytes.NewReader(img)); err == nil {
+		t.Fatalf("encrypted image opened without a passphrase")
+	}
+	if _, err := NewQcow2FormatWithOptions(bytes.NewReader(img), Options{Passphrase: []byte("wrong")}); err == nil {
+		t.Fatalf("encrypted image opened with a wrong passphrase")
+	}
+
+	q, err := NewQcow2FormatWithOptions(bytes.NewReader(img), Options{Passphrase: passphrase})
+	if err != nil {
+		t.Fatalf("NewQcow2FormatWithOptions failed: %v", err)
+	}
+	out := make([]byte, clusterSize*2)
+	if _, err := q.ReadAt(out, 0); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if !bytes.Equal(out, append(data, make([]byte, clusterSize)...)) {
+		t.Fatalf("decrypted data mismatch")
+	}
+
+	// Reads that do not start or end on a sector boundary.
+	part := make([]byte, 700)
+	if _, err := q.ReadAt(part, 1000); err != nil {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if !bytes.Equal(part, data[1000:1700]) {
+		t.Fatalf("unaligned decrypted data mismatch")
+	}
+}
@@ -0,0 +1,383 @@
+package format
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	// DefaultClusterBits is the cluster size used by qemu-img (64k).
+	DefaultClusterBits = 16
+
+	// Writers always use 16 bit refcounts.
+	writerRefcountOrder = RefcountOrder16
+
+	// L1 and L2 entries referencing a cluster with a refcount of exactly one.
+	copiedFlag = uint64(1 << 63)
+)
+
+// WriterOptions controls the layout of images produced by Qcow2Writer.
+type WriterOptions struct {
+	// ClusterBits is the cluster size as a power of two, DefaultClusterBits if zero.
+	ClusterBits uint32
+	// Compress stores clusters deflate-compressed when that saves space.
+	Compress bool
+}
+
+// Qcow2Writer builds a version 3 qcow2 image from sequentially written guest
+// data. Data clusters are appended as soon as they are complete and all-zero
+// clusters are left unallocated. The L1 table, the refcount structures and the
+// header are written by Close, so the destination must accept random writes.
+type Qcow2Writer struct {
+	w           io.WriterAt
+	size        uint64
+	clusterBits uint32
+	clusterSize int64
+	l2Entries   int64
+	compress    bool
+
+	// l1Reserved is the number of L1 entries preallocated after the header.
+	l1Reserved int64
+	l1         []uint64
+
+	l2      []uint64
+	l2Index int64
+	l2Dirty bool
+
+	cluster      []byte
+	clusterFill  int64
+	guestCluster int64
+
+	nextCluster      int64
+	compressedOffset int64
+	// refcounts holds the host clusters whose refcount is not one.
+	refcounts map[int64]uint16
+}
+
+func NewQcow2Writer(w io.WriterAt, size uint64, opts WriterOptions) (*Qcow2Writer, error) {
+	clusterBits := opts.ClusterBits
+	if clusterBits == 0 {
+		clusterBits = DefaultClusterBits
+	}
+	if clusterBits < 9 || clusterBits > 21 {
+		return nil, fmt.Errorf("invalid cluster bits: %d", clusterBits)
+	}
+
+	q := &Qcow2Writer{
+		w:           w,
+		size:        size,
+		clusterBits: clusterBits,
+		clusterSize: int64(1) << clusterBits,
+		compress:    opts.Compress,
+		l2Index:     -1,
+		refcounts:   make(map[int64]uint16),
+	}
+	q.l2Entries = q.clusterSize / 8
+	q.cluster = make([]byte, q.clusterSize)
+
+	// Reserve room for the L1 table right after the header. If the stream turns
+	// out to be larger than announced, Close relocates the table.
+	guestClusters := divRoundUp(int64(size), q.clusterSize)
+	q.l1Reserved = divRoundUp(guestClusters, q.l2Entries)
+	if q.l1Reserved == 0 {
+		q.l1Reserved = 1
+	}
+	q.nextCluster = 1 + divRoundUp(q.l1Reserved*8, q.clusterSize)
+
+	return q, nil
+}
+
+func (q *Qcow2Writer) Write(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		c := copy(q.cluster[q.clusterFill:], p[n:])
+		q.clusterFill += int64(c)
+		n += c
+		if q.clusterFill == q.clusterSize {
+			if err := q.flushCluster(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (q *Qcow2Writer) Close() error {
+	if q.clusterFill > 0 {
+		for i := q.clusterFill; i < q.clusterSize; i++ {
+			q.cluster[i] = 0
+		}
+		guestEnd := uint64(q.guestCluster*q.clusterSize + q.clusterFill)
+		if guestEnd > q.size {
+			q.size = guestEnd
+		}
+		if err := q.flushCluster(); err != nil {
+			return err
+		}
+	} else if guestEnd := uint64(q.guestCluster * q.clusterSize); guestEnd > q.size {
+		q.size = guestEnd
+	}
+
+	if err := q.flushL2(); err != nil {
+		return err
+	}
+
+	l1Offset, err := q.writeL1()
+	if err != nil {
+		return err
+	}
+
+	refcountTableOffset, refcountTableClusters, err := q.writeRefcounts()
+	if err != nil {
+		return err
+	}
+
+	return q.writeHeader(l1Offset, refcountTableOffset, refcountTableClusters)
+}
+
+func (q *Qcow2Writer) allocCluster() int64 {
+	off := q.nextCluster * q.clusterSize
+	q.nextCluster++
+	return off
+}
+
+func (q *Qcow2Writer) flushCluster() error {
+	guestCluster := q.guestCluster
+	q.guestCluster++
+	q.clusterFill = 0
+
+	l1Index := guestCluster / q.l2Entries
+	if l1Index != q.l2Index {
+		if err := q.flushL2(); err != nil {
+			return err
+		}
+		q.l2Index = l1Index
+		q.l2 = make([]uint64, q.l2Entries)
+	}
+
+	if isZeroCluster(q.cluster) {
+		return nil
+	}
+
+	var entry uint64
+	if q.compress {
+		e, ok, err := q.writeCompressedCluster()
+		if err != nil {
+			return err
+		}
+		if ok {
+			entry = e
+		}
+	}
+	if entry == 0 {
+		off := q.allocCluster()
+		if _, err := q.w.WriteAt(q.cluster, off); err != nil {
+			return fmt.Errorf("failed to write cluster: %w", err)
+		}
+		entry = uint64(off) | copiedFlag
+	}
+
+	q.l2[guestCluster%q.l2Entries] = entry
+	q.l2Dirty = true
+	return nil
+}
+
+// writeCompressedCluster deflates the pending cluster and packs it into the
+// current compressed host cluster. It reports false if compression does not
+// save at least one sector.
+func (q *Qcow2Writer) writeCompressedCluster() (uint64, bool, error) {
+	var buf bytes.Buffer
+	zw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return 0, false, err
+	}
+	if _, err := zw.Write(q.cluster); err != nil {
+		return 0, false, err
+	}
+	if err := zw.Close(); err != nil {
+		return 0, false, err
+	}
+
+	sectors := divRoundUp(int64(buf.Len()), 512)
+	if sectors*512 >= q.clusterSize {
+		return 0, false, nil
+	}
+	buf.Write(make([]byte, sectors*512-int64(buf.Len())))
+
+	// Compressed data never spans host clusters, which keeps refcounting simple.
+	if q.compressedOffset == 0 || q.compressedOffset%q.clusterSize+sectors*512 > q.clusterSize {
+		q.compressedOffset = q.allocCluster()
+		q.refcounts[q.compressedOffset/q.clusterSize] = 0
+	}
+
+	off := q.compressedOffset
+	if _, err := q.w.WriteAt(buf.Bytes(), off); err != nil {
+		return 0, false, fmt.Errorf("failed to write compressed cluster: %w", err)
+	}
+	q.refcounts[off/q.clusterSize]++
+	q.compressedOffset += sectors * 512
+	if q.compressedOffset%q.clusterSize == 0 {
+		q.compressedOffset = 0
+	}
+
+	hdr := &HeaderAndAdditionalFields{Header: Header{ClusterBits: q.clusterBits}}
+	return uint64(NewL2TableEntry(hdr, off, true, sectors*512)), true, nil
+}
+
+func (q *Qcow2Writer) flushL2() error {
+	if !q.l2Dirty {
+		return nil
+	}
+
+	off := q.allocCluster()
+	if err := q.writeTable(q.l2, off); err != nil {
+		return fmt.Errorf("failed to write L2 table: %w", err)
+	}
+
+	for int64(len(q.l1)) <= q.l2Index {
+		q.l1 = append(q.l1, 0)
+	}
+	q.l1[q.l2Index] = uint64(off) | copiedFlag
+	q.l2Dirty = false
+	return nil
+}
+
+// writeL1 writes the L1 table into the reserved area, or to the end of the
+// image if more guest data arrived than the announced size allowed for.
+func (q *Qcow2Writer) writeL1() (int64, error) {
+	l1Size := divRoundUp(divRoundUp(int64(q.size), q.clusterSize), q.l2Entries)
+	if l1Size < int64(len(q.l1)) {
+		l1Size = int64(len(q.l1))
+	}
+	if l1Size == 0 {
+		l1Size = 1
+	}
+	for int64(len(q.l1)) < l1Size {
+		q.l1 = append(q.l1, 0)
+	}
+
+	off := q.clusterSize
+	if l1Size > q.l1Reserved {
+		reservedClusters := divRoundUp(q.l1Reserved*8, q.clusterSize)
+		for i := int64(1); i <= reservedClusters; i++ {
+			q.refcounts[i] = 0
+		}
+		off = q.nextCluster * q.clusterSize
+		q.nextCluster += divRoundUp(l1Size*8, q.clusterSize)
+	}
+
+	if err := q.writeTable(q.l1, off); err != nil {
+		return 0, fmt.Errorf("failed to write L1 table: %w", err)
+	}
+	return off, nil
+}
+
+// writeRefcounts appends the refcount table and refcount blocks covering every
+// host cluster of the image, including themselves.
+func (q *Qcow2Writer) writeRefcounts() (int64, int64, error) {
+	base := q.nextCluster
+	perBlock := q.clusterSize * 8 / (1 << writerRefcountOrder)
+
+	var blocks, tableClusters int64
+	for {
+		total := base + tableClusters + blocks
+		b := divRoundUp(total, perBlock)
+		t := divRoundUp(b*8, q.clusterSize)
+		if b == blocks && t == tableClusters {
+			break
+		}
+		blocks, tableClusters = b, t
+	}
+
+	tableOffset := q.allocCluster()
+	q.nextCluster += tableClusters - 1
+	total := q.nextCluster + blocks
+
+	table := make([]uint64, tableClusters*q.clusterSize/8)
+	block := make([]byte, q.clusterSize)
+	for b := int64(0); b < blocks; b++ {
+		for i := range block {
+			block[i] = 0
+		}
+		for i := int64(0); i < perBlock; i++ {
+			cluster := b*perBlock + i
+			if cluster >= total {
+				break
+			}
+			refcount, ok := q.refcounts[cluster]
+			if !ok {
+				refcount = 1
+			}
+			binary.BigEndian.PutUint16(block[i*2:], refcount)
+		}
+
+		off := q.allocCluster()
+		if _, err := q.w.WriteAt(block, off); err != nil {
+			return 0, 0, fmt.Errorf("failed to write refcount block: %w", err)
+		}
+		table[b] = uint64(off)
+	}
+
+	if err := q.writeTable(table, tableOffset); err != nil {
+		return 0, 0, fmt.Errorf("failed to write refcount table: %w", err)
+	}
+	return tableOffset, tableClusters, nil
+}
+
+func (q *Qcow2Writer) writeHeader(l1Offset, refcountTableOffset, refcountTableClusters int64) error {
+	hdr := Header{
+		Magic:                 Magic,
+		Version:               Version3,
+		ClusterBits:           q.clusterBits,
+		Size:                  q.size,
+		CryptMethod:           NoEncryption,
+		L1Size:                uint32(len(q.l1)),
+		L1TableOffset:         uint64(l1Offset),
+		RefcountTableOffset:   uint64(refcountTableOffset),
+		RefcountTableClusters: uint32(refcountTableClusters),
+		RefcountOrder:         writerRefcountOrder,
+	}
+	additionalFields := HeaderAdditionalFields{CompressionType: CompressionTypeDeflate}
+	hdr.HeaderLength = uint32(binary.Size(hdr) + binary.Size(additionalFields))
+
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.BigEndian, hdr); err != nil {
+		return err
+	}
+	if err := binary.Write(&buf, binary.BigEndian, additionalFields); err != nil {
+		return err
+	}
+	if err := binary.Write(&buf, binary.BigEndian, HeaderExtensionMetadata{Type: EndOfHeaderExtensionArea}); err != nil {
+		return err
+	}
+
+	if _, err := q.w.WriteAt(buf.Bytes(), 0); err != nil {
+		return fmt.Errorf("failed to write image header: %w", err)
+	}
+	return nil
+}
+
+func (q *Qcow2Writer) writeTable(t []uint64, off int64) error {
+	buf := make([]byte, divRoundUp(int64(len(t))*8, q.clusterSize)*q.clusterSize)
+	for i, e := range t {
+		binary.BigEndian.PutUint64(buf[i*8:], e)
+	}
+	_, err := q.w.WriteAt(buf, off)
+	return err
+}
+
+func isZeroCluster(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func divRoundUp(n, d int64) int64 {
+	return (n + d - 1) / d
+}
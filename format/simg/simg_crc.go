@@ -0,0 +1,61 @@
+package format
+
+// CRC32Zeros returns the CRC-32 (IEEE) of data whose CRC-32 is crc followed
+// by n zero bytes, without going through the zeros. Holes of many gigabytes
+// are common in sparse images, so their checksum is computed in O(log n)
+// steps by applying the operator that feeds zeros into the CRC register
+// through repeated squaring, as zlib's crc32_combine does.
+func CRC32Zeros(crc uint32, n int64) uint32 {
+	if n <= 0 {
+		return crc
+	}
+	// odd holds the operator for one zero bit, even the one for two.
+	var even, odd [32]uint32
+	odd[0] = 0xedb88320
+	row := uint32(1)
+	for i := 1; i < 32; i++ {
+		odd[i] = row
+		row <<= 1
+	}
+	gf2MatrixSquare(&even, &odd)
+	gf2MatrixSquare(&odd, &even)
+
+	// The register holds the inverted CRC.
+	reg := ^crc
+	for {
+		// One zero byte first, then two, four and so on.
+		gf2MatrixSquare(&even, &odd)
+		if n&1 != 0 {
+			reg = gf2MatrixTimes(&even, reg)
+		}
+		n >>= 1
+		if n == 0 {
+			break
+		}
+		gf2MatrixSquare(&odd, &even)
+		if n&1 != 0 {
+			reg = gf2MatrixTimes(&odd, reg)
+		}
+		n >>= 1
+		if n == 0 {
+			break
+		}
+	}
+	return ^reg
+}
+
+func gf2MatrixTimes(mat *[32]uint32, vec uint32) uint32 {
+	var sum uint32
+	for i := 0; vec != 0; i, vec = i+1, vec>>1 {
+		if vec&1 != 0 {
+			sum ^= mat[i]
+		}
+	}
+	return sum
+}
+
+func gf2MatrixSquare(square, mat *[32]uint32) {
+	for i := range mat {
+		square[i] = gf2MatrixTimes(mat, mat[i])
+	}
+}
@@ -0,0 +1,145 @@
+package format
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	// Magic identifies an Android sparse image.
+	Magic = 0xed26ff3a
+	// MajorVersion is the only supported major version; minor versions are
+	// compatible.
+	MajorVersion = 1
+
+	// FileHeaderSize and ChunkHeaderSize are the sizes of the headers written
+	// by this package. Images may use larger headers, whose extra bytes are
+	// skipped.
+	FileHeaderSize  = 28
+	ChunkHeaderSize = 12
+
+	// DefaultBlockSize is the block size used by img2simg and fastboot.
+	DefaultBlockSize = 4096
+)
+
+// ChunkType is the type of a chunk.
+type ChunkType uint16
+
+const (
+	// ChunkRaw holds the data of its blocks.
+	ChunkRaw ChunkType = 0xcac1
+	// ChunkFill holds a 4-byte value that fills its blocks.
+	ChunkFill ChunkType = 0xcac2
+	// ChunkDontCare covers blocks without data.
+	ChunkDontCare ChunkType = 0xcac3
+	// ChunkCRC32 holds the CRC-32 of the image up to the chunk and covers no
+	// blocks.
+	ChunkCRC32 ChunkType = 0xcac4
+)
+
+func (t ChunkType) String() string {
+	switch t {
+	case ChunkRaw:
+		return "raw"
+	case ChunkFill:
+		return "fill"
+	case ChunkDontCare:
+		return "don't care"
+	case ChunkCRC32:
+		return "crc32"
+	default:
+		return fmt.Sprintf("unknown (%#x)", uint16(t))
+	}
+}
+
+// FileHeader is the header at the start of the image, stored little-endian.
+type FileHeader struct {
+	Magic           uint32
+	MajorVersion    uint16
+	MinorVersion    uint16
+	FileHeaderSize  uint16
+	ChunkHeaderSize uint16
+	BlockSize       uint32
+	// TotalBlocks is the number of blocks of the disk, TotalChunks the number
+	// of chunks that follow the header.
+	TotalBlocks uint32
+	TotalChunks uint32
+	// ImageChecksum is the CRC-32 of the whole disk, or zero.
+	ImageChecksum uint32
+}
+
+// ParseFileHeader decodes and validates the file header.
+func ParseFileHeader(b []byte) (*FileHeader, error) {
+	if len(b) < FileHeaderSize {
+		return nil, fmt.Errorf("short sparse image header")
+	}
+	var h FileHeader
+	if err := binary.Read(bytes.NewReader(b[:FileHeaderSize]), binary.LittleEndian, &h); err != nil {
+		return nil, fmt.Errorf("failed to read sparse image header: %w", err)
+	}
+	if h.Magic != Magic {
+		return nil, fmt.Errorf("invalid sparse image magic %#x", h.Magic)
+	}
+	if h.MajorVersion != MajorVersion {
+		return nil, fmt.Errorf("unsupported sparse image version %d.%d", h.MajorVersion, h.MinorVersion)
+	}
+	if h.FileHeaderSize < FileHeaderSize || h.ChunkHeaderSize < ChunkHeaderSize {
+		return nil, fmt.Errorf("invalid sparse image header sizes %d and %d", h.FileHeaderSize, h.ChunkHeaderSize)
+	}
+	if h.BlockSize == 0 || h.BlockSize%4 != 0 {
+		return nil, fmt.Errorf("invalid sparse image block size %d", h.BlockSize)
+	}
+	return &h, nil
+}
+
+// Bytes encodes the header.
+func (h *FileHeader) Bytes() []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, h)
+	return buf.Bytes()
+}
+
+// ChunkHeader is the header of a chunk, stored little-endian.
+type ChunkHeader struct {
+	Type     ChunkType
+	Reserved uint16
+	// Blocks is the number of disk blocks the chunk covers, TotalSize the
+	// size of the chunk in the image including its header.
+	Blocks    uint32
+	TotalSize uint32
+}
+
+// ParseChunkHeader decodes a chunk header.
+func ParseChunkHeader(b []byte) (*ChunkHeader, error) {
+	if len(b) < ChunkHeaderSize {
+		return nil, fmt.Errorf("short sparse image chunk header")
+	}
+	var c ChunkHeader
+	if err := binary.Read(bytes.NewReader(b[:ChunkHeaderSize]), binary.LittleEndian, &c); err != nil {
+		return nil, fmt.Errorf("failed to read sparse image chunk header: %w", err)
+	}
+	return &c, nil
+}
+
+// Bytes encodes the chunk header.
+func (c *ChunkHeader) Bytes() []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, c)
+	return buf.Bytes()
+}
+
+// DataSize returns the number of bytes that follow the header of a chunk of
+// this type covering the given number of blocks, or -1 for unknown types.
+func (t ChunkType) DataSize(blocks uint32, blockSize uint32) int64 {
+	switch t {
+	case ChunkRaw:
+		return int64(blocks) * int64(blockSize)
+	case ChunkFill, ChunkCRC32:
+		return 4
+	case ChunkDontCare:
+		return 0
+	default:
+		return -1
+	}
+}
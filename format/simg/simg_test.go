@@ -0,0 +1,137 @@
+package format
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+)
+
+type memImage struct {
+	buf []byte
+}
+
+func (m *memImage) WriteAt(p []byte, off int64) (int, error) {
+	if end := int(off) + len(p); end > len(m.buf) {
+		m.buf = append(m.buf, make([]byte, end-len(m.buf))...)
+	}
+	return copy(m.buf[off:], p), nil
+}
+
+func TestSimgWriterLayout(t *testing.T) {
+	blockSize := 1024
+	data := make([]byte, blockSize*5+100)
+	for i := 0; i < 2*blockSize; i++ {
+		data[i] = byte(i*7 + 1)
+	}
+	for i := 3 * blockSize; i < 5*blockSize; i += 4 {
+		binary.LittleEndian.PutUint32(data[i:], 0xdeadbeef)
+	}
+	copy(data[5*blockSize:], bytes.Repeat([]byte{0x5f}, 100))
+
+	img := &memImage{}
+	w, err := NewSimgWriter(img, uint64(len(data)), WriterOptions{BlockSize: uint32(blockSize)})
+	if err != nil {
+		t.Fatalf("NewSimgWriter failed: %v", err)
+	}
+	// Writes that do not line up with the blocks.
+	for off := 0; off < len(data); off += 1000 {
+		if _, err := w.Write(data[off:min(off+1000, len(data))]); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	h, err := ParseFileHeader(img.buf)
+	if err != nil {
+		t.Fatalf("ParseFileHeader failed: %v", err)
+	}
+	if h.BlockSize != uint32(blockSize) || h.TotalBlocks != 6 || h.TotalChunks != 4 {
+		t.Fatalf("unexpected header %+v", h)
+	}
+
+	want := []struct {
+		typ    ChunkType
+		blocks uint32
+	}{
+		{ChunkRaw, 2},
+		{ChunkDontCare, 1},
+		{ChunkFill, 2},
+		{ChunkRaw, 1},
+	}
+	pos := FileHeaderSize
+	for i, e := range want {
+		c, err := ParseChunkHeader(img.buf[pos:])
+		if err != nil {
+			t.Fatalf("chunk %d: %v", i, err)
+		}
+		if c.Type != e.typ || c.Blocks != e.blocks || int64(c.TotalSize) != ChunkHeaderSize+e.typ.DataSize(e.blocks, uint32(blockSize)) {
+			t.Fatalf("chunk %d: %+v", i, c)
+		}
+		body := img.buf[pos+ChunkHeaderSize : pos+int(c.TotalSize)]
+		switch c.Type {
+		case ChunkRaw:
+			if i == 0 && !bytes.Equal(body, data[:2*blockSize]) {
+				t.Fatalf("chunk %d data mismatch", i)
+			}
+			if i == 3 && (!bytes.Equal(body[:100], data[5*blockSize:]) || !bytes.Equal(body[100:], make([]byte, blockSize-100))) {
+				t.Fatalf("last block is not padded with zeros")
+			}
+		case ChunkFill:
+			if v := binary.LittleEndian.Uint32(body); v != 0xdeadbeef {
+				t.Fatalf("fill value %#x", v)
+			}
+		}
+		pos += int(c.TotalSize)
+	}
+	if pos != len(img.buf) {
+		t.Fatalf("image is %d bytes, chunks end at %d", len(img.buf), pos)
+	}
+}
+
+func TestSimgWriterUnwrittenBlocks(t *testing.T) {
+	img := &memImage{}
+	w, err := NewSimgWriter(img, 16*DefaultBlockSize, WriterOptions{})
+	if err != nil {
+		t.Fatalf("NewSimgWriter failed: %v", err)
+	}
+	if _, err := w.Write(bytes.Repeat([]byte{1, 2, 3, 4, 5}, DefaultBlockSize)); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	h, err := ParseFileHeader(img.buf)
+	if err != nil {
+		t.Fatalf("ParseFileHeader failed: %v", err)
+	}
+	if h.TotalBlocks != 16 || h.TotalChunks != 2 {
+		t.Fatalf("unexpected header %+v", h)
+	}
+	c, err := ParseChunkHeader(img.buf[FileHeaderSize+ChunkHeaderSize+5*DefaultBlockSize:])
+	if err != nil {
+		t.Fatalf("ParseChunkHeader failed: %v", err)
+	}
+	if c.Type != ChunkDontCare || c.Blocks != 11 {
+		t.Fatalf("unexpected last chunk %+v", c)
+	}
+
+	if _, err := NewSimgWriter(img, 4096, WriterOptions{BlockSize: 1001}); err == nil {
+		t.Fatalf("block size 1001 accepted")
+	}
+}
+
+func TestCRC32Zeros(t *testing.T) {
+	for _, n := range []int{0, 1, 3, 4096, 100000} {
+		crc := crc32.ChecksumIEEE([]byte("sparse"))
+		want := crc32.Update(crc, crc32.IEEETable, make([]byte, n))
+		if got := CRC32Zeros(crc, int64(n)); got != want {
+			t.Fatalf("%d zeros: %#08x, want %#08x", n, got, want)
+		}
+	}
+	if got, want := CRC32Zeros(0, 5), crc32.ChecksumIEEE(make([]byte, 5)); got != want {
+		t.Fatalf("zeros only: %#08x, want %#08x", got, want)
+	}
+}
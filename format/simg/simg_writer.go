@@ -0,0 +1,199 @@
+package format
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// maxRawChunk bounds the data of a raw chunk, whose total size must fit in
+// 32 bits; fastboot splits images into pieces of a few hundred MiB anyway.
+const maxRawChunk = 64 << 20
+
+// WriterOptions controls the layout of images produced by SimgWriter.
+type WriterOptions struct {
+	// BlockSize is the block size, DefaultBlockSize if zero. It must be a
+	// multiple of 4.
+	BlockSize uint32
+}
+
+// SimgWriter builds an Android sparse image from sequentially written disk
+// data. Blocks that are all zeros become DONT_CARE chunks, blocks filled with
+// a repeating 4-byte value FILL chunks, and the other blocks RAW chunks;
+// neighbouring blocks of the same kind share a chunk. Chunk headers are
+// written once their chunk is complete and the file header, which carries the
+// number of chunks, by Close, so the destination must accept random writes.
+// The disk is padded with zeros to a whole number of blocks.
+type SimgWriter struct {
+	w           io.WriterAt
+	blockSize   int64
+	totalBlocks uint32
+
+	block []byte
+	fill  int64
+	// blocks is the number of blocks written so far.
+	blocks uint32
+
+	// The chunk being built: its header offset, type, fill value and size.
+	chunkOffset int64
+	chunkType   ChunkType
+	chunkValue  uint32
+	chunkBlocks uint32
+	chunks      uint32
+	// pos is where the next chunk data goes.
+	pos int64
+}
+
+func NewSimgWriter(w io.WriterAt, size uint64, opts WriterOptions) (*SimgWriter, error) {
+	blockSize := opts.BlockSize
+	if blockSize == 0 {
+		blockSize = DefaultBlockSize
+	}
+	if blockSize%4 != 0 || blockSize > maxRawChunk {
+		return nil, fmt.Errorf("invalid sparse image block size %d", blockSize)
+	}
+	blocks := (size + uint64(blockSize) - 1) / uint64(blockSize)
+	if blocks > uint64(^uint32(0)) {
+		return nil, fmt.Errorf("sparse image of %d bytes needs too many %d-byte blocks", size, blockSize)
+	}
+	return &SimgWriter{
+		w:           w,
+		blockSize:   int64(blockSize),
+		totalBlocks: uint32(blocks),
+		block:       make([]byte, blockSize),
+		pos:         FileHeaderSize,
+	}, nil
+}
+
+func (s *SimgWriter) Write(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if s.blocks >= s.totalBlocks {
+			return n, fmt.Errorf("write beyond the %d blocks of the sparse image", s.totalBlocks)
+		}
+		c := copy(s.block[s.fill:], p[n:])
+		s.fill += int64(c)
+		n += c
+		if s.fill == s.blockSize {
+			if err := s.writeBlock(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// writeBlock adds the buffered block to the current chunk, or ends the chunk
+// and starts a new one when the block is of another kind.
+func (s *SimgWriter) writeBlock() error {
+	typ, value := classify(s.block)
+	s.fill = 0
+	s.blocks++
+
+	extend := s.chunkBlocks > 0 && typ == s.chunkType && value == s.chunkValue && s.chunkBlocks < ^uint32(0)
+	if typ == ChunkRaw && int64(s.chunkBlocks+1)*s.blockSize > maxRawChunk {
+		extend = false
+	}
+	if !extend {
+		if err := s.endChunk(); err != nil {
+			return err
+		}
+		s.chunkOffset = s.pos
+		s.chunkType = typ
+		s.chunkValue = value
+		s.pos += ChunkHeaderSize + typ.DataSize(0, 0)
+	}
+	s.chunkBlocks++
+	if typ == ChunkRaw {
+		if _, err := s.w.WriteAt(s.block, s.pos); err != nil {
+			return fmt.Errorf("failed to write sparse image data: %w", err)
+		}
+		s.pos += s.blockSize
+	}
+	return nil
+}
+
+// endChunk writes the header of the current chunk, if any.
+func (s *SimgWriter) endChunk() error {
+	if s.chunkBlocks == 0 {
+		return nil
+	}
+	c := ChunkHeader{
+		Type:      s.chunkType,
+		Blocks:    s.chunkBlocks,
+		TotalSize: uint32(ChunkHeaderSize + s.chunkType.DataSize(s.chunkBlocks, uint32(s.blockSize))),
+	}
+	b := c.Bytes()
+	if s.chunkType == ChunkFill {
+		b = binary.LittleEndian.AppendUint32(b, s.chunkValue)
+	}
+	if _, err := s.w.WriteAt(b, s.chunkOffset); err != nil {
+		return fmt.Errorf("failed to write sparse image chunk header: %w", err)
+	}
+	s.chunks++
+	s.chunkBlocks = 0
+	return nil
+}
+
+// classify returns the chunk type of a block and the fill value of FILL
+// blocks.
+func classify(block []byte) (ChunkType, uint32) {
+	value := binary.LittleEndian.Uint32(block)
+	for i := 4; i < len(block); i += 4 {
+		if binary.LittleEndian.Uint32(block[i:]) != value {
+			return ChunkRaw, 0
+		}
+	}
+	if value == 0 {
+		return ChunkDontCare, 0
+	}
+	return ChunkFill, value
+}
+
+// Close pads the last block, covers blocks that were never written with a
+// DONT_CARE chunk and writes the file header.
+func (s *SimgWriter) Close() error {
+	if s.fill > 0 {
+		clear(s.block[s.fill:])
+		s.fill = s.blockSize
+		if err := s.writeBlock(); err != nil {
+			return err
+		}
+	}
+	if s.blocks < s.totalBlocks {
+		if s.chunkBlocks > 0 && s.chunkType != ChunkDontCare {
+			if err := s.endChunk(); err != nil {
+				return err
+			}
+		}
+		if s.chunkBlocks == 0 {
+			s.chunkOffset = s.pos
+			s.chunkType = ChunkDontCare
+			s.pos += ChunkHeaderSize
+		}
+		s.chunkBlocks += s.totalBlocks - s.blocks
+		s.blocks = s.totalBlocks
+	}
+	if err := s.endChunk(); err != nil {
+		return err
+	}
+
+	h := FileHeader{
+		Magic:           Magic,
+		MajorVersion:    MajorVersion,
+		FileHeaderSize:  FileHeaderSize,
+		ChunkHeaderSize: ChunkHeaderSize,
+		BlockSize:       uint32(s.blockSize),
+		TotalBlocks:     s.totalBlocks,
+		TotalChunks:     s.chunks,
+	}
+	if _, err := s.w.WriteAt(h.Bytes(), 0); err != nil {
+		return fmt.Errorf("failed to write sparse image header: %w", err)
+	}
+	return nil
+}
+
+// Size returns the size of the image written so far.
+func (s *SimgWriter) Size() int64 {
+	return s.pos
+}
@@ -0,0 +1,137 @@
+package format
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	// FileInfo is the text at the start of images written by VirtualBox.
+	FileInfo = "<<< Oracle VM VirtualBox Disk Image >>>\n"
+	// Signature identifies the pre-header.
+	Signature = 0xbeda107f
+	// Version is the only supported image version (1.1).
+	Version = 0x00010001
+
+	// HeaderSize is the size of the pre-header and the version 1.1 header,
+	// padded to a sector. The header itself is HeaderV1Size bytes, or
+	// HeaderV1PlusSize when it includes the LCHS geometry.
+	HeaderSize       = 512
+	PreHeaderSize    = 72
+	HeaderV1Size     = 384
+	HeaderV1PlusSize = 400
+	SectorSize       = 512
+
+	// BlockUnallocated and BlockZero are block map entries of blocks without
+	// data. Both read as zeros.
+	BlockUnallocated = 0xffffffff
+	BlockZero        = 0xfffffffe
+
+	// DefaultBlockSize is the block size used by VirtualBox (1 MiB).
+	DefaultBlockSize = 1 << 20
+)
+
+// ImageType is the type of the image.
+type ImageType uint32
+
+const (
+	ImageTypeDynamic ImageType = 1
+	ImageTypeFixed   ImageType = 2
+	ImageTypeUndo    ImageType = 3
+	ImageTypeDiff    ImageType = 4
+)
+
+func (t ImageType) String() string {
+	switch t {
+	case ImageTypeDynamic:
+		return "dynamic"
+	case ImageTypeFixed:
+		return "fixed"
+	case ImageTypeUndo:
+		return "undo"
+	case ImageTypeDiff:
+		return "differencing"
+	default:
+		return fmt.Sprintf("unknown (%d)", uint32(t))
+	}
+}
+
+// UUID is a UUID as stored by VirtualBox.
+type UUID [16]byte
+
+// Geometry is a CHS geometry with its sector size.
+type Geometry struct {
+	Cylinders  uint32
+	Heads      uint32
+	Sectors    uint32
+	SectorSize uint32
+}
+
+// Header is the pre-header followed by the version 1.1 header, stored
+// little-endian.
+type Header struct {
+	FileInfo  [64]byte
+	Signature uint32
+	Version   uint32
+
+	HeaderSize      uint32
+	ImageType       ImageType
+	ImageFlags      uint32
+	Description     [256]byte
+	OffsetBlocks    uint32
+	OffsetData      uint32
+	LegacyGeometry  Geometry
+	Dummy           uint32
+	DiskSize        uint64
+	BlockSize       uint32
+	BlockExtra      uint32
+	BlocksInImage   uint32
+	BlocksAllocated uint32
+	UUIDImage       UUID
+	UUIDLastSnap    UUID
+	UUIDLink        UUID
+	UUIDParent      UUID
+	LCHSGeometry    Geometry
+	Reserved        [40]byte
+}
+
+// ParseHeader decodes and validates the pre-header and the header.
+func ParseHeader(b []byte) (*Header, error) {
+	if len(b) < HeaderSize {
+		return nil, fmt.Errorf("short VDI header")
+	}
+	var h Header
+	if err := binary.Read(bytes.NewReader(b[:HeaderSize]), binary.LittleEndian, &h); err != nil {
+		return nil, fmt.Errorf("failed to read VDI header: %w", err)
+	}
+	if h.Signature != Signature {
+		return nil, fmt.Errorf("invalid VDI signature %#x", h.Signature)
+	}
+	if h.Version != Version {
+		return nil, fmt.Errorf("unsupported VDI version %#x", h.Version)
+	}
+	if h.HeaderSize < HeaderV1Size || h.HeaderSize > HeaderSize-PreHeaderSize {
+		return nil, fmt.Errorf("invalid VDI header size %d", h.HeaderSize)
+	}
+	if h.BlockSize == 0 || h.BlockSize%SectorSize != 0 {
+		return nil, fmt.Errorf("invalid VDI block size %d", h.BlockSize)
+	}
+	if uint64(h.BlocksInImage)*uint64(h.BlockSize) < h.DiskSize {
+		return nil, fmt.Errorf("VDI block map with %d blocks does not cover the disk", h.BlocksInImage)
+	}
+	return &h, nil
+}
+
+// Bytes encodes the header.
+func (h *Header) Bytes() []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, h)
+	return buf.Bytes()
+}
+
+// BlockOffset returns the file offset of the data of the block stored at
+// map entry index.
+func (h *Header) BlockOffset(entry uint32) int64 {
+	return int64(h.OffsetData) + int64(entry)*int64(h.BlockSize+h.BlockExtra) + int64(h.BlockExtra)
+}
@@ -0,0 +1,64 @@
+package format
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+type memImage struct {
+	buf []byte
+}
+
+func (m *memImage) WriteAt(p []byte, off int64) (int, error) {
+	if end := int(off) + len(p); end > len(m.buf) {
+		m.buf = append(m.buf, make([]byte, end-len(m.buf))...)
+	}
+	return copy(m.buf[off:], p), nil
+}
+
+func TestVDIWriterLayout(t *testing.T) {
+	blockSize := 4096
+	data := make([]byte, blockSize*4+100)
+	copy(data[blockSize:], bytes.Repeat([]byte{0x5e}, 10))
+	copy(data[blockSize*4:], bytes.Repeat([]byte{0x5f}, 100))
+
+	img := &memImage{}
+	w, err := NewVDIWriter(img, uint64(len(data)), WriterOptions{BlockSize: uint32(blockSize)})
+	if err != nil {
+		t.Fatalf("NewVDIWriter failed: %v", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	h, err := ParseHeader(img.buf)
+	if err != nil {
+		t.Fatalf("ParseHeader failed: %v", err)
+	}
+	if string(h.FileInfo[:len(FileInfo)]) != FileInfo || h.ImageType != ImageTypeDynamic {
+		t.Fatalf("unexpected header %+v", h)
+	}
+	if h.DiskSize != uint64(len(data)+412) || h.BlocksInImage != 5 || h.BlocksAllocated != 2 {
+		t.Fatalf("disk size %d, %d blocks, %d allocated", h.DiskSize, h.BlocksInImage, h.BlocksAllocated)
+	}
+	if h.OffsetBlocks%dataAlignment != 0 || h.OffsetData%dataAlignment != 0 {
+		t.Fatalf("block map at %d, data at %d", h.OffsetBlocks, h.OffsetData)
+	}
+
+	want := []uint32{BlockUnallocated, 0, BlockUnallocated, BlockUnallocated, 1}
+	for i, e := range want {
+		if got := binary.LittleEndian.Uint32(img.buf[int(h.OffsetBlocks)+i*4:]); got != e {
+			t.Fatalf("block %d map entry %#x, want %#x", i, got, e)
+		}
+	}
+	if int64(len(img.buf)) != h.BlockOffset(2) {
+		t.Fatalf("image is %d bytes", len(img.buf))
+	}
+	if !bytes.Equal(img.buf[h.BlockOffset(1):h.BlockOffset(1)+100], data[blockSize*4:]) {
+		t.Fatalf("last block mismatch")
+	}
+}
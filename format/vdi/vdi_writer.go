@@ -0,0 +1,152 @@
+package format
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// dataAlignment is the alignment of the block map and the blocks in images
+// written by VirtualBox.
+const dataAlignment = 1 << 20
+
+// WriterOptions controls the layout of images produced by VDIWriter.
+type WriterOptions struct {
+	// BlockSize is the block size, DefaultBlockSize if zero.
+	BlockSize uint32
+}
+
+// VDIWriter builds a dynamic VDI image from sequentially written guest data.
+// Blocks that are all zeros are left unallocated. The block map and the
+// number of allocated blocks are written by Close, so the destination must
+// accept random writes.
+type VDIWriter struct {
+	w         io.WriterAt
+	header    Header
+	blockSize int64
+	blockMap  []uint32
+
+	block  []byte
+	fill   int64
+	offset int64
+}
+
+func NewVDIWriter(w io.WriterAt, size uint64, opts WriterOptions) (*VDIWriter, error) {
+	blockSize := opts.BlockSize
+	if blockSize == 0 {
+		blockSize = DefaultBlockSize
+	}
+	if blockSize%SectorSize != 0 {
+		return nil, fmt.Errorf("invalid VDI block size %d", blockSize)
+	}
+	size = (size + SectorSize - 1) / SectorSize * SectorSize
+	blocks := (size + uint64(blockSize) - 1) / uint64(blockSize)
+	if blocks > BlockZero-1 {
+		return nil, fmt.Errorf("VDI image of %d bytes needs too many blocks", size)
+	}
+
+	v := &VDIWriter{
+		w:         w,
+		blockSize: int64(blockSize),
+		blockMap:  make([]uint32, blocks),
+		block:     make([]byte, blockSize),
+	}
+	for i := range v.blockMap {
+		v.blockMap[i] = BlockUnallocated
+	}
+
+	h := &v.header
+	copy(h.FileInfo[:], FileInfo)
+	h.Signature = Signature
+	h.Version = Version
+	h.HeaderSize = HeaderV1PlusSize
+	h.ImageType = ImageTypeDynamic
+	h.OffsetBlocks = dataAlignment
+	h.OffsetData = uint32(alignUp(dataAlignment+int64(blocks)*4, dataAlignment))
+	h.LegacyGeometry.SectorSize = SectorSize
+	h.LCHSGeometry.SectorSize = SectorSize
+	h.DiskSize = size
+	h.BlockSize = blockSize
+	h.BlocksInImage = uint32(blocks)
+	rand.Read(h.UUIDImage[:])
+	rand.Read(h.UUIDLastSnap[:])
+	// Mark the UUIDs as random (version 4) ones.
+	for _, u := range []*UUID{&h.UUIDImage, &h.UUIDLastSnap} {
+		u[7] = u[7]&0x0f | 0x40
+		u[8] = u[8]&0x3f | 0x80
+	}
+	return v, nil
+}
+
+func (v *VDIWriter) Write(p []byte) (int, error) {
+	if v.offset+v.fill+int64(len(p)) > int64(v.header.DiskSize) {
+		return 0, fmt.Errorf("write beyond the VDI capacity of %d bytes", v.header.DiskSize)
+	}
+	n := 0
+	for n < len(p) {
+		c := copy(v.block[v.fill:], p[n:])
+		v.fill += int64(c)
+		n += c
+		if v.fill == v.blockSize {
+			if err := v.flushBlock(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// flushBlock appends the pending block unless it is all zeros.
+func (v *VDIWriter) flushBlock() error {
+	index := v.offset / v.blockSize
+	v.offset += v.blockSize
+	v.fill = 0
+
+	if isZero(v.block) {
+		return nil
+	}
+	entry := v.header.BlocksAllocated
+	if _, err := v.w.WriteAt(v.block, v.header.BlockOffset(entry)); err != nil {
+		return fmt.Errorf("failed to write VDI block: %w", err)
+	}
+	v.blockMap[index] = entry
+	v.header.BlocksAllocated++
+	return nil
+}
+
+func (v *VDIWriter) Close() error {
+	if v.fill > 0 {
+		for i := v.fill; i < v.blockSize; i++ {
+			v.block[i] = 0
+		}
+		if err := v.flushBlock(); err != nil {
+			return err
+		}
+	}
+
+	blockMap := make([]byte, len(v.blockMap)*4)
+	for i, e := range v.blockMap {
+		binary.LittleEndian.PutUint32(blockMap[i*4:], e)
+	}
+	if _, err := v.w.WriteAt(blockMap, int64(v.header.OffsetBlocks)); err != nil {
+		return fmt.Errorf("failed to write VDI block map: %w", err)
+	}
+	if _, err := v.w.WriteAt(v.header.Bytes(), 0); err != nil {
+		return fmt.Errorf("failed to write VDI header: %w", err)
+	}
+	return nil
+}
+
+func alignUp(n, a int64) int64 {
+	return (n + a - 1) / a * a
+}
+
+func isZero(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,177 @@
+package format
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	// FooterCookie starts the footer at the end of every image, and its copy
+	// at the start of dynamic images.
+	FooterCookie = "conectix"
+	// DynamicHeaderCookie starts the dynamic disk header.
+	DynamicHeaderCookie = "cxsparse"
+
+	FooterSize        = 512
+	DynamicHeaderSize = 1024
+	SectorSize        = 512
+
+	// FileFormatVersion is the only version of the format.
+	FileFormatVersion = 0x00010000
+	// DynamicHeaderVersion is the only version of the dynamic disk header.
+	DynamicHeaderVersion = 0x00010000
+	// FeaturesReserved must always be set in the footer.
+	FeaturesReserved = 0x00000002
+
+	// FixedDataOffset is the footer data offset of fixed images.
+	FixedDataOffset = 0xffffffffffffffff
+	// UnallocatedBlock marks BAT entries of blocks that are not allocated.
+	UnallocatedBlock = 0xffffffff
+
+	// DefaultBlockSize is the block size used by Hyper-V and qemu (2 MiB).
+	DefaultBlockSize = 2 << 20
+)
+
+// DiskType is the type of the image.
+type DiskType uint32
+
+const (
+	DiskTypeFixed        DiskType = 2
+	DiskTypeDynamic      DiskType = 3
+	DiskTypeDifferencing DiskType = 4
+)
+
+func (t DiskType) String() string {
+	switch t {
+	case DiskTypeFixed:
+		return "fixed"
+	case DiskTypeDynamic:
+		return "dynamic"
+	case DiskTypeDifferencing:
+		return "differencing"
+	default:
+		return fmt.Sprintf("unknown (%d)", uint32(t))
+	}
+}
+
+// Geometry is the CHS geometry stored in the footer.
+type Geometry struct {
+	Cylinders       uint16
+	Heads           uint8
+	SectorsPerTrack uint8
+}
+
+// Footer is the hard disk footer, stored big-endian.
+type Footer struct {
+	Cookie             [8]byte
+	Features           uint32
+	FileFormatVersion  uint32
+	DataOffset         uint64
+	TimeStamp          uint32
+	CreatorApplication [4]byte
+	CreatorVersion     uint32
+	CreatorHostOS      [4]byte
+	OriginalSize       uint64
+	CurrentSize        uint64
+	DiskGeometry       Geometry
+	DiskType           DiskType
+	Checksum           uint32
+	UniqueID           [16]byte
+	SavedState         uint8
+	Reserved           [427]byte
+}
+
+// ParentLocator is a parent locator entry of the dynamic disk header.
+type ParentLocator struct {
+	PlatformCode       [4]byte
+	PlatformDataSpace  uint32
+	PlatformDataLength uint32
+	Reserved           uint32
+	PlatformDataOffset uint64
+}
+
+// DynamicHeader is the dynamic disk header of dynamic and differencing
+// images, stored big-endian.
+type DynamicHeader struct {
+	Cookie            [8]byte
+	DataOffset        uint64
+	TableOffset       uint64
+	HeaderVersion     uint32
+	MaxTableEntries   uint32
+	BlockSize         uint32
+	Checksum          uint32
+	ParentUniqueID    [16]byte
+	ParentTimeStamp   uint32
+	Reserved          uint32
+	ParentUnicodeName [512]byte
+	ParentLocators    [8]ParentLocator
+	Reserved2         [256]byte
+}
+
+// Checksum is the one's complement of the sum of all bytes of a footer or
+// dynamic header, with its checksum field taken as zero.
+func Checksum(b []byte, checksumOffset int) uint32 {
+	var sum uint32
+	for i, v := range b {
+		if i >= checksumOffset && i < checksumOffset+4 {
+			continue
+		}
+		sum += uint32(v)
+	}
+	return ^sum
+}
+
+const (
+	footerChecksumOffset        = 64
+	dynamicHeaderChecksumOffset = 36
+)
+
+// ParseFooter decodes and validates a footer.
+func ParseFooter(b []byte) (*Footer, error) {
+	if len(b) < FooterSize {
+		return nil, fmt.Errorf("short VHD footer")
+	}
+	var f Footer
+	if err := binary.Read(bytes.NewReader(b[:FooterSize]), binary.BigEndian, &f); err != nil {
+		return nil, fmt.Errorf("failed to read VHD footer: %w", err)
+	}
+	if string(f.Cookie[:]) != FooterCookie {
+		return nil, fmt.Errorf("invalid VHD footer cookie")
+	}
+	if sum := Checksum(b[:FooterSize], footerChecksumOffset); sum != f.Checksum {
+		return nil, fmt.Errorf("VHD footer checksum mismatch")
+	}
+	if f.FileFormatVersion>>16 != FileFormatVersion>>16 {
+		return nil, fmt.Errorf("unsupported VHD version %#x", f.FileFormatVersion)
+	}
+	return &f, nil
+}
+
+// ParseDynamicHeader decodes and validates a dynamic disk header.
+func ParseDynamicHeader(b []byte) (*DynamicHeader, error) {
+	if len(b) < DynamicHeaderSize {
+		return nil, fmt.Errorf("short VHD dynamic header")
+	}
+	var h DynamicHeader
+	if err := binary.Read(bytes.NewReader(b[:DynamicHeaderSize]), binary.BigEndian, &h); err != nil {
+		return nil, fmt.Errorf("failed to read VHD dynamic header: %w", err)
+	}
+	if string(h.Cookie[:]) != DynamicHeaderCookie {
+		return nil, fmt.Errorf("invalid VHD dynamic header cookie")
+	}
+	if sum := Checksum(b[:DynamicHeaderSize], dynamicHeaderChecksumOffset); sum != h.Checksum {
+		return nil, fmt.Errorf("VHD dynamic header checksum mismatch")
+	}
+	if h.BlockSize == 0 || h.BlockSize%SectorSize != 0 {
+		return nil, fmt.Errorf("invalid VHD block size %d", h.BlockSize)
+	}
+	return &h, nil
+}
+
+// BitmapSize is the size of the sector bitmap in front of every block,
+// padded to a sector.
+func (h *DynamicHeader) BitmapSize() int64 {
+	sectors := int64(h.BlockSize) / SectorSize
+	return ((sectors+7)/8 + SectorSize - 1) / SectorSize * SectorSize
+}
@@ -0,0 +1,113 @@
+package format
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+type memImage struct {
+	buf []byte
+}
+
+func (m *memImage) WriteAt(p []byte, off int64) (int, error) {
+	if end := int(off) + len(p); end > len(m.buf) {
+		m.buf = append(m.buf, make([]byte, end-len(m.buf))...)
+	}
+	return copy(m.buf[off:], p), nil
+}
+
+func TestCHSGeometry(t *testing.T) {
+	for _, tc := range []struct {
+		size uint64
+		want Geometry
+	}{
+		{1 << 30, Geometry{Cylinders: 2080, Heads: 16, SectorsPerTrack: 63}},
+		{10 << 20, Geometry{Cylinders: 301, Heads: 4, SectorsPerTrack: 17}},
+		{4 << 40, Geometry{Cylinders: 65535, Heads: 16, SectorsPerTrack: 255}},
+	} {
+		if got := CHSGeometry(tc.size); got != tc.want {
+			t.Errorf("CHSGeometry(%d) = %+v, want %+v", tc.size, got, tc.want)
+		}
+	}
+}
+
+func TestVHDWriterLayout(t *testing.T) {
+	blockSize := 4096
+	data := make([]byte, blockSize*3+100)
+	copy(data[blockSize*2:], bytes.Repeat([]byte{0x7f}, blockSize+100))
+
+	t.Run("fixed", func(t *testing.T) {
+		img := &memImage{}
+		w, err := NewVHDWriter(img, uint64(len(data)), WriterOptions{})
+		if err != nil {
+			t.Fatalf("NewVHDWriter failed: %v", err)
+		}
+		if _, err := w.Write(data); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+
+		if len(img.buf) != FixedAlignment+FooterSize {
+			t.Fatalf("fixed image is %d bytes, want %d", len(img.buf), FixedAlignment+FooterSize)
+		}
+		footer, err := ParseFooter(img.buf[FixedAlignment:])
+		if err != nil {
+			t.Fatalf("ParseFooter failed: %v", err)
+		}
+		if footer.DiskType != DiskTypeFixed || footer.CurrentSize != FixedAlignment {
+			t.Fatalf("footer type=%s size=%d", footer.DiskType, footer.CurrentSize)
+		}
+		if !bytes.Equal(img.buf[:len(data)], data) {
+			t.Fatalf("fixed data mismatch")
+		}
+	})
+
+	t.Run("dynamic", func(t *testing.T) {
+		img := &memImage{}
+		w, err := NewVHDWriter(img, uint64(len(data)), WriterOptions{Dynamic: true, BlockSize: uint32(blockSize)})
+		if err != nil {
+			t.Fatalf("NewVHDWriter failed: %v", err)
+		}
+		if _, err := w.Write(data); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+
+		head, err := ParseFooter(img.buf)
+		if err != nil {
+			t.Fatalf("ParseFooter failed: %v", err)
+		}
+		if tail, err := ParseFooter(img.buf[len(img.buf)-FooterSize:]); err != nil || *tail != *head {
+			t.Fatalf("footer copy differs from footer: %v", err)
+		}
+		header, err := ParseDynamicHeader(img.buf[head.DataOffset:])
+		if err != nil {
+			t.Fatalf("ParseDynamicHeader failed: %v", err)
+		}
+		if header.MaxTableEntries != 4 {
+			t.Fatalf("MaxTableEntries = %d, want 4", header.MaxTableEntries)
+		}
+
+		// Only the two blocks holding data are allocated.
+		for i := 0; i < 4; i++ {
+			entry := binary.BigEndian.Uint32(img.buf[int(header.TableOffset)+i*4:])
+			if allocated := entry != UnallocatedBlock; allocated != (i >= 2) {
+				t.Fatalf("block %d allocated=%v", i, allocated)
+			}
+			if entry == UnallocatedBlock {
+				continue
+			}
+			off := int64(entry)*SectorSize + header.BitmapSize()
+			want := make([]byte, blockSize)
+			copy(want, data[i*blockSize:])
+			if !bytes.Equal(img.buf[off:off+int64(blockSize)], want) {
+				t.Fatalf("block %d data mismatch", i)
+			}
+		}
+	})
+}
@@ -0,0 +1,281 @@
+package format
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	// FixedAlignment is the capacity alignment Azure requires of fixed images.
+	FixedAlignment = 1 << 20
+
+	// maxCHSSectors is the largest disk the CHS geometry can describe.
+	maxCHSSectors = 65535 * 16 * 255
+)
+
+var (
+	// timestampEpoch is the origin of footer and header timestamps.
+	timestampEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	creatorApplication = [4]byte{'d', 's', 'c', ' '}
+	creatorHostOS      = [4]byte{'W', 'i', '2', 'k'}
+)
+
+// WriterOptions controls the layout of images produced by VHDWriter.
+type WriterOptions struct {
+	// Dynamic writes a dynamic image instead of a fixed one.
+	Dynamic bool
+	// BlockSize is the block size of dynamic images, DefaultBlockSize if zero.
+	BlockSize uint32
+}
+
+// VHDWriter builds a VHD image from sequentially written guest data.
+//
+// Fixed images are the data followed by the footer, with the capacity rounded
+// up to FixedAlignment, and are written strictly sequentially. Dynamic images
+// only store blocks that are not all zeros; the BAT is written by Close, so
+// the destination must accept random writes.
+type VHDWriter struct {
+	w         io.WriterAt
+	size      uint64
+	dynamic   bool
+	blockSize int64
+	footer    *Footer
+
+	// offset is the next guest offset, written is the end of the image file.
+	offset  int64
+	written int64
+
+	bat    []uint32
+	block  []byte
+	fill   int64
+	bitmap []byte
+}
+
+func NewVHDWriter(w io.WriterAt, size uint64, opts WriterOptions) (*VHDWriter, error) {
+	v := &VHDWriter{w: w, dynamic: opts.Dynamic}
+
+	if !v.dynamic {
+		v.size = (size + FixedAlignment - 1) / FixedAlignment * FixedAlignment
+		v.footer = NewFooter(v.size, DiskTypeFixed)
+		return v, nil
+	}
+
+	v.blockSize = int64(opts.BlockSize)
+	if v.blockSize == 0 {
+		v.blockSize = DefaultBlockSize
+	}
+	if v.blockSize%SectorSize != 0 {
+		return nil, fmt.Errorf("invalid VHD block size %d", v.blockSize)
+	}
+	v.size = (size + SectorSize - 1) / SectorSize * SectorSize
+	v.footer = NewFooter(v.size, DiskTypeDynamic)
+	v.footer.DataOffset = FooterSize
+
+	blocks := (int64(v.size) + v.blockSize - 1) / v.blockSize
+	v.bat = make([]uint32, blocks)
+	for i := range v.bat {
+		v.bat[i] = UnallocatedBlock
+	}
+	v.block = make([]byte, v.blockSize)
+
+	header := &DynamicHeader{
+		DataOffset:      FixedDataOffset,
+		TableOffset:     FooterSize + DynamicHeaderSize,
+		HeaderVersion:   DynamicHeaderVersion,
+		MaxTableEntries: uint32(blocks),
+		BlockSize:       uint32(v.blockSize),
+	}
+	v.bitmap = bytes.Repeat([]byte{0xff}, int(header.BitmapSize()))
+
+	// Blocks follow the BAT. Every sector of a stored block is marked as
+	// written in its bitmap.
+	v.written = int64(header.TableOffset) + (blocks*4+SectorSize-1)/SectorSize*SectorSize
+	if _, err := w.WriteAt(header.Bytes(), FooterSize); err != nil {
+		return nil, fmt.Errorf("failed to write VHD dynamic header: %w", err)
+	}
+	return v, nil
+}
+
+func (v *VHDWriter) Write(p []byte) (int, error) {
+	if v.offset+v.fill+int64(len(p)) > int64(v.size) {
+		return 0, fmt.Errorf("write beyond the VHD capacity of %d bytes", v.size)
+	}
+	if !v.dynamic {
+		n, err := v.w.WriteAt(p, v.offset)
+		v.offset += int64(n)
+		if err != nil {
+			return n, fmt.Errorf("failed to write VHD data: %w", err)
+		}
+		return n, nil
+	}
+
+	n := 0
+	for n < len(p) {
+		c := copy(v.block[v.fill:], p[n:])
+		v.fill += int64(c)
+		n += c
+		if v.fill == v.blockSize {
+			if err := v.flushBlock(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// flushBlock appends the pending block unless it is all zeros.
+func (v *VHDWriter) flushBlock() error {
+	index := v.offset / v.blockSize
+	v.offset += v.blockSize
+	v.fill = 0
+
+	if isZero(v.block) {
+		return nil
+	}
+	if _, err := v.w.WriteAt(v.bitmap, v.written); err != nil {
+		return fmt.Errorf("failed to write VHD block bitmap: %w", err)
+	}
+	if _, err := v.w.WriteAt(v.block, v.written+int64(len(v.bitmap))); err != nil {
+		return fmt.Errorf("failed to write VHD block: %w", err)
+	}
+	v.bat[index] = uint32(v.written / SectorSize)
+	v.written += int64(len(v.bitmap)) + v.blockSize
+	return nil
+}
+
+func (v *VHDWriter) Close() error {
+	if !v.dynamic {
+		// Pad the data up to the aligned capacity.
+		zero := make([]byte, 1<<16)
+		for v.offset < int64(v.size) {
+			chunk := zero
+			if rest := int64(v.size) - v.offset; rest < int64(len(chunk)) {
+				chunk = chunk[:rest]
+			}
+			if _, err := v.Write(chunk); err != nil {
+				return err
+			}
+		}
+		if _, err := v.w.WriteAt(v.footer.Bytes(), v.offset); err != nil {
+			return fmt.Errorf("failed to write VHD footer: %w", err)
+		}
+		return nil
+	}
+
+	if v.fill > 0 {
+		for i := v.fill; i < v.blockSize; i++ {
+			v.block[i] = 0
+		}
+		if err := v.flushBlock(); err != nil {
+			return err
+		}
+	}
+
+	bat := make([]byte, len(v.bat)*4)
+	for i, e := range v.bat {
+		binary.BigEndian.PutUint32(bat[i*4:], e)
+	}
+	if _, err := v.w.WriteAt(bat, FooterSize+DynamicHeaderSize); err != nil {
+		return fmt.Errorf("failed to write VHD BAT: %w", err)
+	}
+
+	footer := v.footer.Bytes()
+	if _, err := v.w.WriteAt(footer, v.written); err != nil {
+		return fmt.Errorf("failed to write VHD footer: %w", err)
+	}
+	if _, err := v.w.WriteAt(footer, 0); err != nil {
+		return fmt.Errorf("failed to write VHD footer copy: %w", err)
+	}
+	return nil
+}
+
+// NewFooter returns a footer for a new image of the given size.
+func NewFooter(size uint64, diskType DiskType) *Footer {
+	f := &Footer{
+		Features:           FeaturesReserved,
+		FileFormatVersion:  FileFormatVersion,
+		DataOffset:         FixedDataOffset,
+		TimeStamp:          uint32(time.Since(timestampEpoch) / time.Second),
+		CreatorApplication: creatorApplication,
+		CreatorVersion:     0x00010000,
+		CreatorHostOS:      creatorHostOS,
+		OriginalSize:       size,
+		CurrentSize:        size,
+		DiskGeometry:       CHSGeometry(size),
+		DiskType:           diskType,
+	}
+	copy(f.Cookie[:], FooterCookie)
+	rand.Read(f.UniqueID[:])
+	return f
+}
+
+// Bytes encodes the footer with its checksum.
+func (f *Footer) Bytes() []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, f)
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b[footerChecksumOffset:], Checksum(b, footerChecksumOffset))
+	return b
+}
+
+// Bytes encodes the dynamic disk header with its checksum.
+func (h *DynamicHeader) Bytes() []byte {
+	copy(h.Cookie[:], DynamicHeaderCookie)
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, h)
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b[dynamicHeaderChecksumOffset:], Checksum(b, dynamicHeaderChecksumOffset))
+	return b
+}
+
+// CHSGeometry computes the disk geometry as described in the VHD
+// specification. Disks larger than the geometry can describe get the maximum.
+func CHSGeometry(size uint64) Geometry {
+	totalSectors := size / SectorSize
+	if totalSectors > maxCHSSectors {
+		totalSectors = maxCHSSectors
+	}
+
+	var sectorsPerTrack, heads, cylinderTimesHeads uint64
+	if totalSectors >= 65535*16*63 {
+		sectorsPerTrack = 255
+		heads = 16
+		cylinderTimesHeads = totalSectors / sectorsPerTrack
+	} else {
+		sectorsPerTrack = 17
+		cylinderTimesHeads = totalSectors / sectorsPerTrack
+		heads = (cylinderTimesHeads + 1023) / 1024
+		if heads < 4 {
+			heads = 4
+		}
+		if cylinderTimesHeads >= heads*1024 || heads > 16 {
+			sectorsPerTrack = 31
+			heads = 16
+			cylinderTimesHeads = totalSectors / sectorsPerTrack
+		}
+		if cylinderTimesHeads >= heads*1024 {
+			sectorsPerTrack = 63
+			heads = 16
+			cylinderTimesHeads = totalSectors / sectorsPerTrack
+		}
+	}
+	return Geometry{
+		Cylinders:       uint16(cylinderTimesHeads / heads),
+		Heads:           uint8(heads),
+		SectorsPerTrack: uint8(sectorsPerTrack),
+	}
+}
+
+func isZero(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
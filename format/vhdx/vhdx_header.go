@@ -0,0 +1,362 @@
+package format
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"strings"
+)
+
+const (
+	// FileSignature starts the file type identifier at offset 0.
+	FileSignature = "vhdxfile"
+
+	HeaderSignature      = "head"
+	RegionTableSignature = "regi"
+	MetadataSignature    = "metadata"
+
+	// The header section holds the file type identifier, both headers and
+	// both region tables, 64 KiB each.
+	Header1Offset      = 64 << 10
+	Header2Offset      = 128 << 10
+	RegionTable1Offset = 192 << 10
+	RegionTable2Offset = 256 << 10
+	HeaderSectionSize  = 1 << 20
+
+	HeaderSize      = 4 << 10
+	RegionTableSize = 64 << 10
+
+	// Version is the only version of the format.
+	Version = 1
+
+	// BAT entries store file offsets in MiB.
+	batOffsetShift = 20
+	batStateMask   = 0x7
+
+	maxRegionEntries   = 2047
+	maxMetadataEntries = 2047
+
+	// MaxVirtualDiskSize is the largest disk the specification allows.
+	MaxVirtualDiskSize = 64 << 40
+	// MaxMetadataRegionSize is the largest metadata region read, the size
+	// of the region in images written by Hyper-V and qemu.
+	MaxMetadataRegionSize = 1 << 20
+	// RegionAlignment is the alignment of regions in the file.
+	RegionAlignment = 1 << 20
+)
+
+// GUID is a GUID in its on-disk form, with the first three fields
+// little-endian.
+type GUID [16]byte
+
+// ParseGUID parses the textual form of a GUID, e.g.
+// 2DC27766-F623-4200-9D64-115E9BFD4A08.
+func ParseGUID(s string) (GUID, error) {
+	var g GUID
+	b, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	if err != nil || len(b) != 16 {
+		return g, fmt.Errorf("invalid GUID %q", s)
+	}
+	binary.LittleEndian.PutUint32(g[0:4], binary.BigEndian.Uint32(b[0:4]))
+	binary.LittleEndian.PutUint16(g[4:6], binary.BigEndian.Uint16(b[4:6]))
+	binary.LittleEndian.PutUint16(g[6:8], binary.BigEndian.Uint16(b[6:8]))
+	copy(g[8:], b[8:])
+	return g, nil
+}
+
+func mustParseGUID(s string) GUID {
+	g, err := ParseGUID(s)
+	if err != nil {
+		panic(err)
+	}
+	return g
+}
+
+func (g GUID) String() string {
+	return fmt.Sprintf("%08X-%04X-%04X-%X-%X",
+		binary.LittleEndian.Uint32(g[0:4]), binary.LittleEndian.Uint16(g[4:6]),
+		binary.LittleEndian.Uint16(g[6:8]), g[8:10], g[10:])
+}
+
+// IsZero reports whether g is the all-zero GUID.
+func (g GUID) IsZero() bool {
+	return g == GUID{}
+}
+
+// Region and metadata item GUIDs.
+var (
+	BATRegion      = mustParseGUID("2DC27766-F623-4200-9D64-115E9BFD4A08")
+	MetadataRegion = mustParseGUID("8B7CA206-4790-4B9A-B8FE-575F050F886E")
+
+	FileParametersItem     = mustParseGUID("CAA16737-FA36-4D43-B3B6-33F0AA44E76B")
+	VirtualDiskSizeItem    = mustParseGUID("2FA54224-CD1B-4876-B211-5DBED83BF4B8")
+	VirtualDiskIDItem      = mustParseGUID("BECA12AB-B2E6-4523-93EF-C309E000C746")
+	LogicalSectorSizeItem  = mustParseGUID("8141BF1D-A96F-4709-BA47-F233A8FAAB5F")
+	PhysicalSectorSizeItem = mustParseGUID("CDA348C7-445D-4471-9CC9-E9885251C556")
+	ParentLocatorItem      = mustParseGUID("A8D35F2D-B30B-454D-ABF7-D3D84834AB0C")
+)
+
+// Header is one of the two headers, stored little-endian. The current one is
+// the valid header with the higher sequence number.
+type Header struct {
+	Signature      [4]byte
+	Checksum       uint32
+	SequenceNumber uint64
+	FileWriteGUID  GUID
+	DataWriteGUID  GUID
+	// LogGUID is non-zero while the log holds entries to be replayed.
+	LogGUID    GUID
+	LogVersion uint16
+	Version    uint16
+	LogLength  uint32
+	LogOffset  uint64
+}
+
+// RegionTableHeader starts a region table, stored little-endian.
+type RegionTableHeader struct {
+	Signature  [4]byte
+	Checksum   uint32
+	EntryCount uint32
+	Reserved   uint32
+}
+
+// RegionTableEntry locates a region of the file.
+type RegionTableEntry struct {
+	GUID       GUID
+	FileOffset uint64
+	Length     uint32
+	// Required is set for regions a reader must understand.
+	Required uint32
+}
+
+// MetadataTableHeader starts the metadata region, stored little-endian.
+type MetadataTableHeader struct {
+	Signature  [8]byte
+	Reserved   uint16
+	EntryCount uint16
+	Reserved2  [5]uint32
+}
+
+// MetadataTableEntry locates a metadata item within the metadata region.
+type MetadataTableEntry struct {
+	ItemID   GUID
+	Offset   uint32
+	Length   uint32
+	Flags    uint32
+	Reserved uint32
+}
+
+// Metadata item flags.
+const (
+	MetadataIsUser        = 1 << 0
+	MetadataIsVirtualDisk = 1 << 1
+	MetadataIsRequired    = 1 << 2
+)
+
+// FileParameters is the file parameters metadata item.
+type FileParameters struct {
+	BlockSize uint32
+	Flags     uint32
+}
+
+const (
+	FileParametersLeaveBlocksAllocated = 1 << 0
+	FileParametersHasParent            = 1 << 1
+)
+
+// Payload block states of BAT entries.
+const (
+	PayloadBlockNotPresent       = 0
+	PayloadBlockUndefined        = 1
+	PayloadBlockZero             = 2
+	PayloadBlockUnmapped         = 3
+	PayloadBlockFullyPresent     = 6
+	PayloadBlockPartiallyPresent = 7
+)
+
+// Sector bitmap block states of BAT entries.
+const (
+	SectorBitmapBlockNotPresent = 0
+	SectorBitmapBlockPresent    = 6
+)
+
+// BATEntry is an entry of the block allocation table.
+type BATEntry uint64
+
+func (e BATEntry) State() int {
+	return int(e & batStateMask)
+}
+
+// FileOffset is the offset of the block in the file.
+func (e BATEntry) FileOffset() int64 {
+	return int64(e>>batOffsetShift) << 20
+}
+
+// Metadata holds the metadata items needed to read the image.
+type Metadata struct {
+	BlockSize          uint32
+	HasParent          bool
+	VirtualDiskSize    uint64
+	LogicalSectorSize  uint32
+	PhysicalSectorSize uint32
+}
+
+// ChunkRatio is the number of payload blocks described by one sector bitmap
+// block. Its entry follows theirs in the BAT.
+func (m *Metadata) ChunkRatio() int64 {
+	return (int64(1) << 23) * int64(m.LogicalSectorSize) / int64(m.BlockSize)
+}
+
+// PayloadBlocks is the number of blocks of the virtual disk.
+func (m *Metadata) PayloadBlocks() int64 {
+	return (int64(m.VirtualDiskSize) + int64(m.BlockSize) - 1) / int64(m.BlockSize)
+}
+
+// BATEntries is the number of BAT entries, including the interleaved sector
+// bitmap entries.
+func (m *Metadata) BATEntries() int64 {
+	blocks := m.PayloadBlocks()
+	if m.HasParent {
+		chunks := (blocks + m.ChunkRatio() - 1) / m.ChunkRatio()
+		return chunks * (m.ChunkRatio() + 1)
+	}
+	return blocks + (blocks-1)/m.ChunkRatio()
+}
+
+// PayloadEntry is the index of the BAT entry of payload block i.
+func (m *Metadata) PayloadEntry(i int64) int64 {
+	return i + i/m.ChunkRatio()
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Checksum is the CRC-32C of a header or table, with its checksum field
+// (always at offset 4) taken as zero.
+func Checksum(b []byte) uint32 {
+	crc := crc32.Update(0, castagnoli, b[:4])
+	crc = crc32.Update(crc, castagnoli, []byte{0, 0, 0, 0})
+	return crc32.Update(crc, castagnoli, b[8:])
+}
+
+// ParseHeader decodes a header and validates its signature and checksum.
+func ParseHeader(b []byte) (*Header, error) {
+	if len(b) < HeaderSize {
+		return nil, fmt.Errorf("short VHDX header")
+	}
+	var h Header
+	if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, &h); err != nil {
+		return nil, fmt.Errorf("failed to read VHDX header: %w", err)
+	}
+	if string(h.Signature[:]) != HeaderSignature {
+		return nil, fmt.Errorf("invalid VHDX header signature")
+	}
+	if Checksum(b[:HeaderSize]) != h.Checksum {
+		return nil, fmt.Errorf("VHDX header checksum mismatch")
+	}
+	return &h, nil
+}
+
+// ParseRegionTable decodes a region table and validates its signature and
+// checksum.
+func ParseRegionTable(b []byte) ([]RegionTableEntry, error) {
+	if len(b) < RegionTableSize {
+		return nil, fmt.Errorf("short VHDX region table")
+	}
+	var h RegionTableHeader
+	r := bytes.NewReader(b[:RegionTableSize])
+	if err := binary.Read(r, binary.LittleEndian, &h); err != nil {
+		return nil, fmt.Errorf("failed to read VHDX region table: %w", err)
+	}
+	if string(h.Signature[:]) != RegionTableSignature {
+		return nil, fmt.Errorf("invalid VHDX region table signature")
+	}
+	if Checksum(b[:RegionTableSize]) != h.Checksum {
+		return nil, fmt.Errorf("VHDX region table checksum mismatch")
+	}
+	if h.EntryCount > maxRegionEntries {
+		return nil, fmt.Errorf("invalid VHDX region table entry count %d", h.EntryCount)
+	}
+	entries := make([]RegionTableEntry, h.EntryCount)
+	if err := binary.Read(r, binary.LittleEndian, entries); err != nil {
+		return nil, fmt.Errorf("failed to read VHDX region table: %w", err)
+	}
+	return entries, nil
+}
+
+// ParseMetadata decodes the metadata region and the items needed to read the
+// image. Unknown items marked required are rejected.
+func ParseMetadata(region []byte) (*Metadata, error) {
+	var h MetadataTableHeader
+	r := bytes.NewReader(region)
+	if err := binary.Read(r, binary.LittleEndian, &h); err != nil {
+		return nil, fmt.Errorf("failed to read VHDX metadata table: %w", err)
+	}
+	if string(h.Signature[:]) != MetadataSignature {
+		return nil, fmt.Errorf("invalid VHDX metadata table signature")
+	}
+	if h.EntryCount > maxMetadataEntries {
+		return nil, fmt.Errorf("invalid VHDX metadata entry count %d", h.EntryCount)
+	}
+	entries := make([]MetadataTableEntry, h.EntryCount)
+	if err := binary.Read(r, binary.LittleEndian, entries); err != nil {
+		return nil, fmt.Errorf("failed to read VHDX metadata table: %w", err)
+	}
+
+	var m Metadata
+	for _, e := range entries {
+		if uint64(e.Offset)+uint64(e.Length) > uint64(len(region)) {
+			return nil, fmt.Errorf("VHDX metadata item %s is out of bounds", e.ItemID)
+		}
+		data := region[e.Offset : e.Offset+e.Length]
+		if e.Flags&MetadataIsUser != 0 {
+			continue
+		}
+
+		short := fmt.Errorf("short VHDX metadata item %s", e.ItemID)
+		switch e.ItemID {
+		case FileParametersItem:
+			if len(data) < 8 {
+				return nil, short
+			}
+			m.BlockSize = binary.LittleEndian.Uint32(data[0:4])
+			if binary.LittleEndian.Uint32(data[4:8])&FileParametersHasParent != 0 {
+				m.HasParent = true
+			}
+		case VirtualDiskSizeItem:
+			if len(data) < 8 {
+				return nil, short
+			}
+			m.VirtualDiskSize = binary.LittleEndian.Uint64(data)
+		case LogicalSectorSizeItem:
+			if len(data) < 4 {
+				return nil, short
+			}
+			m.LogicalSectorSize = binary.LittleEndian.Uint32(data)
+		case PhysicalSectorSizeItem:
+			if len(data) < 4 {
+				return nil, short
+			}
+			m.PhysicalSectorSize = binary.LittleEndian.Uint32(data)
+		case ParentLocatorItem:
+			m.HasParent = true
+		case VirtualDiskIDItem:
+		default:
+			if e.Flags&MetadataIsRequired != 0 {
+				return nil, fmt.Errorf("unsupported required VHDX metadata item %s", e.ItemID)
+			}
+		}
+	}
+
+	if m.BlockSize < 1<<20 || m.BlockSize > 256<<20 || m.BlockSize&(m.BlockSize-1) != 0 {
+		return nil, fmt.Errorf("invalid VHDX block size %d", m.BlockSize)
+	}
+	if m.LogicalSectorSize != 512 && m.LogicalSectorSize != 4096 {
+		return nil, fmt.Errorf("invalid VHDX logical sector size %d", m.LogicalSectorSize)
+	}
+	if m.VirtualDiskSize == 0 || m.VirtualDiskSize > MaxVirtualDiskSize || m.VirtualDiskSize%uint64(m.LogicalSectorSize) != 0 {
+		return nil, fmt.Errorf("invalid VHDX virtual disk size %d", m.VirtualDiskSize)
+	}
+	return &m, nil
+}
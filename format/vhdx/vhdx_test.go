@@ -0,0 +1,98 @@
+package format
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestGUIDEncoding(t *testing.T) {
+	want := []byte{0x66, 0x77, 0xc2, 0x2d, 0x23, 0xf6, 0x00, 0x42, 0x9d, 0x64, 0x11, 0x5e, 0x9b, 0xfd, 0x4a, 0x08}
+	if !bytes.Equal(BATRegion[:], want) {
+		t.Fatalf("BAT region GUID encodes as % x", BATRegion[:])
+	}
+	if s := BATRegion.String(); s != "2DC27766-F623-4200-9D64-115E9BFD4A08" {
+		t.Fatalf("String() = %s", s)
+	}
+}
+
+func TestMetadataBATLayout(t *testing.T) {
+	m := &Metadata{BlockSize: 32 << 20, LogicalSectorSize: 512, VirtualDiskSize: 10 << 30}
+	if r := m.ChunkRatio(); r != 128 {
+		t.Fatalf("ChunkRatio() = %d, want 128", r)
+	}
+	// 320 payload blocks with a sector bitmap entry after every 128 of them.
+	if n := m.BATEntries(); n != 322 {
+		t.Fatalf("BATEntries() = %d, want 322", n)
+	}
+	if i := m.PayloadEntry(128); i != 129 {
+		t.Fatalf("PayloadEntry(128) = %d, want 129", i)
+	}
+}
+
+type memImage struct {
+	buf []byte
+}
+
+func (m *memImage) WriteAt(p []byte, off int64) (int, error) {
+	if end := int(off) + len(p); end > len(m.buf) {
+		m.buf = append(m.buf, make([]byte, end-len(m.buf))...)
+	}
+	return copy(m.buf[off:], p), nil
+}
+
+func TestVHDXWriterStructures(t *testing.T) {
+	img := &memImage{}
+	w, err := NewVHDXWriter(img, 3<<20, WriterOptions{BlockSize: 1 << 20})
+	if err != nil {
+		t.Fatalf("NewVHDXWriter failed: %v", err)
+	}
+	data := make([]byte, 3<<20)
+	copy(data[2<<20:], "payload")
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	for _, off := range []int{Header1Offset, Header2Offset} {
+		if _, err := ParseHeader(img.buf[off:]); err != nil {
+			t.Fatalf("header at %d: %v", off, err)
+		}
+	}
+	regions, err := ParseRegionTable(img.buf[RegionTable1Offset:])
+	if err != nil {
+		t.Fatalf("ParseRegionTable failed: %v", err)
+	}
+	var metadataOffset, batOffset uint64
+	for _, r := range regions {
+		switch r.GUID {
+		case MetadataRegion:
+			metadataOffset = r.FileOffset
+		case BATRegion:
+			batOffset = r.FileOffset
+		}
+	}
+	m, err := ParseMetadata(img.buf[metadataOffset:])
+	if err != nil {
+		t.Fatalf("ParseMetadata failed: %v", err)
+	}
+	if m.BlockSize != 1<<20 || m.VirtualDiskSize != 3<<20 || m.LogicalSectorSize != 512 {
+		t.Fatalf("unexpected metadata %+v", m)
+	}
+
+	// Only the third block is present, right after the BAT.
+	for i := int64(0); i < 3; i++ {
+		e := BATEntry(binary.LittleEndian.Uint64(img.buf[batOffset+uint64(m.PayloadEntry(i))*8:]))
+		if i < 2 {
+			if e.State() != PayloadBlockNotPresent {
+				t.Fatalf("block %d state %d", i, e.State())
+			}
+			continue
+		}
+		if e.State() != PayloadBlockFullyPresent || !bytes.Equal(img.buf[e.FileOffset():e.FileOffset()+7], []byte("payload")) {
+			t.Fatalf("block %d state %d at %d", i, e.State(), e.FileOffset())
+		}
+	}
+}
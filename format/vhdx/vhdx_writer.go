@@ -0,0 +1,251 @@
+package format
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"unicode/utf16"
+)
+
+const (
+	// DefaultBlockSize is the block size used by Hyper-V (32 MiB).
+	DefaultBlockSize = 32 << 20
+
+	// Region layout of written images: the log right after the header
+	// section, then the metadata region, the BAT and the blocks, all aligned
+	// to 1 MiB as the specification requires.
+	writerAlignment      = 1 << 20
+	writerLogOffset      = HeaderSectionSize
+	writerLogLength      = 1 << 20
+	writerMetadataOffset = writerLogOffset + writerLogLength
+	writerMetadataLength = 1 << 20
+	writerBATOffset      = writerMetadataOffset + writerMetadataLength
+
+	writerLogicalSectorSize  = 512
+	writerPhysicalSectorSize = 4096
+
+	creator = "disk-stream-convert"
+)
+
+// WriterOptions controls the layout of images produced by VHDXWriter.
+type WriterOptions struct {
+	// BlockSize is the payload block size, DefaultBlockSize if zero.
+	BlockSize uint32
+}
+
+// VHDXWriter builds a dynamic VHDX image from sequentially written guest
+// data. Blocks that are all zeros are left not present. The headers, region
+// tables and metadata are written up front and the BAT by Close, so the
+// destination must accept random writes.
+type VHDXWriter struct {
+	w         io.WriterAt
+	metadata  Metadata
+	blockSize int64
+	bat       []BATEntry
+
+	block  []byte
+	fill   int64
+	offset int64
+	// written is the end of the image file.
+	written int64
+}
+
+func NewVHDXWriter(w io.WriterAt, size uint64, opts WriterOptions) (*VHDXWriter, error) {
+	blockSize := opts.BlockSize
+	if blockSize == 0 {
+		blockSize = DefaultBlockSize
+	}
+	if blockSize < 1<<20 || blockSize > 256<<20 || blockSize&(blockSize-1) != 0 {
+		return nil, fmt.Errorf("invalid VHDX block size %d", blockSize)
+	}
+	v := &VHDXWriter{
+		w: w,
+		metadata: Metadata{
+			BlockSize:          blockSize,
+			VirtualDiskSize:    (size + writerLogicalSectorSize - 1) / writerLogicalSectorSize * writerLogicalSectorSize,
+			LogicalSectorSize:  writerLogicalSectorSize,
+			PhysicalSectorSize: writerPhysicalSectorSize,
+		},
+		blockSize: int64(blockSize),
+	}
+	if v.metadata.VirtualDiskSize == 0 {
+		// A virtual disk cannot be empty.
+		v.metadata.VirtualDiskSize = writerLogicalSectorSize
+	}
+
+	v.bat = make([]BATEntry, v.metadata.BATEntries())
+	batLength := alignUp(int64(len(v.bat))*8, writerAlignment)
+	v.written = writerBATOffset + batLength
+	v.block = make([]byte, v.blockSize)
+
+	if err := v.writeHeaderSection(batLength); err != nil {
+		return nil, err
+	}
+	if err := v.writeMetadata(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (v *VHDXWriter) Write(p []byte) (int, error) {
+	if v.offset+v.fill+int64(len(p)) > int64(v.metadata.VirtualDiskSize) {
+		return 0, fmt.Errorf("write beyond the VHDX capacity of %d bytes", v.metadata.VirtualDiskSize)
+	}
+	n := 0
+	for n < len(p) {
+		c := copy(v.block[v.fill:], p[n:])
+		v.fill += int64(c)
+		n += c
+		if v.fill == v.blockSize {
+			if err := v.flushBlock(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// flushBlock appends the pending block unless it is all zeros.
+func (v *VHDXWriter) flushBlock() error {
+	index := v.offset / v.blockSize
+	v.offset += v.blockSize
+	v.fill = 0
+
+	if isZero(v.block) {
+		return nil
+	}
+	if _, err := v.w.WriteAt(v.block, v.written); err != nil {
+		return fmt.Errorf("failed to write VHDX block: %w", err)
+	}
+	v.bat[v.metadata.PayloadEntry(index)] = BATEntry(v.written) | PayloadBlockFullyPresent
+	v.written += v.blockSize
+	return nil
+}
+
+func (v *VHDXWriter) Close() error {
+	if v.fill > 0 {
+		for i := v.fill; i < v.blockSize; i++ {
+			v.block[i] = 0
+		}
+		if err := v.flushBlock(); err != nil {
+			return err
+		}
+	}
+
+	bat := make([]byte, len(v.bat)*8)
+	for i, e := range v.bat {
+		binary.LittleEndian.PutUint64(bat[i*8:], uint64(e))
+	}
+	if _, err := v.w.WriteAt(bat, writerBATOffset); err != nil {
+		return fmt.Errorf("failed to write VHDX BAT: %w", err)
+	}
+	return nil
+}
+
+// writeHeaderSection writes the file type identifier, both headers, both
+// region tables and the empty log.
+func (v *VHDXWriter) writeHeaderSection(batLength int64) error {
+	section := make([]byte, HeaderSectionSize)
+	copy(section, FileSignature)
+	for i, c := range utf16.Encode([]rune(creator)) {
+		binary.LittleEndian.PutUint16(section[8+i*2:], c)
+	}
+
+	var fileWriteGUID, dataWriteGUID GUID
+	rand.Read(fileWriteGUID[:])
+	rand.Read(dataWriteGUID[:])
+	for i, off := range []int{Header1Offset, Header2Offset} {
+		h := Header{
+			SequenceNumber: uint64(i),
+			FileWriteGUID:  fileWriteGUID,
+			DataWriteGUID:  dataWriteGUID,
+			Version:        Version,
+			LogLength:      writerLogLength,
+			LogOffset:      writerLogOffset,
+		}
+		copy(h.Signature[:], HeaderSignature)
+		putChecksummed(section[off:off+HeaderSize], &h)
+	}
+
+	regions := []RegionTableEntry{
+		{GUID: MetadataRegion, FileOffset: writerMetadataOffset, Length: writerMetadataLength, Required: 1},
+		{GUID: BATRegion, FileOffset: writerBATOffset, Length: uint32(batLength), Required: 1},
+	}
+	for _, off := range []int{RegionTable1Offset, RegionTable2Offset} {
+		h := RegionTableHeader{EntryCount: uint32(len(regions))}
+		copy(h.Signature[:], RegionTableSignature)
+		putChecksummed(section[off:off+RegionTableSize], &h, regions)
+	}
+
+	if _, err := v.w.WriteAt(section, 0); err != nil {
+		return fmt.Errorf("failed to write VHDX header section: %w", err)
+	}
+	if _, err := v.w.WriteAt(make([]byte, writerLogLength), writerLogOffset); err != nil {
+		return fmt.Errorf("failed to write VHDX log: %w", err)
+	}
+	return nil
+}
+
+func (v *VHDXWriter) writeMetadata() error {
+	var diskID GUID
+	rand.Read(diskID[:])
+
+	le := binary.LittleEndian
+	items := []struct {
+		id    GUID
+		flags uint32
+		value []byte
+	}{
+		{FileParametersItem, MetadataIsRequired, le.AppendUint32(le.AppendUint32(nil, v.metadata.BlockSize), 0)},
+		{VirtualDiskSizeItem, MetadataIsVirtualDisk | MetadataIsRequired, le.AppendUint64(nil, v.metadata.VirtualDiskSize)},
+		{VirtualDiskIDItem, MetadataIsVirtualDisk | MetadataIsRequired, diskID[:]},
+		{LogicalSectorSizeItem, MetadataIsVirtualDisk | MetadataIsRequired, le.AppendUint32(nil, v.metadata.LogicalSectorSize)},
+		{PhysicalSectorSizeItem, MetadataIsVirtualDisk | MetadataIsRequired, le.AppendUint32(nil, v.metadata.PhysicalSectorSize)},
+	}
+
+	// Item data starts after the 64 KiB table, as Hyper-V lays it out.
+	region := make([]byte, writerMetadataLength)
+	h := MetadataTableHeader{EntryCount: uint16(len(items))}
+	copy(h.Signature[:], MetadataSignature)
+	entries := make([]MetadataTableEntry, len(items))
+	dataOffset := 64 << 10
+	for i, item := range items {
+		entries[i] = MetadataTableEntry{ItemID: item.id, Offset: uint32(dataOffset), Length: uint32(len(item.value)), Flags: item.flags}
+		copy(region[dataOffset:], item.value)
+		dataOffset += len(item.value)
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, &h)
+	binary.Write(&buf, binary.LittleEndian, entries)
+	copy(region, buf.Bytes())
+
+	if _, err := v.w.WriteAt(region, writerMetadataOffset); err != nil {
+		return fmt.Errorf("failed to write VHDX metadata: %w", err)
+	}
+	return nil
+}
+
+// putChecksummed encodes values into b and stores the checksum of all of b.
+func putChecksummed(b []byte, values ...interface{}) {
+	var buf bytes.Buffer
+	for _, value := range values {
+		binary.Write(&buf, binary.LittleEndian, value)
+	}
+	copy(b, buf.Bytes())
+	binary.LittleEndian.PutUint32(b[4:], Checksum(b))
+}
+
+func alignUp(n, a int64) int64 {
+	return (n + a - 1) / a * a
+}
+
+func isZero(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
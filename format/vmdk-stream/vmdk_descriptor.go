@@ -0,0 +1,137 @@
+package format
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Extent access modes.
+const (
+	EXTENT_ACCESS_RW       = "RW"
+	EXTENT_ACCESS_RDONLY   = "RDONLY"
+	EXTENT_ACCESS_NOACCESS = "NOACCESS"
+)
+
+// Extent types. VMFS is the flat extent of ESXi images.
+const (
+	EXTENT_TYPE_FLAT       = "FLAT"
+	EXTENT_TYPE_SPARSE     = "SPARSE"
+	EXTENT_TYPE_ZERO       = "ZERO"
+	EXTENT_TYPE_VMFS       = "VMFS"
+	EXTENT_TYPE_VMFSSPARSE = "VMFSSPARSE"
+	EXTENT_TYPE_VMFSRDM    = "VMFSRDM"
+	EXTENT_TYPE_VMFSRAW    = "VMFSRAW"
+	EXTENT_TYPE_SESPARSE   = "SESPARSE"
+)
+
+// DESCRIPTOR_NO_PARENT is the parentCID of images without a parent.
+const DESCRIPTOR_NO_PARENT = "ffffffff"
+
+// Extent is one extent line of a disk descriptor file.
+type Extent struct {
+	Access   string
+	Sectors  SectorType
+	Type     string
+	FileName string
+	// Offset is the sector in FileName where a FLAT extent starts.
+	Offset SectorType
+}
+
+// Descriptor holds the parts of a disk descriptor file needed to read the
+// disk it describes.
+type Descriptor struct {
+	CreateType string
+	ParentCID  string
+	Extents    []Extent
+}
+
+// Capacity returns the sum of the extent sizes in sectors.
+func (d *Descriptor) Capacity() SectorType {
+	var sectors SectorType
+	for _, e := range d.Extents {
+		sectors += e.Sectors
+	}
+	return sectors
+}
+
+// ParseDescriptor parses a disk descriptor file. Unknown settings and the
+// disk database are ignored.
+func ParseDescriptor(text string) (*Descriptor, error) {
+	d := &Descriptor{ParentCID: DESCRIPTOR_NO_PARENT}
+	sc := bufio.NewScanner(strings.NewReader(text))
+	for line := 1; sc.Scan(); line++ {
+		s := strings.TrimSpace(sc.Text())
+		if s == "" || strings.HasPrefix(s, "#") {
+			continue
+		}
+
+		fields := strings.Fields(s)
+		switch fields[0] {
+		case EXTENT_ACCESS_RW, EXTENT_ACCESS_RDONLY, EXTENT_ACCESS_NOACCESS:
+			e, err := parseExtent(s)
+			if err != nil {
+				return nil, fmt.Errorf("vmdk descriptor line %d: %w", line, err)
+			}
+			d.Extents = append(d.Extents, *e)
+			continue
+		}
+
+		key, value, ok := strings.Cut(s, "=")
+		if !ok {
+			return nil, fmt.Errorf("vmdk descriptor line %d: unexpected %q", line, s)
+		}
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+		switch strings.TrimSpace(key) {
+		case "createType":
+			d.CreateType = value
+		case "parentCID":
+			d.ParentCID = strings.ToLower(value)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(d.Extents) == 0 {
+		return nil, fmt.Errorf("vmdk descriptor has no extents")
+	}
+	return d, nil
+}
+
+// parseExtent parses an extent line: access, size in sectors, type, and for
+// all types but ZERO the quoted file name, followed by the start sector for
+// FLAT and VMFS extents.
+func parseExtent(s string) (*Extent, error) {
+	var e Extent
+	fields := strings.Fields(s)
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("incomplete extent %q", s)
+	}
+	e.Access = fields[0]
+	sectors, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid extent size %q", fields[1])
+	}
+	e.Sectors = SectorType(sectors)
+	e.Type = fields[2]
+	if e.Type == EXTENT_TYPE_ZERO {
+		return &e, nil
+	}
+
+	// The file name is quoted and may contain spaces.
+	first := strings.IndexByte(s, '"')
+	last := strings.LastIndexByte(s, '"')
+	if first < 0 || last == first {
+		return nil, fmt.Errorf("extent %q lacks a quoted file name", s)
+	}
+	e.FileName = s[first+1 : last]
+	if rest := strings.Fields(s[last+1:]); len(rest) > 0 {
+		offset, err := strconv.ParseUint(rest[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid extent offset %q", rest[0])
+		}
+		e.Offset = SectorType(offset)
+	}
+	return &e, nil
+}
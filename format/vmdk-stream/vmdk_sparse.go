@@ -0,0 +1,40 @@
+package format
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// ParseSparseExtentHeader decodes the header in the first sector of a hosted
+// sparse extent.
+func ParseSparseExtentHeader(b []byte) (*SparseExtentHeader, error) {
+	var hdr SparseExtentHeader
+	if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, &hdr); err != nil {
+		return nil, err
+	}
+	if hdr.MagicNumber != VMDKMagic {
+		return nil, fmt.Errorf("invalid vmdk header")
+	}
+	if hdr.Version == 0 || hdr.Version > SPARSE_VERSION_INCOMPAT_FLAGS {
+		return nil, fmt.Errorf("unsupported vmdk sparse extent version %d", hdr.Version)
+	}
+	if hdr.GrainSize < 8 || hdr.GrainSize&(hdr.GrainSize-1) != 0 {
+		return nil, fmt.Errorf("invalid vmdk grain size of %d sectors", hdr.GrainSize)
+	}
+	if hdr.NumGTEsPerGT == 0 {
+		return nil, fmt.Errorf("invalid vmdk grain table size of 0 entries")
+	}
+	return &hdr, nil
+}
+
+// GrainCount returns the number of grains covering the capacity.
+func (hdr *SparseExtentHeader) GrainCount() uint64 {
+	return uint64((hdr.Capacity + hdr.GrainSize - 1) / hdr.GrainSize)
+}
+
+// GrainDirectoryEntries returns the number of grain tables covering the
+// capacity, which is also the number of grain directory entries.
+func (hdr *SparseExtentHeader) GrainDirectoryEntries() uint64 {
+	return (hdr.GrainCount() + uint64(hdr.NumGTEsPerGT) - 1) / uint64(hdr.NumGTEsPerGT)
+}
@@ -0,0 +1,184 @@
+package format
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	// Layout of written hosted sparse extents, as VMware Workstation creates
+	// them: the header, a 20 sector descriptor, then the redundant and the
+	// primary grain directory, each followed by its grain tables.
+	sparseWriterGrainSize      = 128 // 64k
+	sparseWriterNumGTEsPerGT   = 512
+	sparseWriterDescriptorSize = 20
+	sparseWriterRgdOffset      = 1 + sparseWriterDescriptorSize
+)
+
+// SparseWriter builds a hosted sparse extent (monolithicSparse) from
+// sequentially written guest data. The grain directories and grain tables are
+// preallocated near the start of the file and grains are stored uncompressed
+// after them. Grains that are all zeros are not stored. Grain tables are
+// filled in place once their last grain has been written, so the destination
+// must accept random writes.
+type SparseWriter struct {
+	w      io.WriterAt
+	Header SparseExtentHeader
+
+	// rgtOffset and gtOffset are the sectors of the first redundant and
+	// primary grain table.
+	rgtOffset SectorType
+	gtOffset  SectorType
+
+	grain    []byte
+	fill     int
+	grainNum uint64
+	gt       []uint32
+	// next is the sector of the next stored grain.
+	next SectorType
+}
+
+func NewSparseWriter(w io.WriterAt, fileName string, capacity uint64) (*SparseWriter, error) {
+	var hdr SparseExtentHeader
+	hdr.MagicNumber = VMDKMagic
+	hdr.Version = 1
+	hdr.Flags = SPARSEFLAG_VALID_NEWLINE_DETECTOR | SPARSEFLAG_USE_REDUNDANT
+	hdr.Capacity = SectorType(alignToSectorSize(capacity) / SECTOR_SIZE)
+	hdr.GrainSize = sparseWriterGrainSize
+	hdr.DescriptorOffset = 1
+	hdr.DescriptorSize = sparseWriterDescriptorSize
+	hdr.NumGTEsPerGT = sparseWriterNumGTEsPerGT
+	hdr.SingleEndLineChar = SPARSE_SINGLE_END_LINE_CHAR
+	hdr.NonEndLineChar = SPARSE_NON_END_LINE_CHAR
+	hdr.DoubleEndLineChar1 = SPARSE_DOUBLE_END_LINE_CHAR1
+	hdr.DoubleEndLineChar2 = SPARSE_DOUBLE_END_LINE_CHAR2
+	hdr.CompressAlgorithm = COMPRESSION_NONE
+
+	gdSize := hdr.GetGrainDirectorySectorSize()
+	gtSize := SectorType(sparseWriterNumGTEsPerGT * 4 >> SECTOR_SIZE_SHIFT)
+	tables := SectorType(hdr.GrainDirectoryEntries())
+	hdr.RgdOffset = sparseWriterRgdOffset
+	hdr.GdOffset = hdr.RgdOffset + gdSize + tables*gtSize
+	overhead := hdr.GdOffset + gdSize + tables*gtSize
+	hdr.Overhead = (overhead + hdr.GrainSize - 1) / hdr.GrainSize * hdr.GrainSize
+
+	sw := &SparseWriter{
+		w:         w,
+		Header:    hdr,
+		rgtOffset: hdr.RgdOffset + gdSize,
+		gtOffset:  hdr.GdOffset + gdSize,
+		grain:     make([]byte, hdr.GrainSize<<SECTOR_SIZE_SHIFT),
+		gt:        make([]uint32, sparseWriterNumGTEsPerGT),
+		next:      hdr.Overhead,
+	}
+
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, hdr); err != nil {
+		return nil, err
+	}
+	descriptor := makeDiskDescriptorFile(CREATE_TYPE_MONOLITHIC_SPARSE, fileName, uint64(hdr.Capacity), generateCID())
+	if len(descriptor) > sparseWriterDescriptorSize*SECTOR_SIZE {
+		return nil, fmt.Errorf("vmdk descriptor of %d bytes does not fit the header", len(descriptor))
+	}
+	buf.WriteString(descriptor)
+	if _, err := w.WriteAt(buf.Bytes(), 0); err != nil {
+		return nil, fmt.Errorf("failed to write vmdk header: %w", err)
+	}
+
+	// The grain tables are preallocated, so both directories are final.
+	for _, dir := range []struct{ gd, gt SectorType }{{hdr.RgdOffset, sw.rgtOffset}, {hdr.GdOffset, sw.gtOffset}} {
+		gd := make([]byte, gdSize<<SECTOR_SIZE_SHIFT)
+		for i := SectorType(0); i < tables; i++ {
+			binary.LittleEndian.PutUint32(gd[i*4:], uint32(dir.gt+i*gtSize))
+		}
+		if _, err := w.WriteAt(gd, int64(dir.gd<<SECTOR_SIZE_SHIFT)); err != nil {
+			return nil, fmt.Errorf("failed to write vmdk grain directory: %w", err)
+		}
+	}
+	return sw, nil
+}
+
+func (sw *SparseWriter) Write(p []byte) (int, error) {
+	capacity := uint64(sw.Header.Capacity) << SECTOR_SIZE_SHIFT
+	if sw.grainNum*uint64(len(sw.grain))+uint64(sw.fill)+uint64(len(p)) > capacity {
+		return 0, fmt.Errorf("write beyond the vmdk capacity of %d bytes", capacity)
+	}
+	n := 0
+	for n < len(p) {
+		c := copy(sw.grain[sw.fill:], p[n:])
+		sw.fill += c
+		n += c
+		if sw.fill == len(sw.grain) {
+			if err := sw.flushGrain(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// flushGrain stores the pending grain unless it is all zeros, and writes its
+// grain table once it is complete.
+func (sw *SparseWriter) flushGrain() error {
+	slot := sw.grainNum % sparseWriterNumGTEsPerGT
+	if !isAllZeroByte(sw.grain) {
+		if _, err := sw.w.WriteAt(sw.grain, int64(sw.next<<SECTOR_SIZE_SHIFT)); err != nil {
+			return fmt.Errorf("failed to write vmdk grain: %w", err)
+		}
+		sw.gt[slot] = uint32(sw.next)
+		sw.next += sw.Header.GrainSize
+	}
+	sw.grainNum++
+	sw.fill = 0
+	if slot == sparseWriterNumGTEsPerGT-1 {
+		return sw.writeGrainTable(sw.grainNum/sparseWriterNumGTEsPerGT - 1)
+	}
+	return nil
+}
+
+// writeGrainTable writes the current grain table as table index of both
+// directories and starts the next one.
+func (sw *SparseWriter) writeGrainTable(index uint64) error {
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, sw.gt); err != nil {
+		return err
+	}
+	gtSize := int64(sparseWriterNumGTEsPerGT * 4)
+	for _, first := range []SectorType{sw.rgtOffset, sw.gtOffset} {
+		if _, err := sw.w.WriteAt(buf.Bytes(), int64(first<<SECTOR_SIZE_SHIFT)+int64(index)*gtSize); err != nil {
+			return fmt.Errorf("failed to write vmdk grain table: %w", err)
+		}
+	}
+	for i := range sw.gt {
+		sw.gt[i] = 0
+	}
+	return nil
+}
+
+// Close stores the last, partial grain and writes the grain tables that are
+// not complete yet.
+func (sw *SparseWriter) Close() error {
+	if sw.fill > 0 {
+		for i := sw.fill; i < len(sw.grain); i++ {
+			sw.grain[i] = 0
+		}
+		if err := sw.flushGrain(); err != nil {
+			return err
+		}
+	}
+	index := (sw.grainNum + sparseWriterNumGTEsPerGT - 1) / sparseWriterNumGTEsPerGT
+	if sw.grainNum%sparseWriterNumGTEsPerGT != 0 {
+		if err := sw.writeGrainTable(index - 1); err != nil {
+			return err
+		}
+	}
+	// Tables of grains that were never written stay empty.
+	for ; index < sw.Header.GrainDirectoryEntries(); index++ {
+		if err := sw.writeGrainTable(index); err != nil {
+			return err
+		}
+	}
+	return nil
+}
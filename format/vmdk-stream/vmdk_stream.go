@@ -81,7 +81,7 @@ func (vs *VMDKStream) Create(fileName string, capability uint64) error {
 	hdr.GrainSize = 128 // 64k
 	hdr.DescriptorOffset = 1
 
-	descriptor := makeDiskDescriptorFile(fileName, uint64(hdr.Capacity), generateCID())
+	descriptor := makeDiskDescriptorFile(CREATE_TYPE_STREAM_OPTIMIZED, fileName, uint64(hdr.Capacity), generateCID())
 	hdr.DescriptorSize = SectorType(alignToSectorSize(uint64(len(descriptor))) >> SECTOR_SIZE_SHIFT)
 
 	hdr.NumGTEsPerGT = 512
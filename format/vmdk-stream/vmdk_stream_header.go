@@ -15,9 +15,17 @@ const (
 	SECTOR_SIZE       = 1 << SECTOR_SIZE_SHIFT
 )
 
+// Descriptor createType values of the written images.
+const (
+	CREATE_TYPE_STREAM_OPTIMIZED  = "streamOptimized"
+	CREATE_TYPE_MONOLITHIC_SPARSE = "monolithicSparse"
+)
+
 const (
 	SPARSE_VERSION_INCOMPAT_FLAGS     uint32     = 3
 	SPARSEFLAG_VALID_NEWLINE_DETECTOR uint32     = 1 << 0
+	SPARSEFLAG_USE_REDUNDANT          uint32     = 1 << 1
+	SPARSEFLAG_ZEROED_GTE             uint32     = 1 << 2
 	SPARSEFLAG_COMPRESSED             uint32     = 1 << 16
 	SPARSEFLAG_EMBEDDED_LBA           uint32     = 1 << 17
 	SPARSE_GD_AT_END                  SectorType = 0xFFFFFFFFFFFFFFFF
@@ -27,6 +35,13 @@ const (
 	SPARSE_DOUBLE_END_LINE_CHAR2                 = '\n'
 )
 
+// Grain table entries that do not point to a grain. SPARSE_GTE_ZEROED is
+// only used by extents with SPARSEFLAG_ZEROED_GTE.
+const (
+	SPARSE_GTE_EMPTY  uint32 = 0
+	SPARSE_GTE_ZEROED uint32 = 1
+)
+
 // Marker Constants
 const (
 	MARKER_EOS    uint32 = 0
@@ -100,7 +115,7 @@ version=1
 encoding="UTF-8"
 CID=%08x
 parentCID=ffffffff
-createType="streamOptimized"
+createType="%s"
 
 # Extent description
 RW %d SPARSE "%s"
@@ -133,7 +148,7 @@ func generateCID() uint32 {
 	return cid
 }
 
-func makeDiskDescriptorFile(fileName string, capacity uint64, cid uint32) string {
+func makeDiskDescriptorFile(createType string, fileName string, capacity uint64, cid uint32) string {
 	var cylinders uint32
 
 	if capacity > 65535*255*63 {
@@ -145,6 +160,7 @@ func makeDiskDescriptorFile(fileName string, capacity uint64, cid uint32) string
 	ret := fmt.Sprintf(
 		diskDescriptorFileTemplate,
 		cid,
+		createType,
 		capacity,
 		fileName,
 		rand.Uint32(),
@@ -2,4 +2,9 @@ module disk-stream-convert
 
 go 1.21
 
-require github.com/goburrow/cache v0.1.4 // indirect
+require (
+	github.com/goburrow/cache v0.1.4
+	github.com/klauspost/compress v1.17.11
+	github.com/ulikunitz/xz v0.5.12
+	golang.org/x/crypto v0.31.0
+)
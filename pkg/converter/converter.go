@@ -34,10 +34,7 @@ func (sc *StreamConverter) Run(ctx context.Context) (written uint64, capacity ui
 
 	for {
 		n, off, err := sc.Reader.Read(buf)
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
+		if err != nil && err != io.EOF {
 			if n > 0 {
 				if _, wErr := sc.Writer.Write(buf[:n]); wErr != nil {
 					return written, capacity, wErr
@@ -69,6 +66,11 @@ func (sc *StreamConverter) Run(ctx context.Context) (written uint64, capacity ui
 			written += uint64(n)
 			writeCursor += uint64(n)
 		}
+
+		// Readers may return the final block together with io.EOF.
+		if err == io.EOF {
+			break
+		}
 	}
 
 	if writeCursor < capacity {
@@ -0,0 +1,17 @@
+// Package all registers every disk image format of this module with the
+// diskfmt registry. Programs import it for its side effects:
+//
+//	import _ "disk-stream-convert/pkg/diskfmt/all"
+package all
+
+import (
+	_ "disk-stream-convert/pkg/diskfmt/gcetar"
+	_ "disk-stream-convert/pkg/diskfmt/ova"
+	_ "disk-stream-convert/pkg/diskfmt/qcow2"
+	_ "disk-stream-convert/pkg/diskfmt/raw"
+	_ "disk-stream-convert/pkg/diskfmt/simg"
+	_ "disk-stream-convert/pkg/diskfmt/vdi"
+	_ "disk-stream-convert/pkg/diskfmt/vhd"
+	_ "disk-stream-convert/pkg/diskfmt/vhdx"
+	_ "disk-stream-convert/pkg/diskfmt/vmdk"
+)
@@ -0,0 +1,301 @@
+package gcetar
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	gcefmt "disk-stream-convert/format/gcetar"
+	"disk-stream-convert/pkg/transferio"
+)
+
+// chunkSize is the granularity at which zero regions become holes.
+const chunkSize = 4096
+
+// Reader reads the disk of a Compute Engine image tarball: a tar holding
+// disk.raw. The gzip compression is removed by the caller, usually through
+// diskfmt.ResolveSource. Sparse files in the GNU and PAX formats are expanded by
+// archive/tar; chunks that are all zeros are not returned, so holes stay holes
+// in the destination where it supports them.
+type Reader struct {
+	Source   transferio.StreamRead
+	rc       io.ReadCloser
+	tr       *tar.Reader
+	capacity int64
+	offset   int64
+}
+
+func NewReader(source transferio.StreamRead) *Reader {
+	return &Reader{Source: source}
+}
+
+func (r *Reader) Open(ctx context.Context) error {
+	type openable interface {
+		Open(ctx context.Context) (io.ReadCloser, error)
+	}
+	if o, ok := r.Source.(openable); ok {
+		rc, err := o.Open(ctx)
+		if err != nil {
+			return err
+		}
+		r.rc = rc
+	} else {
+		r.rc = r.Source
+	}
+
+	r.tr = tar.NewReader(r.rc)
+	for {
+		hdr, err := r.tr.Next()
+		if err == io.EOF {
+			r.rc.Close()
+			return fmt.Errorf("image tarball does not contain %s", gcefmt.DiskName)
+		}
+		if err != nil {
+			r.rc.Close()
+			return fmt.Errorf("failed to read image tarball: %w", err)
+		}
+		if path.Clean(hdr.Name) != gcefmt.DiskName {
+			continue
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeGNUSparse {
+			r.rc.Close()
+			return fmt.Errorf("%s in image tarball is not a regular file", gcefmt.DiskName)
+		}
+		r.capacity = hdr.Size
+		break
+	}
+	return nil
+}
+
+func (r *Reader) Read(p []byte) (int, int64, error) {
+	for {
+		if r.offset >= r.capacity {
+			return 0, r.capacity, io.EOF
+		}
+		n, err := io.ReadFull(r.tr, p)
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			if r.offset+int64(n) < r.capacity {
+				return 0, 0, fmt.Errorf("image tarball ends at %d of %d bytes: %w", r.offset+int64(n), r.capacity, io.ErrUnexpectedEOF)
+			}
+			err = nil
+		}
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to read %s: %w", gcefmt.DiskName, err)
+		}
+		off := r.offset
+		r.offset += int64(n)
+		if !isZero(p[:n]) {
+			return n, off, nil
+		}
+	}
+}
+
+func (r *Reader) Capacity() int64 {
+	return r.capacity
+}
+
+func (r *Reader) Close() error {
+	if r.rc != nil {
+		return r.rc.Close()
+	}
+	return nil
+}
+
+// Writer writes a gzip compressed Compute Engine image tarball holding the
+// disk as a sparse disk.raw in the old GNU format that tar --format=oldgnu -S
+// writes. Chunks of 4 KiB that are all zeros become holes. The tar header
+// carries the sparse map and the amount of stored data, both known only once
+// the whole disk has been seen, so the data is spooled to a temporary file and
+// the tarball is written to the sink in a single sequential pass by Close.
+// Sinks without random writes, such as HTTP downloads, are supported.
+type Writer struct {
+	Sink transferio.WriteAtStorage
+	// Options tunes the gzip compression.
+	Options transferio.CompressOptions
+	// TempDir is the directory of the spooled data, the system default if
+	// empty.
+	TempDir string
+
+	capacity int64
+	spool    *os.File
+	buf      *bufio.Writer
+	regions  []gcefmt.SparseEntry
+	chunk    []byte
+	fill     int
+	offset   int64
+}
+
+func NewWriter(sink transferio.WriteAtStorage, opts transferio.CompressOptions) *Writer {
+	return &Writer{Sink: sink, Options: opts}
+}
+
+func (w *Writer) Open(ctx context.Context, capacity int64) error {
+	spool, err := os.CreateTemp(w.TempDir, "gce-*.raw")
+	if err != nil {
+		return fmt.Errorf("failed to create gce-tar spool file: %w", err)
+	}
+	w.spool = spool
+	w.buf = bufio.NewWriterSize(spool, 1<<20)
+	w.capacity = capacity
+	w.chunk = make([]byte, chunkSize)
+	return nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.offset+int64(w.fill)+int64(len(p)) > w.capacity {
+		return 0, fmt.Errorf("write beyond the disk capacity of %d bytes", w.capacity)
+	}
+	n := 0
+	for n < len(p) {
+		c := copy(w.chunk[w.fill:], p[n:])
+		w.fill += c
+		n += c
+		if w.fill == len(w.chunk) {
+			if err := w.flushChunk(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// flushChunk spools the pending chunk unless it is all zeros.
+func (w *Writer) flushChunk() error {
+	data := w.chunk[:w.fill]
+	off := w.offset
+	w.offset += int64(w.fill)
+	w.fill = 0
+	if isZero(data) {
+		return nil
+	}
+	if _, err := w.buf.Write(data); err != nil {
+		return fmt.Errorf("failed to spool disk data: %w", err)
+	}
+	if last := len(w.regions) - 1; last >= 0 && w.regions[last].Offset+w.regions[last].Length == off {
+		w.regions[last].Length += int64(len(data))
+	} else {
+		w.regions = append(w.regions, gcefmt.SparseEntry{Offset: off, Length: int64(len(data))})
+	}
+	return nil
+}
+
+func (w *Writer) Close() error {
+	if w.spool == nil {
+		return w.Sink.Close()
+	}
+	defer os.Remove(w.spool.Name())
+	defer w.spool.Close()
+
+	if w.fill > 0 {
+		if err := w.flushChunk(); err != nil {
+			w.Sink.Close()
+			return err
+		}
+	}
+	if err := w.buf.Flush(); err != nil {
+		w.Sink.Close()
+		return fmt.Errorf("failed to spool disk data: %w", err)
+	}
+	if _, err := w.spool.Seek(0, io.SeekStart); err != nil {
+		w.Sink.Close()
+		return err
+	}
+
+	out, err := transferio.NewCompressWrite(w.Sink, transferio.CompressionGzip, w.Options)
+	if err != nil {
+		w.Sink.Close()
+		return err
+	}
+	if err := w.writeTar(out); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// writeTar writes the header, the spooled data of the stored regions and the
+// end of the archive.
+func (w *Writer) writeTar(out io.Writer) error {
+	entries := mergeRegions(w.regions, gcefmt.MaxSparseEntries)
+	hdr, err := gcefmt.SparseHeader(gcefmt.DiskName, w.capacity, entries, time.Now())
+	if err != nil {
+		return err
+	}
+	if _, err := out.Write(hdr); err != nil {
+		return fmt.Errorf("failed to write gce-tar header: %w", err)
+	}
+
+	// Merged entries include the holes between their regions as zeros.
+	zero := make([]byte, chunkSize)
+	var stored int64
+	regions := w.regions
+	for _, e := range entries {
+		pos := e.Offset
+		for len(regions) > 0 && regions[0].Offset < e.Offset+e.Length {
+			rg := regions[0]
+			regions = regions[1:]
+			for gap := rg.Offset - pos; gap > 0; {
+				c := min(gap, int64(len(zero)))
+				if _, err := out.Write(zero[:c]); err != nil {
+					return fmt.Errorf("failed to write gce-tar data: %w", err)
+				}
+				gap -= c
+			}
+			if _, err := io.CopyN(out, w.spool, rg.Length); err != nil {
+				return fmt.Errorf("failed to write gce-tar data: %w", err)
+			}
+			pos = rg.Offset + rg.Length
+		}
+		stored += e.Length
+	}
+
+	// Pad the data to a block and end the archive with two zero blocks.
+	pad := (gcefmt.BlockSize-stored%gcefmt.BlockSize)%gcefmt.BlockSize + 2*gcefmt.BlockSize
+	if _, err := out.Write(make([]byte, pad)); err != nil {
+		return fmt.Errorf("failed to write gce-tar data: %w", err)
+	}
+	return nil
+}
+
+// mergeRegions returns the regions as sparse entries, merging the regions
+// separated by the smallest holes until at most max entries remain.
+func mergeRegions(regions []gcefmt.SparseEntry, max int) []gcefmt.SparseEntry {
+	entries := append([]gcefmt.SparseEntry(nil), regions...)
+	for len(entries) > max {
+		// Close the holes up to twice the smallest one in each round, so
+		// that long maps converge in a few passes.
+		minHole := int64(-1)
+		for i := 1; i < len(entries); i++ {
+			hole := entries[i].Offset - entries[i-1].Offset - entries[i-1].Length
+			if minHole < 0 || hole < minHole {
+				minHole = hole
+			}
+		}
+		limit := minHole*2 + 1
+		merged := entries[:1]
+		for _, e := range entries[1:] {
+			last := &merged[len(merged)-1]
+			if e.Offset-last.Offset-last.Length < limit {
+				last.Length = e.Offset + e.Length - last.Offset
+				continue
+			}
+			merged = append(merged, e)
+		}
+		entries = merged
+	}
+	return entries
+}
+
+func isZero(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
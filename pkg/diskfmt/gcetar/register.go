@@ -0,0 +1,26 @@
+package gcetar
+
+import (
+	"disk-stream-convert/pkg/diskfmt"
+	"disk-stream-convert/pkg/transferio"
+)
+
+// WriterOptions are the options of gce-tar output.
+type WriterOptions struct {
+	// CompressLevel is the gzip level, the encoder default if 0.
+	CompressLevel int `option:"compressLevel"`
+}
+
+func init() {
+	diskfmt.Register(&diskfmt.Format{
+		Name:         "gce-tar",
+		Capabilities: diskfmt.Readable | diskfmt.Writable,
+		Extension:    ".tar.gz",
+		Reader: diskfmt.ReaderFor(func(source transferio.StreamRead, _ *diskfmt.NoOptions) (diskfmt.StreamReader, error) {
+			return NewReader(source), nil
+		}),
+		Writer: diskfmt.WriterFor(func(sink transferio.WriteAtStorage, opts *WriterOptions) (diskfmt.StreamWriter, error) {
+			return NewWriter(sink, transferio.CompressOptions{Level: opts.CompressLevel}), nil
+		}),
+	})
+}
@@ -16,3 +16,9 @@ type StreamWriter interface {
 	Write(p []byte) (n int, err error)
 	Close() error
 }
+
+// FeatureReporter is implemented by readers that can report the feature flags
+// found in the source image once it has been opened.
+type FeatureReporter interface {
+	Features() []string
+}
@@ -0,0 +1,101 @@
+// Package blockio reads the block based image formats, whose tables point to
+// blocks stored anywhere in the image, from sources with or without random
+// access.
+package blockio
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"disk-stream-convert/pkg/transferio"
+)
+
+// Source reads an image at given offsets. Sources with random access are read
+// where asked; other sources are streamed and can only move forward, skipping
+// the bytes in between.
+type Source struct {
+	// name is the name of the format in errors, e.g. "VHD".
+	name string
+	rc   io.ReadCloser
+	ra   io.ReaderAt
+	pos  int64
+}
+
+// Open opens source for reading an image of the named format.
+func Open(ctx context.Context, source transferio.StreamRead, name string) (*Source, error) {
+	type openable interface {
+		Open(ctx context.Context) (io.ReadCloser, error)
+	}
+	s := &Source{name: name}
+	if o, ok := source.(openable); ok {
+		rc, err := o.Open(ctx)
+		if err != nil {
+			return nil, err
+		}
+		s.rc = rc
+	} else {
+		s.rc = source
+	}
+	if ra, ok := source.(io.ReaderAt); ok {
+		s.ra = ra
+	}
+	return s, nil
+}
+
+// RandomAccess reports whether the source can be read at any offset.
+func (s *Source) RandomAccess() bool {
+	return s.ra != nil
+}
+
+// ReadFullAt fills p from the source at off. Without random access, off must
+// not precede the data read before.
+func (s *Source) ReadFullAt(p []byte, off int64) error {
+	if s.ra != nil {
+		n, err := s.ra.ReadAt(p, off)
+		if n == len(p) {
+			return nil
+		}
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if off < s.pos {
+		return fmt.Errorf("%s structure at %d precedes the stream position %d", s.name, off, s.pos)
+	}
+	if _, err := io.CopyN(io.Discard, s.rc, off-s.pos); err != nil {
+		return err
+	}
+	s.pos = off
+	n, err := io.ReadFull(s.rc, p)
+	s.pos += int64(n)
+	return err
+}
+
+// Close closes the source.
+func (s *Source) Close() error {
+	return s.rc.Close()
+}
+
+// Block is an allocated block of a disk.
+type Block struct {
+	// Index is the number of the block in the disk.
+	Index int64
+	// Offset is where the block is stored in the image.
+	Offset int64
+}
+
+// CheckOrder makes sure the source can return the blocks, which are in disk
+// order, without seeking back.
+func (s *Source) CheckOrder(blocks []Block) error {
+	if s.ra != nil {
+		return nil
+	}
+	for i := 1; i < len(blocks); i++ {
+		if blocks[i].Offset < blocks[i-1].Offset {
+			return fmt.Errorf("%s block %d is stored before block %d, which requires a seekable source", s.name, blocks[i].Index, blocks[i-1].Index)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,332 @@
+package ova
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	ovafmt "disk-stream-convert/format/ova"
+	"disk-stream-convert/pkg/diskfmt/vmdk"
+	"disk-stream-convert/pkg/transferio"
+)
+
+// DefaultName is the appliance name used when Writer.Name is empty.
+const DefaultName = "disk"
+
+// maxEnvelopeSize bounds the OVF descriptor read into memory.
+const maxEnvelopeSize = 4 << 20
+
+// Reader reads a disk of an OVA appliance. The tar is read as a stream: the
+// OVF descriptor, which comes first, names the disk files, and the entry of the
+// selected disk is passed to the vmdk Reader without extracting it, so the
+// source does not need to be seekable. Disks must be streamOptimized VMDKs,
+// optionally gzip compressed, stored after the descriptor.
+type Reader struct {
+	Source transferio.StreamRead
+	// DiskIndex selects the disk of multi-disk appliances, counted from zero
+	// in the order of the OVF disk section.
+	DiskIndex int
+
+	rc   io.ReadCloser
+	disk *vmdk.Reader
+}
+
+func NewReader(source transferio.StreamRead) *Reader {
+	return &Reader{Source: source}
+}
+
+func (r *Reader) Open(ctx context.Context) error {
+	type openable interface {
+		Open(ctx context.Context) (io.ReadCloser, error)
+	}
+	if o, ok := r.Source.(openable); ok {
+		rc, err := o.Open(ctx)
+		if err != nil {
+			return err
+		}
+		r.rc = rc
+	} else {
+		r.rc = r.Source
+	}
+
+	entry, err := r.openDisk()
+	if err != nil {
+		r.rc.Close()
+		return err
+	}
+	disk := vmdk.NewReader(entry)
+	if err := disk.Open(ctx); err != nil {
+		entry.Close()
+		return err
+	}
+	r.disk = disk
+	return nil
+}
+
+// openDisk reads the descriptor and moves the tar to the entry of the
+// selected disk.
+func (r *Reader) openDisk() (*entryStream, error) {
+	tr := tar.NewReader(r.rc)
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ova: %w", err)
+	}
+	if path.Ext(hdr.Name) != ovafmt.EnvelopeExt {
+		return nil, fmt.Errorf("ova starts with %s instead of the OVF descriptor", hdr.Name)
+	}
+	if hdr.Size > maxEnvelopeSize {
+		return nil, fmt.Errorf("OVF descriptor of %d bytes is too large", hdr.Size)
+	}
+	b, err := io.ReadAll(tr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read OVF descriptor: %w", err)
+	}
+	envelope, err := ovafmt.ParseEnvelope(b)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.DiskIndex < 0 || r.DiskIndex >= len(envelope.Disks) {
+		return nil, fmt.Errorf("ova disk index %d out of range, the appliance has %d disks", r.DiskIndex, len(envelope.Disks))
+	}
+	disk := envelope.Disks[r.DiskIndex]
+	if disk.FileRef == "" {
+		return nil, fmt.Errorf("ova disk %s is blank", disk.DiskID)
+	}
+	file := envelope.File(disk.FileRef)
+	if file == nil {
+		return nil, fmt.Errorf("ova disk %s refers to unknown file %s", disk.DiskID, disk.FileRef)
+	}
+	if !strings.HasSuffix(disk.Format, "#streamOptimized") {
+		return nil, fmt.Errorf("ova disk %s has unsupported format %q, only streamOptimized vmdk disks are supported", disk.DiskID, disk.Format)
+	}
+	if file.ChunkSize != 0 {
+		return nil, fmt.Errorf("ova file %s is split into chunks, which is not supported", file.Href)
+	}
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("ova file %s not found", file.Href)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ova: %w", err)
+		}
+		if hdr.Name != file.Href {
+			continue
+		}
+		e := &entryStream{r: tr, size: hdr.Size, closer: r.rc}
+		switch file.Compression {
+		case "":
+		case "gzip":
+			zr, err := gzip.NewReader(tr)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read ova file %s: %w", file.Href, err)
+			}
+			e.r = zr
+			// The uncompressed size is not known.
+			e.size = 0
+		default:
+			return nil, fmt.Errorf("ova file %s has unsupported compression %q", file.Href, file.Compression)
+		}
+		return e, nil
+	}
+}
+
+func (r *Reader) Read(p []byte) (int, int64, error) {
+	return r.disk.Read(p)
+}
+
+func (r *Reader) Capacity() int64 {
+	return r.disk.Capacity()
+}
+
+func (r *Reader) Close() error {
+	return r.disk.Close()
+}
+
+// entryStream is the disk entry of the tar, closing the whole source.
+type entryStream struct {
+	r      io.Reader
+	size   int64
+	closer io.Closer
+}
+
+func (e *entryStream) Read(p []byte) (int, error) {
+	return e.r.Read(p)
+}
+
+func (e *entryStream) Size() (int64, bool) {
+	return e.size, e.size != 0
+}
+
+func (e *entryStream) Close() error {
+	return e.closer.Close()
+}
+
+// Writer packages the converted disk as an OVA: a tar holding the OVF
+// descriptor, the streamOptimized VMDK and a SHA-256 manifest, in that order.
+// The descriptor and the tar header of the disk need the size of the VMDK,
+// so the disk is spooled to a temporary file and the package is written to the
+// sink in a single sequential pass by Close. Sinks without random writes, such
+// as HTTP downloads, are supported.
+type Writer struct {
+	Sink transferio.WriteAtStorage
+	// Name is the name of the virtual machine and the base name of the files
+	// in the package, DefaultName if empty.
+	Name string
+	// TempDir is the directory of the spooled disk, the system default if
+	// empty.
+	TempDir string
+
+	capacity  int64
+	spoolPath string
+	disk      *vmdk.Writer
+}
+
+func NewWriter(sink transferio.WriteAtStorage, name string) *Writer {
+	return &Writer{Sink: sink, Name: name}
+}
+
+func (w *Writer) Open(ctx context.Context, capacity int64) error {
+	f, err := os.CreateTemp(w.TempDir, "ova-*.vmdk")
+	if err != nil {
+		return fmt.Errorf("failed to create ova spool file: %w", err)
+	}
+	w.spoolPath = f.Name()
+	f.Close()
+
+	spool, err := transferio.NewFileWriteStorage(w.spoolPath, false)
+	if err != nil {
+		os.Remove(w.spoolPath)
+		return err
+	}
+	disk := vmdk.NewWriter(spool)
+	if err := disk.Open(ctx, capacity); err != nil {
+		spool.Close()
+		os.Remove(w.spoolPath)
+		return err
+	}
+	w.disk = disk
+	w.capacity = capacity
+	return nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	return w.disk.Write(p)
+}
+
+func (w *Writer) Close() error {
+	if w.disk == nil {
+		return w.Sink.Close()
+	}
+	defer os.Remove(w.spoolPath)
+	if err := w.disk.Close(); err != nil {
+		w.Sink.Close()
+		return err
+	}
+	if err := w.writePackage(); err != nil {
+		w.Sink.Close()
+		return err
+	}
+	return w.Sink.Close()
+}
+
+// writePackage streams the descriptor, the spooled disk and the manifest to
+// the sink.
+func (w *Writer) writePackage() error {
+	spool, err := os.Open(w.spoolPath)
+	if err != nil {
+		return err
+	}
+	defer spool.Close()
+	fi, err := spool.Stat()
+	if err != nil {
+		return err
+	}
+
+	name := w.Name
+	if name == "" {
+		name = DefaultName
+	}
+	disk := ovafmt.Disk{
+		FileName: name + "-disk1.vmdk",
+		FileSize: fi.Size(),
+		Capacity: w.capacity,
+		Format:   ovafmt.DiskFormatStreamOptimized,
+	}
+	envelope := []byte(ovafmt.MakeEnvelope(name, disk))
+
+	tw := tar.NewWriter(&sinkWriter{sink: w.Sink})
+	modTime := time.Now()
+	var manifest []byte
+	// The descriptor must be the first file of the package.
+	files := []struct {
+		name string
+		size int64
+		r    io.Reader
+	}{
+		{name + ovafmt.EnvelopeExt, int64(len(envelope)), bytes.NewReader(envelope)},
+		{disk.FileName, disk.FileSize, spool},
+	}
+	for _, f := range files {
+		sum, err := writeFile(tw, f.name, f.size, modTime, f.r)
+		if err != nil {
+			return err
+		}
+		manifest = append(manifest, ovafmt.ManifestEntry(f.name, sum)...)
+	}
+	if _, err := writeFile(tw, name+ovafmt.ManifestExt, int64(len(manifest)), modTime, bytes.NewReader(manifest)); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to write ova: %w", err)
+	}
+	return nil
+}
+
+// fileHeader returns the tar header of a file of the package. The format is
+// left to archive/tar, which writes ustar headers, as OVF asks for, unless the
+// file is too large for them, like disks of 8 GiB and more; it falls back to
+// PAX headers then.
+func fileHeader(name string, size int64, modTime time.Time) *tar.Header {
+	return &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0o644,
+		ModTime:  modTime,
+	}
+}
+
+// writeFile adds a file to the package and returns its SHA-256 digest.
+func writeFile(tw *tar.Writer, name string, size int64, modTime time.Time, r io.Reader) ([]byte, error) {
+	if err := tw.WriteHeader(fileHeader(name, size, modTime)); err != nil {
+		return nil, fmt.Errorf("failed to write ova entry %s: %w", name, err)
+	}
+	h := sha256.New()
+	if _, err := io.CopyN(io.MultiWriter(tw, h), r, size); err != nil {
+		return nil, fmt.Errorf("failed to write ova entry %s: %w", name, err)
+	}
+	return h.Sum(nil), nil
+}
+
+// sinkWriter writes sequentially to the sink.
+type sinkWriter struct {
+	sink transferio.WriteAtStorage
+	off  int64
+}
+
+func (s *sinkWriter) Write(p []byte) (int, error) {
+	n, err := s.sink.WriteAt(p, s.off)
+	s.off += int64(n)
+	return n, err
+}
@@ -0,0 +1,35 @@
+package ova
+
+import (
+	"archive/tar"
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestFileHeaderLargeDisk(t *testing.T) {
+	modTime := time.Unix(1700000000, 0)
+	for _, tc := range []struct {
+		size int64
+		want tar.Format
+	}{
+		{4096, tar.FormatUSTAR},
+		{9 << 30, tar.FormatPAX},
+	} {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		if err := tw.WriteHeader(fileHeader("disk-disk1.vmdk", tc.size, modTime)); err != nil {
+			t.Fatalf("size %d: write header: %v", tc.size, err)
+		}
+		hdr, err := tar.NewReader(&buf).Next()
+		if err != nil {
+			t.Fatalf("size %d: read header: %v", tc.size, err)
+		}
+		if hdr.Name != "disk-disk1.vmdk" || hdr.Size != tc.size {
+			t.Fatalf("read back %s of %d bytes, want %d", hdr.Name, hdr.Size, tc.size)
+		}
+		if hdr.Format&tc.want == 0 {
+			t.Fatalf("size %d: header format %v, want %v", tc.size, hdr.Format, tc.want)
+		}
+	}
+}
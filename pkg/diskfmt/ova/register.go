@@ -0,0 +1,34 @@
+package ova
+
+import (
+	"disk-stream-convert/pkg/diskfmt"
+	"disk-stream-convert/pkg/transferio"
+)
+
+// ReaderOptions are the options of ova sources.
+type ReaderOptions struct {
+	// DiskIndex selects the disk of a multi-disk appliance, counted from 0.
+	DiskIndex int `option:"diskIndex"`
+}
+
+// WriterOptions are the options of ova output.
+type WriterOptions struct {
+	// Name is the name of the appliance.
+	Name string `option:"name,hint"`
+}
+
+func init() {
+	diskfmt.Register(&diskfmt.Format{
+		Name:         "ova",
+		Capabilities: diskfmt.Readable | diskfmt.Writable,
+		Extension:    ".ova",
+		Reader: diskfmt.ReaderFor(func(source transferio.StreamRead, opts *ReaderOptions) (diskfmt.StreamReader, error) {
+			ar := NewReader(source)
+			ar.DiskIndex = opts.DiskIndex
+			return ar, nil
+		}),
+		Writer: diskfmt.WriterFor(func(sink transferio.WriteAtStorage, opts *WriterOptions) (diskfmt.StreamWriter, error) {
+			return NewWriter(sink, opts.Name), nil
+		}),
+	})
+}
@@ -0,0 +1,198 @@
+package diskfmt
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	gcefmt "disk-stream-convert/format/gcetar"
+	ovafmt "disk-stream-convert/format/ova"
+	qcow2fmt "disk-stream-convert/format/qcow2"
+	simgfmt "disk-stream-convert/format/simg"
+	vdifmt "disk-stream-convert/format/vdi"
+	vhdfmt "disk-stream-convert/format/vhd"
+	vhdxfmt "disk-stream-convert/format/vhdx"
+	vmdkstream "disk-stream-convert/format/vmdk-stream"
+	"disk-stream-convert/pkg/transferio"
+)
+
+// probeSize is the number of bytes Probe looks at, enough for the headers of
+// all recognized formats.
+const probeSize = 64 << 10
+
+// Probed is the result of Probe.
+type Probed struct {
+	// Format is the name of the source format, "raw" when no other format is
+	// recognized.
+	Format string
+	// Subformat is the subformat of vmdk images: streamOptimized,
+	// monolithicSparse or descriptor.
+	Subformat string
+	// Compression is the wrapper around the image, transferio.CompressionNone
+	// if there is none.
+	Compression string
+	// Source reads the image from its start, decompressed.
+	Source transferio.StreamRead
+}
+
+// Probe detects the format of the image in source from its first bytes. The
+// source is decompressed first according to compression, which takes the
+// values of transferio.Decompress. Sources with random access are probed with
+// ReadAt and keep it unless they are compressed; other sources, such as HTTP
+// bodies, are opened and the bytes read are replayed when the returned
+// Source is read, so nothing is consumed.
+//
+// Recognized are qcow2, vmdk sparse extents and descriptors, vhd (dynamic
+// images by the copy of the footer at the start, fixed images by the footer
+// at the end, on sources with random access and a known size only), vhdx,
+// vdi, Android sparse images, and tar files starting with an OVF descriptor
+// (ova) or holding disk.raw (gce-tar). Anything else is raw.
+func Probe(ctx context.Context, source transferio.StreamRead, compression string) (*Probed, error) {
+	source, err := transferio.Decompress(source, compression)
+	if err != nil {
+		return nil, err
+	}
+	p := &Probed{Compression: transferio.CompressionNone, Source: source}
+
+	var head []byte
+	if ra, ok := source.(io.ReaderAt); ok {
+		head = make([]byte, probeSize)
+		n, err := ra.ReadAt(head, 0)
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("failed to probe source: %w", err)
+		}
+		head = head[:n]
+	} else {
+		pr, err := peek(ctx, source)
+		if err != nil {
+			return nil, err
+		}
+		if d, ok := source.(*transferio.DecompressRead); ok {
+			p.Compression = d.Detected()
+		}
+		head = pr.head
+		p.Source = pr
+	}
+
+	p.Format, p.Subformat = detectFormat(head)
+	if p.Format == "raw" {
+		if ra, ok := source.(io.ReaderAt); ok && isFixedVHD(ra, source) {
+			p.Format = "vhd"
+		}
+	}
+	return p, nil
+}
+
+// detectFormat returns the format, and the subformat for vmdk, of an image
+// starting with head.
+func detectFormat(head []byte) (string, string) {
+	switch {
+	case len(head) >= 4 && binary.BigEndian.Uint32(head) == qcow2fmt.Magic:
+		return "qcow2", ""
+	case len(head) >= vmdkstream.SECTOR_SIZE && binary.LittleEndian.Uint32(head) == vmdkstream.VMDKMagic:
+		hdr, err := vmdkstream.ParseSparseExtentHeader(head[:vmdkstream.SECTOR_SIZE])
+		if err == nil && hdr.Flags&vmdkstream.SPARSEFLAG_COMPRESSED == 0 && hdr.GdOffset != vmdkstream.SPARSE_GD_AT_END {
+			return "vmdk", vmdkstream.CREATE_TYPE_MONOLITHIC_SPARSE
+		}
+		return "vmdk", vmdkstream.CREATE_TYPE_STREAM_OPTIMIZED
+	case bytes.HasPrefix(head, []byte("# Disk DescriptorFile")):
+		return "vmdk", "descriptor"
+	case bytes.HasPrefix(head, []byte(vhdfmt.FooterCookie)):
+		return "vhd", ""
+	case bytes.HasPrefix(head, []byte(vhdxfmt.FileSignature)):
+		return "vhdx", ""
+	case len(head) >= 68 && binary.LittleEndian.Uint32(head[64:]) == vdifmt.Signature:
+		return "vdi", ""
+	case len(head) >= 4 && binary.LittleEndian.Uint32(head) == simgfmt.Magic:
+		return "simg", ""
+	}
+	if format := detectTar(head); format != "" {
+		return format, ""
+	}
+	return "raw", ""
+}
+
+// detectTar recognizes the tar based formats by the first file of the tar.
+func detectTar(head []byte) string {
+	if len(head) < 512 || !bytes.HasPrefix(head[257:], []byte("ustar")) {
+		return ""
+	}
+	hdr, err := tar.NewReader(bytes.NewReader(head)).Next()
+	if err != nil {
+		return ""
+	}
+	switch {
+	case strings.HasSuffix(hdr.Name, ovafmt.EnvelopeExt):
+		return "ova"
+	case path.Clean(hdr.Name) == gcefmt.DiskName:
+		return "gce-tar"
+	}
+	return ""
+}
+
+// isFixedVHD reports whether the source ends with a VHD footer.
+func isFixedVHD(ra io.ReaderAt, source transferio.StreamRead) bool {
+	size, ok := source.Size()
+	if !ok || size < vhdfmt.FooterSize {
+		return false
+	}
+	footer := make([]byte, vhdfmt.FooterSize)
+	if _, err := ra.ReadAt(footer, size-vhdfmt.FooterSize); err != nil {
+		return false
+	}
+	_, err := vhdfmt.ParseFooter(footer)
+	return err == nil
+}
+
+// peekedRead is an opened source whose first bytes have already been read.
+// They are returned again before the rest of the source.
+type peekedRead struct {
+	transferio.StreamRead
+	head []byte
+	rc   io.ReadCloser
+	r    io.Reader
+}
+
+func peek(ctx context.Context, source transferio.StreamRead) (*peekedRead, error) {
+	type openable interface {
+		Open(ctx context.Context) (io.ReadCloser, error)
+	}
+	var rc io.ReadCloser = source
+	if o, ok := source.(openable); ok {
+		var err error
+		if rc, err = o.Open(ctx); err != nil {
+			return nil, err
+		}
+	}
+	head := make([]byte, probeSize)
+	n, err := io.ReadFull(rc, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		rc.Close()
+		return nil, fmt.Errorf("failed to probe source: %w", err)
+	}
+	head = head[:n]
+	return &peekedRead{
+		StreamRead: source,
+		head:       head,
+		rc:         rc,
+		r:          io.MultiReader(bytes.NewReader(head), rc),
+	}, nil
+}
+
+// Open returns the source itself, which is already open.
+func (p *peekedRead) Open(ctx context.Context) (io.ReadCloser, error) {
+	return p, nil
+}
+
+func (p *peekedRead) Read(b []byte) (int, error) {
+	return p.r.Read(b)
+}
+
+func (p *peekedRead) Close() error {
+	return p.rc.Close()
+}
@@ -0,0 +1,61 @@
+package qcow2
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"disk-stream-convert/pkg/transferio"
+)
+
+// BackingResolver opens a backing file by the name stored in an overlay header.
+type BackingResolver func(ctx context.Context, name string) (transferio.StreamRead, error)
+
+// FileResolver resolves backing files on the local filesystem the way qemu
+// does: absolute names are used as they are and relative names are taken
+// relative to dir, which should be the directory of the overlay.
+func FileResolver(dir string) BackingResolver {
+	return func(ctx context.Context, name string) (transferio.StreamRead, error) {
+		p := name
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(dir, p)
+		}
+		return transferio.NewFileReadStorage(p)
+	}
+}
+
+// DirResolver resolves backing files by their base name inside dir. Unlike
+// FileResolver it never leaves dir, so image headers supplied by clients
+// cannot reach arbitrary local files.
+func DirResolver(dir string) BackingResolver {
+	return func(ctx context.Context, name string) (transferio.StreamRead, error) {
+		base := filepath.Base(filepath.FromSlash(name))
+		if base == "." || base == ".." || base == string(filepath.Separator) {
+			return nil, fmt.Errorf("invalid backing file name %q", name)
+		}
+		return transferio.NewFileReadStorage(filepath.Join(dir, base))
+	}
+}
+
+// URLResolver resolves backing files relative to the URL of the overlay and
+// fetches them with HTTPImport. Absolute paths, which usually refer to the
+// host that created the chain, are reduced to their base name.
+func URLResolver(overlayURL string) BackingResolver {
+	return func(ctx context.Context, name string) (transferio.StreamRead, error) {
+		base, err := url.Parse(overlayURL)
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(name, "/") || filepath.IsAbs(name) {
+			name = path.Base(filepath.ToSlash(name))
+		}
+		ref, err := url.Parse(name)
+		if err != nil || ref.IsAbs() || ref.Host != "" {
+			return nil, fmt.Errorf("invalid backing file name %q", name)
+		}
+		return transferio.NewHTTPImport(base.ResolveReference(ref).String()), nil
+	}
+}
@@ -3,6 +3,7 @@ package qcow2
 import (
 	"context"
 	qcow2fmt "disk-stream-convert/format/qcow2"
+	"disk-stream-convert/pkg/diskfmt"
 	"disk-stream-convert/pkg/transferio"
 	"fmt"
 	"io"
@@ -10,11 +11,28 @@ import (
 )
 
 type Reader struct {
-	Source  transferio.StreamRead
-	q       *qcow2fmt.Qcow2Format
-	rc      io.ReadCloser
-	tmpFile *os.File
-	offset  int64
+	Source transferio.StreamRead
+	// ResolveBacking opens the backing files of overlay images, and external
+	// data files that are not given as DataFile. Such images are rejected when
+	// it is nil.
+	ResolveBacking BackingResolver
+	// DataFile is the external data file of the image, if it has one. When nil,
+	// the file named in the image header is opened through ResolveBacking.
+	DataFile transferio.StreamRead
+	// Snapshot selects an internal snapshot, by ID or name, to convert instead
+	// of the current state of the image.
+	Snapshot string
+	// AllowCorrupt converts images that qemu marked corrupt.
+	AllowCorrupt bool
+	// Passphrase unlocks LUKS encrypted images, including encrypted backing
+	// files.
+	Passphrase   []byte
+	q            *qcow2fmt.Qcow2Format
+	rc           io.ReadCloser
+	tmpFile      *os.File
+	backing      []io.Closer
+	dataFileUsed bool
+	offset       int64
 }
 
 func NewReader(source transferio.StreamRead) *Reader {
@@ -36,66 +54,131 @@ func (r *Reader) Open(ctx context.Context) error {
 		}
 	} else {
 		// Source does not support ReadAt. Buffer to temp file.
-		tmp, err := os.CreateTemp("", "dsc-qcow2-import-*")
+		tmp, err := bufferToTempFile(ctx, r.Source)
 		if err != nil {
-			return fmt.Errorf("failed to create temp file: %w", err)
+			return err
 		}
 		r.tmpFile = tmp
+		r.rc = tmp
+		inputReader = tmp // os.File implements Read and ReadAt
+	}
 
-		type openable interface {
-			Open(ctx context.Context) (io.ReadCloser, error)
-		}
+	q, err := qcow2fmt.NewQcow2FormatWithOptions(inputReader, qcow2fmt.Options{
+		OpenBacking: func(name string) (qcow2fmt.ReadAndReadAt, error) {
+			return r.openBacking(ctx, name)
+		},
+		OpenDataFile: func(name string) (qcow2fmt.ReadAndReadAt, error) {
+			return r.openDataFile(ctx, name)
+		},
+		Snapshot:     r.Snapshot,
+		AllowCorrupt: r.AllowCorrupt,
+		Passphrase:   r.Passphrase,
+	})
+	if err != nil {
+		return err
+	}
+	r.q = q
+	return nil
+}
 
-		var src io.ReadCloser
-		if o, ok := r.Source.(openable); ok {
-			s, err := o.Open(ctx)
-			if err != nil {
-				tmp.Close()
-				os.Remove(tmp.Name())
-				return err
-			}
-			src = s
-		} else {
-			src = r.Source
-		}
+// openBacking resolves a backing file and makes it randomly accessible.
+func (r *Reader) openBacking(ctx context.Context, name string) (qcow2fmt.ReadAndReadAt, error) {
+	if r.ResolveBacking == nil {
+		return nil, fmt.Errorf("no backing file resolver configured")
+	}
+	src, err := r.ResolveBacking(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return r.openRandomAccess(ctx, src)
+}
 
-		// Copy to temp file
-		if _, err := io.Copy(tmp, src); err != nil {
-			src.Close()
-			tmp.Close()
-			os.Remove(tmp.Name())
-			return fmt.Errorf("failed to buffer qcow2 to temp file: %w", err)
-		}
-		// We don't close src here strictly if it wasn't opened by us,
-		// but since we consumed it, it's safer to leave it to the caller or Close().
-		// However, for temp file logic, we are done with src.
-		// If src IS r.Source, we might want to close it now to free resources,
-		// as we are switching to tmpFile.
-		// But let's be careful not to double close if r.Close() calls Source.Close().
-		// Actually r.rc will be set to tmp.
-
-		// Let's not close src unless we opened it via openable.
-		if _, ok := r.Source.(openable); ok {
-			src.Close()
-		}
+// openDataFile opens the external data file of an image. DataFile belongs to
+// the image itself, which is opened before its backing files.
+func (r *Reader) openDataFile(ctx context.Context, name string) (qcow2fmt.ReadAndReadAt, error) {
+	if r.DataFile != nil && !r.dataFileUsed {
+		r.dataFileUsed = true
+		return r.openRandomAccess(ctx, r.DataFile)
+	}
+	if name == "" {
+		return nil, fmt.Errorf("image does not name its external data file")
+	}
+	return r.openBacking(ctx, name)
+}
+
+// openRandomAccess returns src if it supports ReadAt, or a temp file copy of
+// it otherwise. Close releases both.
+func (r *Reader) openRandomAccess(ctx context.Context, src transferio.StreamRead) (qcow2fmt.ReadAndReadAt, error) {
+	if ra, ok := src.(io.ReaderAt); ok {
+		r.backing = append(r.backing, src)
+		return &readAtWrapper{Reader: src, ReaderAt: ra}, nil
+	}
+
+	tmp, err := bufferToTempFile(ctx, src)
+	src.Close()
+	if err != nil {
+		return nil, err
+	}
+	r.backing = append(r.backing, tempFileCloser{tmp})
+	return tmp, nil
+}
 
-		// Rewind temp file
-		if _, err := tmp.Seek(0, 0); err != nil {
+// bufferToTempFile copies a non-seekable source into a temp file, since qcow2
+// metadata can point anywhere in the image. The source is not closed unless it
+// was opened here.
+func bufferToTempFile(ctx context.Context, source transferio.StreamRead) (*os.File, error) {
+	tmp, err := os.CreateTemp("", "dsc-qcow2-import-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp file: %w", err)
+	}
+
+	type openable interface {
+		Open(ctx context.Context) (io.ReadCloser, error)
+	}
+
+	var src io.ReadCloser
+	if o, ok := source.(openable); ok {
+		s, err := o.Open(ctx)
+		if err != nil {
 			tmp.Close()
 			os.Remove(tmp.Name())
-			return err
+			return nil, err
 		}
+		src = s
+	} else {
+		src = source
+	}
 
-		r.rc = tmp
-		inputReader = tmp // os.File implements Read and ReadAt
+	// Copy to temp file
+	if _, err := io.Copy(tmp, src); err != nil {
+		src.Close()
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, fmt.Errorf("failed to buffer qcow2 to temp file: %w", err)
 	}
 
-	q, err := qcow2fmt.NewQcow2Format(inputReader)
-	if err != nil {
-		return err
+	// Let's not close src unless we opened it via openable.
+	if _, ok := source.(openable); ok {
+		src.Close()
 	}
-	r.q = q
-	return nil
+
+	// Rewind temp file
+	if _, err := tmp.Seek(0, 0); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	return tmp, nil
+}
+
+type tempFileCloser struct {
+	f *os.File
+}
+
+func (t tempFileCloser) Close() error {
+	err := t.f.Close()
+	os.Remove(t.f.Name())
+	return err
 }
 
 func (r *Reader) Read(p []byte) (int, int64, error) {
@@ -107,6 +190,22 @@ func (r *Reader) Read(p []byte) (int, int64, error) {
 	return n, readOffset, err
 }
 
+// Snapshots returns the internal snapshots of the image after Open.
+func (r *Reader) Snapshots() ([]qcow2fmt.Snapshot, error) {
+	if r.q == nil {
+		return nil, nil
+	}
+	return r.q.Snapshots()
+}
+
+// Features returns the feature bits set in the image header after Open.
+func (r *Reader) Features() []string {
+	if r.q == nil {
+		return nil
+	}
+	return r.q.Features()
+}
+
 func (r *Reader) Capacity() int64 {
 	if r.q == nil {
 		return 0
@@ -117,6 +216,10 @@ func (r *Reader) Capacity() int64 {
 
 func (r *Reader) Close() error {
 	var err error
+	for _, b := range r.backing {
+		b.Close()
+	}
+	r.backing = nil
 	if r.tmpFile != nil {
 		r.tmpFile.Close()
 		os.Remove(r.tmpFile.Name())
@@ -146,3 +249,42 @@ type readAtWrapper struct {
 	io.Reader
 	io.ReaderAt
 }
+
+type Writer struct {
+	Sink     transferio.WriteAtStorage
+	Compress bool
+	qw       *qcow2fmt.Qcow2Writer
+}
+
+func NewWriter(sink transferio.WriteAtStorage, compress bool) *Writer {
+	return &Writer{Sink: sink, Compress: compress}
+}
+
+func (w *Writer) Open(ctx context.Context, capacity int64) error {
+	// The header and the tables are written after the data.
+	if !transferio.SupportsRandomWrite(w.Sink) {
+		return fmt.Errorf("qcow2 output requires a destination that supports random writes")
+	}
+	qw, err := qcow2fmt.NewQcow2Writer(w.Sink, uint64(capacity), qcow2fmt.WriterOptions{Compress: w.Compress})
+	if err != nil {
+		return err
+	}
+	w.qw = qw
+	return nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	return w.qw.Write(p)
+}
+
+func (w *Writer) Close() error {
+	if w.qw != nil {
+		if err := w.qw.Close(); err != nil {
+			w.Sink.Close()
+			return err
+		}
+	}
+	return w.Sink.Close()
+}
+
+var _ diskfmt.FeatureReporter = (*Reader)(nil)
@@ -0,0 +1,51 @@
+package qcow2
+
+import (
+	"errors"
+
+	"disk-stream-convert/pkg/diskfmt"
+	"disk-stream-convert/pkg/transferio"
+)
+
+// ReaderOptions are the options of qcow2 sources.
+type ReaderOptions struct {
+	// ResolveBacking opens backing files and the external data file.
+	ResolveBacking BackingResolver `option:"resolve,hint"`
+	// DataFile is the external data file, opened through ResolveBacking if
+	// nil.
+	DataFile transferio.StreamRead `option:"dataFile,hint"`
+	// Snapshot selects an internal snapshot by ID or name.
+	Snapshot string `option:"snapshot"`
+	// AllowCorrupt converts images that are marked corrupt.
+	AllowCorrupt bool `option:"allowCorrupt,hint"`
+	// Passphrase unlocks LUKS encrypted images.
+	Passphrase []byte `option:"passphrase,hint"`
+}
+
+// WriterOptions are the options of qcow2 output.
+type WriterOptions struct {
+	// Compress is deflate to compress the clusters.
+	Compress string `option:"compress,hint"`
+}
+
+func init() {
+	diskfmt.Register(&diskfmt.Format{
+		Name:         "qcow2",
+		Capabilities: diskfmt.Readable | diskfmt.Writable | diskfmt.NeedsSeekableSink | diskfmt.NeedsRandomAccessSource,
+		Reader: diskfmt.ReaderFor(func(source transferio.StreamRead, opts *ReaderOptions) (diskfmt.StreamReader, error) {
+			qr := NewReader(source)
+			qr.ResolveBacking = opts.ResolveBacking
+			qr.DataFile = opts.DataFile
+			qr.Snapshot = opts.Snapshot
+			qr.AllowCorrupt = opts.AllowCorrupt
+			qr.Passphrase = opts.Passphrase
+			return qr, nil
+		}),
+		Writer: diskfmt.WriterFor(func(sink transferio.WriteAtStorage, opts *WriterOptions) (diskfmt.StreamWriter, error) {
+			if opts.Compress != "" && opts.Compress != "deflate" {
+				return nil, errors.New("unsupported qcow2 compression: " + opts.Compress)
+			}
+			return NewWriter(sink, opts.Compress == "deflate"), nil
+		}),
+	})
+}
@@ -2,16 +2,23 @@ package raw
 
 import (
 	"context"
+	"fmt"
 	"io"
+	"os"
 
 	"disk-stream-convert/pkg/transferio"
 )
 
 type Reader struct {
-	Source   transferio.StreamRead
-	reader   io.ReadCloser
-	offset   int64
-	capacity int64
+	Source transferio.StreamRead
+	// BufferUnknownSize copies sources of unknown size, such as compressed
+	// streams, to a temporary file first, so that the capacity is known before
+	// the data is read. Destinations other than raw need it.
+	BufferUnknownSize bool
+	reader            io.ReadCloser
+	tmpFile           *os.File
+	offset            int64
+	capacity          int64
 }
 
 func NewReader(source transferio.StreamRead) *Reader {
@@ -41,11 +48,37 @@ func (r *Reader) Open(ctx context.Context) error {
 	}
 	if size, ok := r.Source.Size(); ok {
 		r.capacity = size
+	} else if r.BufferUnknownSize {
+		if err := r.buffer(); err != nil {
+			return err
+		}
 	}
 	r.offset = 0
 	return nil
 }
 
+// buffer replaces the source stream with a temporary copy of its data.
+func (r *Reader) buffer() error {
+	defer r.reader.Close()
+	tmp, err := os.CreateTemp("", "dsc-raw-import-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	size, err := io.Copy(tmp, r.reader)
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to buffer raw source to temp file: %w", err)
+	}
+	r.tmpFile = tmp
+	r.reader = tmp
+	r.capacity = size
+	return nil
+}
+
 func (r *Reader) Read(p []byte) (int, int64, error) {
 	n, err := io.ReadFull(r.reader, p)
 	if err != nil {
@@ -70,6 +103,9 @@ func (r *Reader) Capacity() int64 {
 }
 
 func (r *Reader) Close() error {
+	if r.tmpFile != nil {
+		defer os.Remove(r.tmpFile.Name())
+	}
 	if r.reader != nil {
 		return r.reader.Close()
 	}
@@ -81,6 +117,9 @@ type Writer struct {
 	Prealloc bool
 	offset   int64
 	ctx      context.Context
+	// stream is set for sinks that only accept sequential writes, such as
+	// compressed outputs and HTTP downloads.
+	stream io.Writer
 }
 
 func NewWriter(sink transferio.WriteAtStorage, prealloc bool) *Writer {
@@ -90,6 +129,11 @@ func NewWriter(sink transferio.WriteAtStorage, prealloc bool) *Writer {
 func (w *Writer) Open(ctx context.Context, capacity int64) error {
 	w.offset = 0
 	w.ctx = ctx
+	if !transferio.SupportsRandomWrite(w.Sink) {
+		if sw, ok := w.Sink.(io.Writer); ok {
+			w.stream = sw
+		}
+	}
 	if w.Prealloc {
 		return w.Sink.Preallocate(ctx, capacity)
 	}
@@ -97,12 +141,15 @@ func (w *Writer) Open(ctx context.Context, capacity int64) error {
 }
 
 func (w *Writer) Write(p []byte) (int, error) {
-	n, err := w.Sink.WriteAt(p, w.offset)
-	if err != nil {
-		return n, err
+	var n int
+	var err error
+	if w.stream != nil {
+		n, err = w.stream.Write(p)
+	} else {
+		n, err = w.Sink.WriteAt(p, w.offset)
 	}
 	w.offset += int64(n)
-	return n, nil
+	return n, err
 }
 
 func (w *Writer) Close() error {
@@ -0,0 +1,59 @@
+package raw
+
+import (
+	"errors"
+
+	"disk-stream-convert/pkg/diskfmt"
+	"disk-stream-convert/pkg/transferio"
+)
+
+// ReaderOptions are the options of raw sources.
+type ReaderOptions struct {
+	// BufferUnknownSize buffers sources of unknown size to learn their
+	// capacity, which every destination but raw needs.
+	BufferUnknownSize bool `option:"bufferUnknownSize,hint"`
+}
+
+// WriterOptions are the options of raw output.
+type WriterOptions struct {
+	// Prealloc preallocates the output.
+	Prealloc bool `option:"prealloc,hint"`
+	// Compress is gzip, xz or zstd to compress the output.
+	Compress string `option:"compress,hint"`
+	// CompressLevel and CompressThreads tune the compression.
+	CompressLevel   int `option:"compressLevel"`
+	CompressThreads int `option:"compressThreads"`
+}
+
+func init() {
+	diskfmt.Register(&diskfmt.Format{
+		Name:         "raw",
+		Aliases:      []string{"img"},
+		Capabilities: diskfmt.Readable | diskfmt.Writable,
+		Reader: diskfmt.ReaderFor(func(source transferio.StreamRead, opts *ReaderOptions) (diskfmt.StreamReader, error) {
+			rr := NewReader(source)
+			rr.BufferUnknownSize = opts.BufferUnknownSize
+			return rr, nil
+		}),
+		Writer: diskfmt.WriterFor(func(sink transferio.WriteAtStorage, opts *WriterOptions) (diskfmt.StreamWriter, error) {
+			switch opts.Compress {
+			case "":
+				if opts.CompressLevel != 0 || opts.CompressThreads != 0 {
+					return nil, errors.New("compression level and threads are only supported for compressed raw output")
+				}
+			case transferio.CompressionGzip, transferio.CompressionXz, transferio.CompressionZstd:
+				cw, err := transferio.NewCompressWrite(sink, opts.Compress, transferio.CompressOptions{
+					Level:       opts.CompressLevel,
+					Concurrency: opts.CompressThreads,
+				})
+				if err != nil {
+					return nil, err
+				}
+				sink = cw
+			default:
+				return nil, errors.New("unsupported raw compression: " + opts.Compress)
+			}
+			return NewWriter(sink, opts.Prealloc), nil
+		}),
+	})
+}
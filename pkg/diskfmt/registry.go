@@ -0,0 +1,336 @@
+package diskfmt
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"disk-stream-convert/pkg/transferio"
+)
+
+// Capabilities describe what a format supports.
+type Capabilities uint
+
+const (
+	// Readable formats have a reader.
+	Readable Capabilities = 1 << iota
+	// Writable formats have a writer.
+	Writable
+	// NeedsSeekableSink is set for writers that patch metadata after the data
+	// and so need a sink that supports random writes.
+	NeedsSeekableSink
+	// NeedsRandomAccessSource is set for readers that may read the source out
+	// of order; ResolveSource buffers sources without random access to a
+	// temporary file for them.
+	NeedsRandomAccessSource
+)
+
+// Params are reader or writer options given by name, as the command line and
+// the HTTP service collect them. Zero values are unset.
+type Params map[string]any
+
+// NoOptions are the options of readers and writers that take none.
+type NoOptions struct{}
+
+// ReaderConstructor creates the readers of a format; see ReaderFor.
+type ReaderConstructor struct {
+	options reflect.Type
+	create  func(transferio.StreamRead, any) (StreamReader, error)
+}
+
+// ReaderFor returns the constructor of readers that take options of type O, a
+// struct defined by the format package. Fields tagged `option:"name"` can be
+// set by name from Params, which is an error for formats without the option;
+// `option:"name,hint"` marks options a program may pass to every format,
+// which those without it ignore.
+func ReaderFor[O any](create func(source transferio.StreamRead, opts *O) (StreamReader, error)) *ReaderConstructor {
+	return &ReaderConstructor{
+		options: reflect.TypeOf((*O)(nil)).Elem(),
+		create: func(source transferio.StreamRead, opts any) (StreamReader, error) {
+			return create(source, opts.(*O))
+		},
+	}
+}
+
+// WriterConstructor creates the writers of a format; see WriterFor.
+type WriterConstructor struct {
+	options reflect.Type
+	create  func(transferio.WriteAtStorage, any) (StreamWriter, error)
+}
+
+// WriterFor returns the constructor of writers that take options of type O,
+// tagged like those of ReaderFor.
+func WriterFor[O any](create func(sink transferio.WriteAtStorage, opts *O) (StreamWriter, error)) *WriterConstructor {
+	return &WriterConstructor{
+		options: reflect.TypeOf((*O)(nil)).Elem(),
+		create: func(sink transferio.WriteAtStorage, opts any) (StreamWriter, error) {
+			return create(sink, opts.(*O))
+		},
+	}
+}
+
+// Format describes a disk image format. Formats register themselves from the
+// init function of their package, so a program supports the formats whose
+// packages it imports; importing disk-stream-convert/pkg/diskfmt/all adds
+// them all.
+type Format struct {
+	// Name is the canonical name, Aliases other names it is looked up by.
+	Name    string
+	Aliases []string
+	// Capabilities tell whether there is a reader and a writer and what they
+	// need.
+	Capabilities Capabilities
+	// Extension replaces that of the source file name in the name of the
+	// output, which keeps its extension if this is empty.
+	Extension string
+	// SeekableSubformats lists the writer subformats that need a seekable
+	// sink, for formats that do not always need one; "" is the default
+	// subformat.
+	SeekableSubformats []string
+	// RandomAccessSubformats lists the reader subformats that need a source
+	// with random access, for formats that do not always need one.
+	RandomAccessSubformats []string
+	// Reader and Writer create the readers and the writers of the format.
+	Reader *ReaderConstructor
+	Writer *WriterConstructor
+}
+
+// Has reports whether the format has all capabilities in c.
+func (f *Format) Has(c Capabilities) bool {
+	return f.Capabilities&c == c
+}
+
+// NeedsSeekableSink reports whether writing the subformat needs a sink that
+// supports random writes.
+func (f *Format) NeedsSeekableSink(subformat string) bool {
+	return f.Has(NeedsSeekableSink) || slices.Contains(f.SeekableSubformats, subformat)
+}
+
+// NeedsRandomAccessSource reports whether reading the subformat needs a
+// source with random access.
+func (f *Format) NeedsRandomAccessSource(subformat string) bool {
+	return f.Has(NeedsRandomAccessSource) || slices.Contains(f.RandomAccessSubformats, subformat)
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]*Format{}
+	formats    []*Format
+)
+
+// Register adds a format to the registry. It panics if the name or an alias
+// is already taken, or the format has neither a reader nor a writer.
+func Register(f *Format) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if f.Has(Readable) != (f.Reader != nil) || f.Has(Writable) != (f.Writer != nil) || f.Capabilities&(Readable|Writable) == 0 {
+		panic("diskfmt: format " + f.Name + " does not match its capabilities")
+	}
+	for _, name := range append([]string{f.Name}, f.Aliases...) {
+		if _, dup := registry[name]; dup || name == Auto {
+			panic("diskfmt: format " + name + " registered twice")
+		}
+		registry[name] = f
+	}
+	formats = append(formats, f)
+	sort.Slice(formats, func(i, j int) bool { return formats[i].Name < formats[j].Name })
+}
+
+// Lookup returns the format registered under name or one of its aliases.
+func Lookup(name string) (*Format, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	f, ok := registry[name]
+	return f, ok
+}
+
+// Formats returns the registered formats sorted by name.
+func Formats() []*Format {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	return slices.Clone(formats)
+}
+
+// Names returns the names of the registered formats with all capabilities in
+// c, sorted.
+func Names(c Capabilities) []string {
+	var names []string
+	for _, f := range Formats() {
+		if f.Has(c) {
+			names = append(names, f.Name)
+		}
+	}
+	return names
+}
+
+// NewReader creates a reader for the named source format. opts are the
+// reader options of the format, such as *vmdk.ReaderOptions, or Params to set
+// them by name; nil selects the defaults. The source is read as it is, see
+// ResolveSource to remove its compression.
+func NewReader(name string, source transferio.StreamRead, opts any) (StreamReader, error) {
+	f, ok := Lookup(name)
+	if !ok || f.Reader == nil {
+		return nil, fmt.Errorf("unsupported source format: %s", name)
+	}
+	opts, err := newOptions(f.Name, f.Reader.options, opts, func(f *Format) reflect.Type {
+		if f.Reader == nil {
+			return nil
+		}
+		return f.Reader.options
+	}, "sources")
+	if err != nil {
+		return nil, err
+	}
+	return f.Reader.create(source, opts)
+}
+
+// NewWriter creates a writer for the named destination format, with opts as
+// for NewReader.
+func NewWriter(name string, sink transferio.WriteAtStorage, opts any) (StreamWriter, error) {
+	f, ok := Lookup(name)
+	if !ok || f.Writer == nil {
+		return nil, fmt.Errorf("unsupported destination format: %s", name)
+	}
+	opts, err := newOptions(f.Name, f.Writer.options, opts, func(f *Format) reflect.Type {
+		if f.Writer == nil {
+			return nil
+		}
+		return f.Writer.options
+	}, "destinations")
+	if err != nil {
+		return nil, err
+	}
+	return f.Writer.create(sink, opts)
+}
+
+// newOptions returns opts as a pointer to options of type t, the type the
+// constructors of the named format take, or of the type options returns for
+// the other formats.
+func newOptions(name string, t reflect.Type, opts any, options func(*Format) reflect.Type, kind string) (any, error) {
+	switch o := opts.(type) {
+	case nil:
+		return reflect.New(t).Interface(), nil
+	case Params:
+		v := reflect.New(t)
+		if err := setParams(v.Elem(), o, options, kind); err != nil {
+			return nil, err
+		}
+		return v.Interface(), nil
+	}
+	if reflect.TypeOf(opts) != reflect.PointerTo(t) {
+		return nil, fmt.Errorf("%s %s take options of type *%s, not %T", name, kind, t, opts)
+	}
+	return opts, nil
+}
+
+// setParams sets the fields of v tagged with the names in params. An option
+// v does not have is an error naming the formats that have it, unless one of
+// them marks it as a hint.
+func setParams(v reflect.Value, params Params, options func(*Format) reflect.Type, kind string) error {
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := reflect.ValueOf(params[key])
+		if !value.IsValid() || value.IsZero() {
+			continue
+		}
+		index, _, ok := optionField(v.Type(), key)
+		if !ok {
+			var names []string
+			hint := false
+			for _, f := range Formats() {
+				if t := options(f); t != nil {
+					if _, h, ok := optionField(t, key); ok {
+						names = append(names, f.Name)
+						hint = hint || h
+					}
+				}
+			}
+			switch {
+			case hint:
+				continue
+			case len(names) == 0:
+				return fmt.Errorf("unknown option %s", key)
+			}
+			return fmt.Errorf("%s is only supported for %s %s", key, joinNames(names), kind)
+		}
+		field := v.Field(index)
+		switch {
+		case value.Type().AssignableTo(field.Type()):
+			field.Set(value)
+		case value.Kind() == field.Kind() && value.CanConvert(field.Type()):
+			field.Set(value.Convert(field.Type()))
+		default:
+			return fmt.Errorf("invalid %s option: %v", key, params[key])
+		}
+	}
+	return nil
+}
+
+// optionField returns the index of the field of the struct type t tagged with
+// the option name, and whether the option is a hint.
+func optionField(t reflect.Type, name string) (index int, hint bool, ok bool) {
+	for i := 0; i < t.NumField(); i++ {
+		tag, mod, _ := strings.Cut(t.Field(i).Tag.Get("option"), ",")
+		if tag == name {
+			return i, mod == "hint", true
+		}
+	}
+	return 0, false, false
+}
+
+// joinNames joins names as in "a, b and c".
+func joinNames(names []string) string {
+	if len(names) == 1 {
+		return names[0]
+	}
+	return strings.Join(names[:len(names)-1], ", ") + " and " + names[len(names)-1]
+}
+
+// Auto is the source format that is detected by Probe.
+const Auto = "auto"
+
+// ResolveSource returns the source format and the source to read it from,
+// decompressed according to decompress. For Auto the format is probed, the
+// result holds what Probe found and the subformat of vmdk images is set in
+// params unless they have one; for other names only Format and Source are
+// set. Sources without random access are buffered to a temporary file for
+// formats that need it.
+func ResolveSource(ctx context.Context, name string, source transferio.StreamRead, decompress string, params Params) (*Probed, error) {
+	var p *Probed
+	if name == Auto {
+		var err error
+		if p, err = Probe(ctx, source, decompress); err != nil {
+			return nil, err
+		}
+		if subformat, _ := params["subformat"].(string); p.Format == "vmdk" && subformat == "" && params != nil {
+			params["subformat"] = p.Subformat
+		}
+	} else {
+		p = &Probed{Format: name, Source: source}
+		if f, ok := Lookup(name); !ok || f.Reader == nil {
+			// Left to NewReader to report.
+			return p, nil
+		}
+		var err error
+		if p.Source, err = transferio.Decompress(source, decompress); err != nil {
+			return nil, err
+		}
+	}
+	subformat, _ := params["subformat"].(string)
+	if f, ok := Lookup(p.Format); ok && f.NeedsRandomAccessSource(subformat) {
+		spooled, err := transferio.Spool(ctx, p.Source)
+		if err != nil {
+			return nil, err
+		}
+		p.Source = spooled
+	}
+	return p, nil
+}
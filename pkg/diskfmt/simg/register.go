@@ -0,0 +1,32 @@
+package simg
+
+import (
+	"fmt"
+
+	"disk-stream-convert/pkg/diskfmt"
+	"disk-stream-convert/pkg/transferio"
+)
+
+// WriterOptions are the options of simg output.
+type WriterOptions struct {
+	// BlockSize is the block size, a multiple of 4; 4096 if 0.
+	BlockSize int `option:"blockSize"`
+}
+
+func init() {
+	diskfmt.Register(&diskfmt.Format{
+		Name:         "simg",
+		Aliases:      []string{"android-sparse"},
+		Capabilities: diskfmt.Readable | diskfmt.Writable,
+		Extension:    ".simg",
+		Reader: diskfmt.ReaderFor(func(source transferio.StreamRead, _ *diskfmt.NoOptions) (diskfmt.StreamReader, error) {
+			return NewReader(source), nil
+		}),
+		Writer: diskfmt.WriterFor(func(sink transferio.WriteAtStorage, opts *WriterOptions) (diskfmt.StreamWriter, error) {
+			if opts.BlockSize < 0 || opts.BlockSize%4 != 0 || opts.BlockSize > 64<<20 {
+				return nil, fmt.Errorf("invalid simg block size %d", opts.BlockSize)
+			}
+			return NewWriter(sink, uint32(opts.BlockSize)), nil
+		}),
+	})
+}
@@ -0,0 +1,277 @@
+package simg
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+
+	simgfmt "disk-stream-convert/format/simg"
+	"disk-stream-convert/pkg/transferio"
+)
+
+// Reader reads Android sparse images as written by img2simg and the Android
+// build. The chunks are read in order, so non-seekable sources work. RAW
+// chunks are returned as they are and FILL chunks expanded; DONT_CARE chunks
+// and FILL chunks of zeros are holes and read as zeros. CRC32 chunks are
+// checked against the data read up to them.
+type Reader struct {
+	Source transferio.StreamRead
+	rc     io.ReadCloser
+	br     *bufio.Reader
+
+	header   *simgfmt.FileHeader
+	capacity int64
+
+	// chunks is the number of chunks read, block the first block after them.
+	chunks uint32
+	block  uint32
+	crc    uint32
+
+	// The data chunk being returned and what remains of it.
+	chunkType   simgfmt.ChunkType
+	fillValue   []byte
+	chunkOffset int64
+	chunkRemain int64
+}
+
+func NewReader(source transferio.StreamRead) *Reader {
+	return &Reader{Source: source}
+}
+
+func (r *Reader) Open(ctx context.Context) error {
+	type openable interface {
+		Open(ctx context.Context) (io.ReadCloser, error)
+	}
+	if o, ok := r.Source.(openable); ok {
+		rc, err := o.Open(ctx)
+		if err != nil {
+			return err
+		}
+		r.rc = rc
+	} else {
+		r.rc = r.Source
+	}
+	r.br = bufio.NewReaderSize(r.rc, 1<<20)
+
+	head := make([]byte, simgfmt.FileHeaderSize)
+	if _, err := io.ReadFull(r.br, head); err != nil {
+		return fmt.Errorf("failed to read sparse image header: %w", err)
+	}
+	h, err := simgfmt.ParseFileHeader(head)
+	if err != nil {
+		return err
+	}
+	if _, err := r.br.Discard(int(h.FileHeaderSize) - simgfmt.FileHeaderSize); err != nil {
+		return fmt.Errorf("failed to read sparse image header: %w", err)
+	}
+	r.header = h
+	r.capacity = int64(h.TotalBlocks) * int64(h.BlockSize)
+	return nil
+}
+
+// nextChunk reads chunk headers up to the next one with data to return.
+// Holes and CRC32 chunks are consumed on the way.
+func (r *Reader) nextChunk() error {
+	h := r.header
+	buf := make([]byte, h.ChunkHeaderSize)
+	for {
+		if r.chunks == h.TotalChunks {
+			if r.block != h.TotalBlocks {
+				return fmt.Errorf("sparse image chunks cover %d of %d blocks", r.block, h.TotalBlocks)
+			}
+			return io.EOF
+		}
+		if _, err := io.ReadFull(r.br, buf); err != nil {
+			return fmt.Errorf("failed to read sparse image chunk %d: %w", r.chunks, eofUnexpected(err))
+		}
+		c, err := simgfmt.ParseChunkHeader(buf)
+		if err != nil {
+			return err
+		}
+		dataSize := c.Type.DataSize(c.Blocks, h.BlockSize)
+		if dataSize < 0 {
+			return fmt.Errorf("sparse image chunk %d has %s type", r.chunks, c.Type)
+		}
+		if int64(c.TotalSize) != int64(h.ChunkHeaderSize)+dataSize {
+			return fmt.Errorf("sparse image %s chunk %d has invalid size %d", c.Type, r.chunks, c.TotalSize)
+		}
+		if c.Type == simgfmt.ChunkCRC32 && c.Blocks != 0 {
+			return fmt.Errorf("sparse image crc32 chunk %d covers %d blocks", r.chunks, c.Blocks)
+		}
+		if uint64(r.block)+uint64(c.Blocks) > uint64(h.TotalBlocks) {
+			return fmt.Errorf("sparse image chunk %d ends beyond the %d blocks of the disk", r.chunks, h.TotalBlocks)
+		}
+		r.chunks++
+
+		var value []byte
+		if dataSize == 4 {
+			value = make([]byte, 4)
+			if _, err := io.ReadFull(r.br, value); err != nil {
+				return fmt.Errorf("failed to read sparse image chunk %d: %w", r.chunks-1, eofUnexpected(err))
+			}
+		}
+		offset := int64(r.block) * int64(h.BlockSize)
+		length := int64(c.Blocks) * int64(h.BlockSize)
+		r.block += c.Blocks
+
+		switch c.Type {
+		case simgfmt.ChunkCRC32:
+			if want := binary.LittleEndian.Uint32(value); want != r.crc {
+				return fmt.Errorf("sparse image checksum mismatch before block %d: %#08x, expected %#08x", r.block, r.crc, want)
+			}
+			continue
+		case simgfmt.ChunkDontCare:
+			r.crc = simgfmt.CRC32Zeros(r.crc, length)
+			continue
+		case simgfmt.ChunkFill:
+			if binary.LittleEndian.Uint32(value) == 0 {
+				r.crc = simgfmt.CRC32Zeros(r.crc, length)
+				continue
+			}
+		}
+		if length == 0 {
+			continue
+		}
+		r.chunkType = c.Type
+		r.fillValue = value
+		r.chunkOffset = offset
+		r.chunkRemain = length
+		return nil
+	}
+}
+
+func (r *Reader) Read(p []byte) (int, int64, error) {
+	if r.chunkRemain == 0 {
+		if err := r.nextChunk(); err != nil {
+			if err == io.EOF {
+				return 0, r.capacity, io.EOF
+			}
+			return 0, 0, err
+		}
+	}
+
+	if int64(len(p)) > r.chunkRemain {
+		p = p[:r.chunkRemain]
+	}
+	if r.chunkType == simgfmt.ChunkRaw {
+		if _, err := io.ReadFull(r.br, p); err != nil {
+			return 0, 0, fmt.Errorf("failed to read sparse image data: %w", eofUnexpected(err))
+		}
+	} else {
+		// Chunks start on a block boundary, so the value repeats from the
+		// start of the chunk.
+		phase := int(r.chunkOffset % 4)
+		for i := range p {
+			p[i] = r.fillValue[(phase+i)%4]
+		}
+	}
+	r.crc = crc32.Update(r.crc, crc32.IEEETable, p)
+
+	off := r.chunkOffset
+	r.chunkOffset += int64(len(p))
+	r.chunkRemain -= int64(len(p))
+	return len(p), off, nil
+}
+
+func (r *Reader) Capacity() int64 {
+	return r.capacity
+}
+
+func (r *Reader) Close() error {
+	if r.rc != nil {
+		return r.rc.Close()
+	}
+	return nil
+}
+
+func eofUnexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Writer writes Android sparse images that fastboot flashes and simg2img
+// expands. Each chunk header is written once its chunk is complete, so on
+// sinks without random writes, such as HTTP downloads, the image is spooled
+// to a temporary file and copied to the sink by Close.
+type Writer struct {
+	Sink transferio.WriteAtStorage
+	// BlockSize is the block size of the image, simgfmt.DefaultBlockSize if
+	// zero.
+	BlockSize uint32
+	// TempDir is the directory of the spooled image, the system default if
+	// empty.
+	TempDir string
+
+	sw    *simgfmt.SimgWriter
+	spool *os.File
+}
+
+func NewWriter(sink transferio.WriteAtStorage, blockSize uint32) *Writer {
+	return &Writer{Sink: sink, BlockSize: blockSize}
+}
+
+func (w *Writer) Open(ctx context.Context, capacity int64) error {
+	var out io.WriterAt = w.Sink
+	if !transferio.SupportsRandomWrite(w.Sink) {
+		spool, err := os.CreateTemp(w.TempDir, "simg-*.img")
+		if err != nil {
+			return fmt.Errorf("failed to create simg spool file: %w", err)
+		}
+		w.spool = spool
+		out = spool
+	}
+	sw, err := simgfmt.NewSimgWriter(out, uint64(capacity), simgfmt.WriterOptions{BlockSize: w.BlockSize})
+	if err != nil {
+		w.removeSpool()
+		return err
+	}
+	w.sw = sw
+	return nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	return w.sw.Write(p)
+}
+
+func (w *Writer) Close() error {
+	defer w.removeSpool()
+	if w.sw != nil {
+		if err := w.sw.Close(); err != nil {
+			w.Sink.Close()
+			return err
+		}
+	}
+	if w.spool != nil && w.sw != nil {
+		if _, err := io.Copy(&sinkWriter{sink: w.Sink}, io.NewSectionReader(w.spool, 0, w.sw.Size())); err != nil {
+			w.Sink.Close()
+			return fmt.Errorf("failed to write simg image: %w", err)
+		}
+	}
+	return w.Sink.Close()
+}
+
+func (w *Writer) removeSpool() {
+	if w.spool != nil {
+		w.spool.Close()
+		os.Remove(w.spool.Name())
+		w.spool = nil
+	}
+}
+
+// sinkWriter writes sequentially to the sink.
+type sinkWriter struct {
+	sink transferio.WriteAtStorage
+	off  int64
+}
+
+func (s *sinkWriter) Write(p []byte) (int, error) {
+	n, err := s.sink.WriteAt(p, s.off)
+	s.off += int64(n)
+	return n, err
+}
@@ -0,0 +1,20 @@
+package vdi
+
+import (
+	"disk-stream-convert/pkg/diskfmt"
+	"disk-stream-convert/pkg/transferio"
+)
+
+func init() {
+	diskfmt.Register(&diskfmt.Format{
+		Name:         "vdi",
+		Capabilities: diskfmt.Readable | diskfmt.Writable | diskfmt.NeedsSeekableSink | diskfmt.NeedsRandomAccessSource,
+		Extension:    ".vdi",
+		Reader: diskfmt.ReaderFor(func(source transferio.StreamRead, _ *diskfmt.NoOptions) (diskfmt.StreamReader, error) {
+			return NewReader(source), nil
+		}),
+		Writer: diskfmt.WriterFor(func(sink transferio.WriteAtStorage, _ *diskfmt.NoOptions) (diskfmt.StreamWriter, error) {
+			return NewWriter(sink), nil
+		}),
+	})
+}
@@ -0,0 +1,175 @@
+package vdi
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	vdifmt "disk-stream-convert/format/vdi"
+	"disk-stream-convert/pkg/diskfmt/internal/blockio"
+	"disk-stream-convert/pkg/transferio"
+)
+
+// Reader reads dynamic and fixed VDI images. Only allocated blocks are
+// returned, in disk order; unallocated and zero blocks read as zeros. Sources
+// with random access are read block by block; non-seekable sources work as
+// long as the blocks are stored in disk order, which is how images written
+// sequentially are laid out.
+type Reader struct {
+	Source transferio.StreamRead
+	src    *blockio.Source
+
+	header   *vdifmt.Header
+	capacity int64
+
+	// Allocated blocks in disk order and the current one.
+	blocks      []blockio.Block
+	current     blockio.Block
+	blockRemain int64
+	blockOffset int64
+}
+
+// blockMapChunkSize is the amount of the block map read at a time.
+const blockMapChunkSize = 64 << 10
+
+func NewReader(source transferio.StreamRead) *Reader {
+	return &Reader{Source: source}
+}
+
+func (r *Reader) Open(ctx context.Context) error {
+	src, err := blockio.Open(ctx, r.Source, "VDI")
+	if err != nil {
+		return err
+	}
+	r.src = src
+
+	head := make([]byte, vdifmt.HeaderSize)
+	if err := r.src.ReadFullAt(head, 0); err != nil {
+		return fmt.Errorf("failed to read VDI header: %w", err)
+	}
+	h, err := vdifmt.ParseHeader(head)
+	if err != nil {
+		return err
+	}
+	switch h.ImageType {
+	case vdifmt.ImageTypeDynamic, vdifmt.ImageTypeFixed:
+	default:
+		return fmt.Errorf("%s VDI images are not supported", h.ImageType)
+	}
+	r.header = h
+	r.capacity = int64(h.DiskSize)
+
+	if r.capacity < 0 {
+		return fmt.Errorf("invalid VDI disk size %d", h.DiskSize)
+	}
+	// Like qemu, the block map must have exactly one entry per block of the
+	// disk.
+	blockSize := int64(h.BlockSize)
+	blocks := (r.capacity + blockSize - 1) / blockSize
+	if int64(h.BlocksInImage) != blocks {
+		return fmt.Errorf("VDI block map with %d blocks does not match the disk size %d", h.BlocksInImage, h.DiskSize)
+	}
+	// The map is read a chunk at a time, so that a crafted disk size cannot
+	// force a large allocation; memory grows with the entries actually
+	// present in the source.
+	blockMap := make([]byte, min(blocks*4, blockMapChunkSize))
+	for i := int64(0); i < blocks; {
+		n := min(blocks-i, int64(len(blockMap))/4)
+		if err := r.src.ReadFullAt(blockMap[:n*4], int64(h.OffsetBlocks)+i*4); err != nil {
+			return fmt.Errorf("failed to read VDI block map: %w", err)
+		}
+		for j := int64(0); j < n; j++ {
+			entry := binary.LittleEndian.Uint32(blockMap[j*4:])
+			if entry == vdifmt.BlockUnallocated || entry == vdifmt.BlockZero {
+				continue
+			}
+			if entry >= h.BlocksInImage {
+				return fmt.Errorf("VDI block %d points to invalid entry %d", i+j, entry)
+			}
+			r.blocks = append(r.blocks, blockio.Block{Index: i + j, Offset: h.BlockOffset(entry)})
+		}
+		i += n
+	}
+	if err := r.src.CheckOrder(r.blocks); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *Reader) Read(p []byte) (int, int64, error) {
+	blockSize := int64(r.header.BlockSize)
+	if r.blockRemain == 0 {
+		if len(r.blocks) == 0 {
+			return 0, r.capacity, io.EOF
+		}
+		r.current = r.blocks[0]
+		r.blocks = r.blocks[1:]
+		r.blockOffset = r.current.Index * blockSize
+		r.blockRemain = blockSize
+		// The last block may extend past the end of the disk.
+		if r.blockOffset+r.blockRemain > r.capacity {
+			r.blockRemain = r.capacity - r.blockOffset
+		}
+	}
+
+	if int64(len(p)) > r.blockRemain {
+		p = p[:r.blockRemain]
+	}
+	inBlock := r.blockOffset - r.current.Index*blockSize
+	if err := r.src.ReadFullAt(p, r.current.Offset+inBlock); err != nil {
+		return 0, 0, fmt.Errorf("failed to read VDI block: %w", err)
+	}
+
+	off := r.blockOffset
+	r.blockOffset += int64(len(p))
+	r.blockRemain -= int64(len(p))
+	return len(p), off, nil
+}
+
+func (r *Reader) Capacity() int64 {
+	return r.capacity
+}
+
+func (r *Reader) Close() error {
+	if r.src != nil {
+		return r.src.Close()
+	}
+	return nil
+}
+
+type Writer struct {
+	Sink transferio.WriteAtStorage
+	vw   *vdifmt.VDIWriter
+}
+
+func NewWriter(sink transferio.WriteAtStorage) *Writer {
+	return &Writer{Sink: sink}
+}
+
+func (w *Writer) Open(ctx context.Context, capacity int64) error {
+	// The block map is written after the blocks it points to.
+	if !transferio.SupportsRandomWrite(w.Sink) {
+		return fmt.Errorf("vdi output requires a destination that supports random writes")
+	}
+	vw, err := vdifmt.NewVDIWriter(w.Sink, uint64(capacity), vdifmt.WriterOptions{})
+	if err != nil {
+		return err
+	}
+	w.vw = vw
+	return nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	return w.vw.Write(p)
+}
+
+func (w *Writer) Close() error {
+	if w.vw != nil {
+		if err := w.vw.Close(); err != nil {
+			w.Sink.Close()
+			return err
+		}
+	}
+	return w.Sink.Close()
+}
@@ -0,0 +1,33 @@
+package vhd
+
+import (
+	"errors"
+
+	"disk-stream-convert/pkg/diskfmt"
+	"disk-stream-convert/pkg/transferio"
+)
+
+// WriterOptions are the options of vhd output.
+type WriterOptions struct {
+	// Subformat is SubformatFixed or SubformatDynamic, the default.
+	Subformat string `option:"subformat"`
+}
+
+func init() {
+	diskfmt.Register(&diskfmt.Format{
+		Name:               "vhd",
+		Aliases:            []string{"vpc"},
+		Capabilities:       diskfmt.Readable | diskfmt.Writable | diskfmt.NeedsRandomAccessSource,
+		Extension:          ".vhd",
+		SeekableSubformats: []string{"", SubformatDynamic},
+		Reader: diskfmt.ReaderFor(func(source transferio.StreamRead, _ *diskfmt.NoOptions) (diskfmt.StreamReader, error) {
+			return NewReader(source), nil
+		}),
+		Writer: diskfmt.WriterFor(func(sink transferio.WriteAtStorage, opts *WriterOptions) (diskfmt.StreamWriter, error) {
+			if opts.Subformat != "" && opts.Subformat != SubformatFixed && opts.Subformat != SubformatDynamic {
+				return nil, errors.New("unsupported vhd subformat: " + opts.Subformat)
+			}
+			return NewWriter(sink, opts.Subformat), nil
+		}),
+	})
+}
@@ -0,0 +1,312 @@
+package vhd
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	vhdfmt "disk-stream-convert/format/vhd"
+	"disk-stream-convert/pkg/diskfmt/internal/blockio"
+	"disk-stream-convert/pkg/transferio"
+)
+
+// Reader reads fixed and dynamic VHD images. Only allocated blocks of dynamic
+// images are returned, in disk order. Sources with random access are read
+// block by block; non-seekable sources work as long as the BAT precedes the
+// blocks and the blocks are stored in disk order, which is how images written
+// sequentially are laid out.
+type Reader struct {
+	Source transferio.StreamRead
+	src    *blockio.Source
+
+	footer   *vhdfmt.Footer
+	dynamic  *vhdfmt.DynamicHeader
+	capacity int64
+
+	// Fixed images: the first sector, read to tell the subformats apart.
+	head   []byte
+	offset int64
+
+	// Dynamic images: allocated blocks in disk order and the current one.
+	blocks      []blockio.Block
+	current     blockio.Block
+	bitmap      []byte
+	blockRemain int64
+	blockOffset int64
+}
+
+// batChunkSize is the amount of the BAT read at a time.
+const batChunkSize = 64 << 10
+
+func NewReader(source transferio.StreamRead) *Reader {
+	return &Reader{Source: source}
+}
+
+func (r *Reader) Open(ctx context.Context) error {
+	src, err := blockio.Open(ctx, r.Source, "VHD")
+	if err != nil {
+		return err
+	}
+	r.src = src
+
+	// Dynamic images start with a copy of the footer, fixed images with data.
+	head := make([]byte, vhdfmt.FooterSize)
+	if err := r.src.ReadFullAt(head, 0); err != nil {
+		return fmt.Errorf("failed to read VHD image: %w", err)
+	}
+	if string(head[:len(vhdfmt.FooterCookie)]) == vhdfmt.FooterCookie {
+		return r.openDynamic(head)
+	}
+	r.head = head
+	return r.openFixed()
+}
+
+func (r *Reader) openFixed() error {
+	size, ok := r.Source.Size()
+	if !ok || size < vhdfmt.FooterSize {
+		return fmt.Errorf("fixed VHD images need a source of known size")
+	}
+	r.capacity = size - vhdfmt.FooterSize
+
+	// With random access the footer is checked up front, otherwise once the
+	// data has been streamed.
+	if r.src.RandomAccess() {
+		raw := make([]byte, vhdfmt.FooterSize)
+		if err := r.src.ReadFullAt(raw, r.capacity); err != nil {
+			return fmt.Errorf("failed to read VHD footer: %w", err)
+		}
+		footer, err := r.checkFixedFooter(raw)
+		if err != nil {
+			return err
+		}
+		r.footer = footer
+	}
+	return nil
+}
+
+func (r *Reader) checkFixedFooter(raw []byte) (*vhdfmt.Footer, error) {
+	footer, err := vhdfmt.ParseFooter(raw)
+	if err != nil {
+		return nil, err
+	}
+	if footer.DiskType != vhdfmt.DiskTypeFixed {
+		return nil, fmt.Errorf("VHD footer at the end of the image is %s, want fixed", footer.DiskType)
+	}
+	if int64(footer.CurrentSize) != r.capacity {
+		return nil, fmt.Errorf("VHD footer size %d does not match the data size %d", footer.CurrentSize, r.capacity)
+	}
+	return footer, nil
+}
+
+func (r *Reader) openDynamic(raw []byte) error {
+	footer, err := vhdfmt.ParseFooter(raw)
+	if err != nil {
+		return err
+	}
+	switch footer.DiskType {
+	case vhdfmt.DiskTypeDynamic:
+	case vhdfmt.DiskTypeDifferencing:
+		return fmt.Errorf("differencing VHD images are not supported")
+	default:
+		return fmt.Errorf("unexpected %s VHD footer at the start of the image", footer.DiskType)
+	}
+	r.footer = footer
+	r.capacity = int64(footer.CurrentSize)
+
+	raw = make([]byte, vhdfmt.DynamicHeaderSize)
+	if err := r.src.ReadFullAt(raw, int64(footer.DataOffset)); err != nil {
+		return fmt.Errorf("failed to read VHD dynamic header: %w", err)
+	}
+	if r.dynamic, err = vhdfmt.ParseDynamicHeader(raw); err != nil {
+		return err
+	}
+
+	if r.capacity < 0 {
+		return fmt.Errorf("invalid VHD disk size %d", footer.CurrentSize)
+	}
+	blockSize := int64(r.dynamic.BlockSize)
+	entries := (r.capacity + blockSize - 1) / blockSize
+	if int64(r.dynamic.MaxTableEntries) < entries {
+		return fmt.Errorf("VHD BAT with %d entries does not cover the disk", r.dynamic.MaxTableEntries)
+	}
+	// Only the entries covering the disk are read, a chunk at a time, so that
+	// the table size in the header cannot force a large allocation; memory
+	// grows with the entries actually present in the source.
+	bat := make([]byte, min(entries*4, batChunkSize))
+	for i := int64(0); i < entries; {
+		n := min(entries-i, int64(len(bat))/4)
+		if err := r.src.ReadFullAt(bat[:n*4], int64(r.dynamic.TableOffset)+i*4); err != nil {
+			return fmt.Errorf("failed to read VHD BAT: %w", err)
+		}
+		for j := int64(0); j < n; j++ {
+			if entry := binary.BigEndian.Uint32(bat[j*4:]); entry != vhdfmt.UnallocatedBlock {
+				r.blocks = append(r.blocks, blockio.Block{Index: i + j, Offset: int64(entry) * vhdfmt.SectorSize})
+			}
+		}
+		i += n
+	}
+	if err := r.src.CheckOrder(r.blocks); err != nil {
+		return err
+	}
+
+	r.bitmap = make([]byte, r.dynamic.BitmapSize())
+	return nil
+}
+
+func (r *Reader) Read(p []byte) (int, int64, error) {
+	if r.dynamic != nil {
+		return r.readDynamic(p)
+	}
+	return r.readFixed(p)
+}
+
+func (r *Reader) readFixed(p []byte) (int, int64, error) {
+	off := r.offset
+	if off >= r.capacity {
+		return 0, off, io.EOF
+	}
+	if int64(len(p)) > r.capacity-off {
+		p = p[:r.capacity-off]
+	}
+
+	n := 0
+	if off < int64(len(r.head)) {
+		n = copy(p, r.head[off:])
+	}
+	if n < len(p) {
+		if err := r.src.ReadFullAt(p[n:], off+int64(n)); err != nil {
+			return 0, off, fmt.Errorf("failed to read VHD data: %w", err)
+		}
+		n = len(p)
+	}
+	r.offset += int64(n)
+
+	if r.offset == r.capacity {
+		if r.footer == nil {
+			raw := make([]byte, vhdfmt.FooterSize)
+			if err := r.src.ReadFullAt(raw, r.capacity); err != nil {
+				return n, off, fmt.Errorf("failed to read VHD footer: %w", err)
+			}
+			footer, err := r.checkFixedFooter(raw)
+			if err != nil {
+				return n, off, err
+			}
+			r.footer = footer
+		}
+		return n, off, io.EOF
+	}
+	return n, off, nil
+}
+
+func (r *Reader) readDynamic(p []byte) (int, int64, error) {
+	blockSize := int64(r.dynamic.BlockSize)
+	if r.blockRemain == 0 {
+		if len(r.blocks) == 0 {
+			return 0, r.capacity, io.EOF
+		}
+		r.current = r.blocks[0]
+		r.blocks = r.blocks[1:]
+		if err := r.src.ReadFullAt(r.bitmap, r.current.Offset); err != nil {
+			return 0, 0, fmt.Errorf("failed to read VHD block bitmap: %w", err)
+		}
+		r.blockOffset = r.current.Index * blockSize
+		r.blockRemain = blockSize
+		// The last block may extend past the end of the disk.
+		if r.blockOffset+r.blockRemain > r.capacity {
+			r.blockRemain = r.capacity - r.blockOffset
+		}
+	}
+
+	if int64(len(p)) > r.blockRemain {
+		p = p[:r.blockRemain]
+	}
+	inBlock := r.blockOffset - r.current.Index*blockSize
+	if err := r.src.ReadFullAt(p, r.current.Offset+r.dynamic.BitmapSize()+inBlock); err != nil {
+		return 0, 0, fmt.Errorf("failed to read VHD block: %w", err)
+	}
+
+	// Sectors not marked in the bitmap were never written and read as zeros.
+	for i := int64(0); i < int64(len(p)); {
+		sector := (inBlock + i) / vhdfmt.SectorSize
+		end := (sector+1)*vhdfmt.SectorSize - inBlock
+		if end > int64(len(p)) {
+			end = int64(len(p))
+		}
+		if r.bitmap[sector/8]&(0x80>>(sector%8)) == 0 {
+			for j := i; j < end; j++ {
+				p[j] = 0
+			}
+		}
+		i = end
+	}
+
+	off := r.blockOffset
+	r.blockOffset += int64(len(p))
+	r.blockRemain -= int64(len(p))
+	return len(p), off, nil
+}
+
+func (r *Reader) Capacity() int64 {
+	return r.capacity
+}
+
+func (r *Reader) Close() error {
+	if r.src != nil {
+		return r.src.Close()
+	}
+	return nil
+}
+
+// Subformats of VHD images written by Writer.
+const (
+	SubformatFixed   = "fixed"
+	SubformatDynamic = "dynamic"
+)
+
+type Writer struct {
+	Sink transferio.WriteAtStorage
+	// Subformat is SubformatFixed or SubformatDynamic, the default.
+	Subformat string
+	vw        *vhdfmt.VHDWriter
+}
+
+func NewWriter(sink transferio.WriteAtStorage, subformat string) *Writer {
+	return &Writer{Sink: sink, Subformat: subformat}
+}
+
+func (w *Writer) Open(ctx context.Context, capacity int64) error {
+	var opts vhdfmt.WriterOptions
+	switch w.Subformat {
+	case SubformatFixed:
+	case SubformatDynamic, "":
+		// The BAT is written after the blocks it points to.
+		if !transferio.SupportsRandomWrite(w.Sink) {
+			return fmt.Errorf("dynamic VHD output requires a destination that supports random writes, use the fixed subformat")
+		}
+		opts.Dynamic = true
+	default:
+		return fmt.Errorf("unsupported VHD subformat %q", w.Subformat)
+	}
+
+	vw, err := vhdfmt.NewVHDWriter(w.Sink, uint64(capacity), opts)
+	if err != nil {
+		return err
+	}
+	w.vw = vw
+	return nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	return w.vw.Write(p)
+}
+
+func (w *Writer) Close() error {
+	if w.vw != nil {
+		if err := w.vw.Close(); err != nil {
+			w.Sink.Close()
+			return err
+		}
+	}
+	return w.Sink.Close()
+}
@@ -0,0 +1,229 @@
+package vhdx
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	vhdxfmt "disk-stream-convert/format/vhdx"
+	"disk-stream-convert/pkg/diskfmt/internal/blockio"
+	"disk-stream-convert/pkg/transferio"
+)
+
+// Reader reads dynamic and fixed VHDX images. Only present blocks are
+// returned, in disk order. Sources with random access are read block by
+// block; non-seekable sources work as long as the metadata region precedes
+// the BAT, both precede the blocks and the blocks are stored in disk order,
+// which is how images written sequentially are laid out.
+type Reader struct {
+	Source transferio.StreamRead
+	src    *blockio.Source
+
+	header   *vhdxfmt.Header
+	metadata *vhdxfmt.Metadata
+	capacity int64
+
+	// Present blocks in disk order and the current one.
+	blocks      []blockio.Block
+	current     blockio.Block
+	blockRemain int64
+	blockOffset int64
+}
+
+func NewReader(source transferio.StreamRead) *Reader {
+	return &Reader{Source: source}
+}
+
+func (r *Reader) Open(ctx context.Context) error {
+	src, err := blockio.Open(ctx, r.Source, "VHDX")
+	if err != nil {
+		return err
+	}
+	r.src = src
+
+	section := make([]byte, vhdxfmt.HeaderSectionSize)
+	if err := r.src.ReadFullAt(section, 0); err != nil {
+		return fmt.Errorf("failed to read VHDX header section: %w", err)
+	}
+	if string(section[:len(vhdxfmt.FileSignature)]) != vhdxfmt.FileSignature {
+		return fmt.Errorf("invalid VHDX file signature")
+	}
+
+	// The current header is the valid one with the higher sequence number.
+	for _, off := range []int{vhdxfmt.Header1Offset, vhdxfmt.Header2Offset} {
+		h, err := vhdxfmt.ParseHeader(section[off : off+vhdxfmt.HeaderSize])
+		if err != nil {
+			continue
+		}
+		if r.header == nil || h.SequenceNumber > r.header.SequenceNumber {
+			r.header = h
+		}
+	}
+	if r.header == nil {
+		return fmt.Errorf("no valid VHDX header")
+	}
+	if r.header.Version != vhdxfmt.Version {
+		return fmt.Errorf("unsupported VHDX version %d", r.header.Version)
+	}
+	if !r.header.LogGUID.IsZero() {
+		return fmt.Errorf("VHDX log has not been replayed, the image was not closed cleanly; open it read-write once with Hyper-V or qemu to replay the log")
+	}
+
+	regions, err := vhdxfmt.ParseRegionTable(section[vhdxfmt.RegionTable1Offset:])
+	if err != nil {
+		if regions, err = vhdxfmt.ParseRegionTable(section[vhdxfmt.RegionTable2Offset:]); err != nil {
+			return fmt.Errorf("no valid VHDX region table: %w", err)
+		}
+	}
+
+	var batRegion, metadataRegion *vhdxfmt.RegionTableEntry
+	for i := range regions {
+		switch regions[i].GUID {
+		case vhdxfmt.BATRegion:
+			batRegion = &regions[i]
+		case vhdxfmt.MetadataRegion:
+			metadataRegion = &regions[i]
+		default:
+			if regions[i].Required&1 != 0 {
+				return fmt.Errorf("unsupported required VHDX region %s", regions[i].GUID)
+			}
+		}
+	}
+	if batRegion == nil || metadataRegion == nil {
+		return fmt.Errorf("VHDX image lacks a BAT or metadata region")
+	}
+
+	// The metadata is read first, it gives the size of the BAT.
+	size, sizeKnown := r.Source.Size()
+	if metadataRegion.Length > vhdxfmt.MaxMetadataRegionSize {
+		return fmt.Errorf("VHDX metadata region of %d bytes exceeds the maximum of %d", metadataRegion.Length, vhdxfmt.MaxMetadataRegionSize)
+	}
+	if sizeKnown && !regionFits(metadataRegion, size) {
+		return fmt.Errorf("VHDX metadata region at %d lies outside the %d byte image", metadataRegion.FileOffset, size)
+	}
+	metadata := make([]byte, metadataRegion.Length)
+	if err := r.src.ReadFullAt(metadata, int64(metadataRegion.FileOffset)); err != nil {
+		return fmt.Errorf("failed to read VHDX metadata region: %w", err)
+	}
+	if r.metadata, err = vhdxfmt.ParseMetadata(metadata); err != nil {
+		return err
+	}
+	if r.metadata.HasParent {
+		return fmt.Errorf("differencing VHDX images are not supported")
+	}
+	r.capacity = int64(r.metadata.VirtualDiskSize)
+
+	batLength := r.metadata.BATEntries() * 8
+	if int64(batRegion.Length) < batLength {
+		return fmt.Errorf("VHDX BAT region is too small for the disk")
+	}
+	if maxLength := (batLength + vhdxfmt.RegionAlignment - 1) &^ (vhdxfmt.RegionAlignment - 1); int64(batRegion.Length) > maxLength {
+		return fmt.Errorf("VHDX BAT region of %d bytes exceeds the %d bytes the disk needs", batRegion.Length, maxLength)
+	}
+	if sizeKnown && !regionFits(batRegion, size) {
+		return fmt.Errorf("VHDX BAT region at %d lies outside the %d byte image", batRegion.FileOffset, size)
+	}
+	bat := make([]byte, batLength)
+	if err := r.src.ReadFullAt(bat, int64(batRegion.FileOffset)); err != nil {
+		return fmt.Errorf("failed to read VHDX BAT region: %w", err)
+	}
+	for i := int64(0); i < r.metadata.PayloadBlocks(); i++ {
+		entry := vhdxfmt.BATEntry(binary.LittleEndian.Uint64(bat[r.metadata.PayloadEntry(i)*8:]))
+		switch entry.State() {
+		case vhdxfmt.PayloadBlockFullyPresent:
+			r.blocks = append(r.blocks, blockio.Block{Index: i, Offset: entry.FileOffset()})
+		case vhdxfmt.PayloadBlockPartiallyPresent:
+			return fmt.Errorf("VHDX block %d is partially present, which is only valid in differencing images", i)
+		default:
+			// Not present, undefined, zero and unmapped blocks all read as
+			// zeros without a parent.
+		}
+	}
+	if err := r.src.CheckOrder(r.blocks); err != nil {
+		return err
+	}
+	return nil
+}
+
+// regionFits reports whether region lies within an image of size bytes.
+func regionFits(region *vhdxfmt.RegionTableEntry, size int64) bool {
+	return uint64(region.Length) <= uint64(size) && region.FileOffset <= uint64(size)-uint64(region.Length)
+}
+
+func (r *Reader) Read(p []byte) (int, int64, error) {
+	blockSize := int64(r.metadata.BlockSize)
+	if r.blockRemain == 0 {
+		if len(r.blocks) == 0 {
+			return 0, r.capacity, io.EOF
+		}
+		r.current = r.blocks[0]
+		r.blocks = r.blocks[1:]
+		r.blockOffset = r.current.Index * blockSize
+		r.blockRemain = blockSize
+		// The last block may extend past the end of the disk.
+		if r.blockOffset+r.blockRemain > r.capacity {
+			r.blockRemain = r.capacity - r.blockOffset
+		}
+	}
+
+	if int64(len(p)) > r.blockRemain {
+		p = p[:r.blockRemain]
+	}
+	inBlock := r.blockOffset - r.current.Index*blockSize
+	if err := r.src.ReadFullAt(p, r.current.Offset+inBlock); err != nil {
+		return 0, 0, fmt.Errorf("failed to read VHDX block: %w", err)
+	}
+
+	off := r.blockOffset
+	r.blockOffset += int64(len(p))
+	r.blockRemain -= int64(len(p))
+	return len(p), off, nil
+}
+
+func (r *Reader) Capacity() int64 {
+	return r.capacity
+}
+
+func (r *Reader) Close() error {
+	if r.src != nil {
+		return r.src.Close()
+	}
+	return nil
+}
+
+type Writer struct {
+	Sink transferio.WriteAtStorage
+	vw   *vhdxfmt.VHDXWriter
+}
+
+func NewWriter(sink transferio.WriteAtStorage) *Writer {
+	return &Writer{Sink: sink}
+}
+
+func (w *Writer) Open(ctx context.Context, capacity int64) error {
+	// The BAT is written after the blocks it points to.
+	if !transferio.SupportsRandomWrite(w.Sink) {
+		return fmt.Errorf("vhdx output requires a destination that supports random writes")
+	}
+	vw, err := vhdxfmt.NewVHDXWriter(w.Sink, uint64(capacity), vhdxfmt.WriterOptions{})
+	if err != nil {
+		return err
+	}
+	w.vw = vw
+	return nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	return w.vw.Write(p)
+}
+
+func (w *Writer) Close() error {
+	if w.vw != nil {
+		if err := w.vw.Close(); err != nil {
+			w.Sink.Close()
+			return err
+		}
+	}
+	return w.Sink.Close()
+}
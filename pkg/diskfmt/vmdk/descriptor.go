@@ -0,0 +1,225 @@
+package vmdk
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	vmdkstream "disk-stream-convert/format/vmdk-stream"
+	"disk-stream-convert/pkg/transferio"
+)
+
+// maxDescriptorSize bounds the text descriptor read from the source.
+const maxDescriptorSize = 1 << 20
+
+// ExtentResolver opens an extent file by the name stored in a descriptor.
+type ExtentResolver func(ctx context.Context, name string) (transferio.StreamRead, error)
+
+// extentSource reads an extent file, with random access if the source has it
+// and forward only otherwise.
+type extentSource struct {
+	rc  io.ReadCloser
+	ra  io.ReaderAt
+	pos int64
+	// size is the size of the file, or -1 if it is not known.
+	size int64
+}
+
+func openExtentSource(ctx context.Context, src transferio.StreamRead) (extentSource, error) {
+	type openable interface {
+		Open(ctx context.Context) (io.ReadCloser, error)
+	}
+	s := extentSource{size: -1}
+	if size, ok := src.Size(); ok {
+		s.size = size
+	}
+	if o, ok := src.(openable); ok {
+		rc, err := o.Open(ctx)
+		if err != nil {
+			return s, err
+		}
+		s.rc = rc
+	} else {
+		s.rc = src
+	}
+	if ra, ok := src.(io.ReaderAt); ok {
+		s.ra = ra
+	}
+	return s, nil
+}
+
+// readAt reads from the source at off. Without random access, the source can
+// only move forward.
+func (s *extentSource) readAt(p []byte, off int64) error {
+	if s.ra != nil {
+		n, err := s.ra.ReadAt(p, off)
+		if n == len(p) {
+			return nil
+		}
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if off < s.pos {
+		return fmt.Errorf("vmdk structure at %d precedes the stream position %d", off, s.pos)
+	}
+	if _, err := io.CopyN(io.Discard, s.rc, off-s.pos); err != nil {
+		return err
+	}
+	s.pos = off
+	n, err := io.ReadFull(s.rc, p)
+	s.pos += int64(n)
+	return err
+}
+
+func (s *extentSource) close() error {
+	return s.rc.Close()
+}
+
+// flatReader reads a FLAT or VMFS extent, which is a plain region of its file.
+type flatReader struct {
+	extentSource
+	fileOffset int64
+	diskOffset int64
+	remain     int64
+}
+
+func (r *flatReader) read(p []byte) (int, int64, error) {
+	if r.remain == 0 {
+		return 0, r.diskOffset, io.EOF
+	}
+	if int64(len(p)) > r.remain {
+		p = p[:r.remain]
+	}
+	if err := r.readAt(p, r.fileOffset); err != nil {
+		return 0, 0, fmt.Errorf("failed to read vmdk flat extent: %w", err)
+	}
+	off := r.diskOffset
+	r.fileOffset += int64(len(p))
+	r.diskOffset += int64(len(p))
+	r.remain -= int64(len(p))
+	return len(p), off, nil
+}
+
+// extentReader returns the data of one extent at offsets relative to the
+// start of the extent.
+type extentReader interface {
+	read(p []byte) (int, int64, error)
+	close() error
+}
+
+// descriptorReader reads the disk described by a text descriptor, one extent
+// after the other. ZERO and NOACCESS extents read as zeros.
+type descriptorReader struct {
+	ctx      context.Context
+	resolve  ExtentResolver
+	extents  []vmdkstream.Extent
+	capacity int64
+
+	next    int
+	base    int64
+	current extentReader
+}
+
+func (r *descriptorReader) open(ctx context.Context, rc io.Reader) error {
+	text, err := io.ReadAll(io.LimitReader(rc, maxDescriptorSize+1))
+	if err != nil {
+		return fmt.Errorf("failed to read vmdk descriptor: %w", err)
+	}
+	if len(text) > maxDescriptorSize {
+		return fmt.Errorf("vmdk descriptor is larger than %d bytes", maxDescriptorSize)
+	}
+	if strings.HasPrefix(string(text), "KDMV") {
+		return fmt.Errorf("vmdk image is a sparse extent, not a descriptor; read it with the %s or %s subformat", SubformatMonolithicSparse, SubformatStreamOptimized)
+	}
+	d, err := vmdkstream.ParseDescriptor(string(text))
+	if err != nil {
+		return err
+	}
+	if d.ParentCID != vmdkstream.DESCRIPTOR_NO_PARENT {
+		return fmt.Errorf("vmdk descriptor has a parent, delta links are not supported")
+	}
+
+	for _, e := range d.Extents {
+		switch e.Type {
+		case vmdkstream.EXTENT_TYPE_FLAT, vmdkstream.EXTENT_TYPE_VMFS, vmdkstream.EXTENT_TYPE_SPARSE, vmdkstream.EXTENT_TYPE_ZERO:
+		default:
+			return fmt.Errorf("unsupported vmdk extent type %s", e.Type)
+		}
+		if e.Access != vmdkstream.EXTENT_ACCESS_NOACCESS && e.Type != vmdkstream.EXTENT_TYPE_ZERO && r.resolve == nil {
+			return fmt.Errorf("no extent resolver configured")
+		}
+	}
+	r.ctx = ctx
+	r.extents = d.Extents
+	r.capacity = int64(d.Capacity()) << vmdkstream.SECTOR_SIZE_SHIFT
+	return nil
+}
+
+// openExtent opens the extent file of e, or returns nil for extents that
+// read as zeros.
+func (r *descriptorReader) openExtent(e vmdkstream.Extent) (extentReader, error) {
+	if e.Access == vmdkstream.EXTENT_ACCESS_NOACCESS || e.Type == vmdkstream.EXTENT_TYPE_ZERO {
+		return nil, nil
+	}
+	src, err := r.resolve(r.ctx, e.FileName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open vmdk extent %q: %w", e.FileName, err)
+	}
+	s, err := openExtentSource(r.ctx, src)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open vmdk extent %q: %w", e.FileName, err)
+	}
+
+	size := int64(e.Sectors) << vmdkstream.SECTOR_SIZE_SHIFT
+	if e.Type != vmdkstream.EXTENT_TYPE_SPARSE {
+		return &flatReader{extentSource: s, fileOffset: int64(e.Offset) << vmdkstream.SECTOR_SIZE_SHIFT, remain: size}, nil
+	}
+	sr := &sparseReader{extentSource: s}
+	if err := sr.open(); err != nil {
+		s.close()
+		return nil, fmt.Errorf("vmdk extent %q: %w", e.FileName, err)
+	}
+	if sr.capacity != size {
+		s.close()
+		return nil, fmt.Errorf("vmdk extent %q holds %d sectors, the descriptor says %d", e.FileName, sr.header.Capacity, e.Sectors)
+	}
+	return sr, nil
+}
+
+func (r *descriptorReader) read(p []byte) (int, int64, error) {
+	for {
+		if r.current != nil {
+			n, off, err := r.current.read(p)
+			if err != io.EOF {
+				return n, r.base + off, err
+			}
+			r.current.close()
+			r.current = nil
+			r.base += int64(r.extents[r.next-1].Sectors) << vmdkstream.SECTOR_SIZE_SHIFT
+		}
+		if r.next == len(r.extents) {
+			return 0, r.capacity, io.EOF
+		}
+		e := r.extents[r.next]
+		r.next++
+		current, err := r.openExtent(e)
+		if err != nil {
+			return 0, 0, err
+		}
+		if current == nil {
+			r.base += int64(e.Sectors) << vmdkstream.SECTOR_SIZE_SHIFT
+			continue
+		}
+		r.current = current
+	}
+}
+
+func (r *descriptorReader) close() error {
+	if r.current != nil {
+		return r.current.close()
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package vmdk
+
+import (
+	"errors"
+
+	"disk-stream-convert/pkg/diskfmt"
+	"disk-stream-convert/pkg/transferio"
+)
+
+// ReaderOptions are the options of vmdk sources.
+type ReaderOptions struct {
+	// Subformat is the layout of the source, SubformatStreamOptimized if
+	// empty.
+	Subformat string `option:"subformat"`
+	// ResolveExtent opens the extents descriptors refer to.
+	ResolveExtent ExtentResolver `option:"resolve,hint"`
+}
+
+// WriterOptions are the options of vmdk output.
+type WriterOptions struct {
+	// Subformat is the layout of the output, SubformatStreamOptimized if
+	// empty.
+	Subformat string `option:"subformat"`
+}
+
+func init() {
+	diskfmt.Register(&diskfmt.Format{
+		Name:                   "vmdk",
+		Capabilities:           diskfmt.Readable | diskfmt.Writable,
+		Extension:              ".vmdk",
+		SeekableSubformats:     []string{SubformatMonolithicSparse},
+		RandomAccessSubformats: []string{SubformatMonolithicSparse},
+		Reader: diskfmt.ReaderFor(func(source transferio.StreamRead, opts *ReaderOptions) (diskfmt.StreamReader, error) {
+			switch opts.Subformat {
+			case "", SubformatStreamOptimized, SubformatMonolithicSparse, SubformatDescriptor:
+			default:
+				return nil, errors.New("unsupported vmdk subformat: " + opts.Subformat)
+			}
+			vr := NewReader(source)
+			vr.Subformat = opts.Subformat
+			vr.ResolveExtent = opts.ResolveExtent
+			return vr, nil
+		}),
+		Writer: diskfmt.WriterFor(func(sink transferio.WriteAtStorage, opts *WriterOptions) (diskfmt.StreamWriter, error) {
+			switch opts.Subformat {
+			case "", SubformatStreamOptimized, SubformatMonolithicSparse:
+			default:
+				return nil, errors.New("unsupported vmdk subformat: " + opts.Subformat)
+			}
+			vw := NewWriter(sink)
+			vw.Subformat = opts.Subformat
+			return vw, nil
+		}),
+	})
+}
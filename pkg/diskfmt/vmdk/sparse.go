@@ -0,0 +1,226 @@
+package vmdk
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+
+	vmdkstream "disk-stream-convert/format/vmdk-stream"
+)
+
+// sparseReader reads hosted sparse extents (monolithicSparse) through their
+// grain directory and grain tables, which hold the file offsets of the
+// uncompressed grains. Grains are returned in disk order. Sources with random
+// access are read grain by grain; non-seekable sources work as long as the
+// tables precede the grains and the grains are stored in disk order, which is
+// how images written sequentially are laid out.
+type sparseReader struct {
+	extentSource
+
+	header     *vmdkstream.SparseExtentHeader
+	capacity   int64
+	grainBytes int64
+
+	// tables holds the grain tables present in the image in disk order; gt
+	// and entry locate the first grain table entry not returned yet.
+	tables []grainTable
+	gt     int
+	entry  int
+
+	grainOffset int64
+	grainRemain int64
+	diskOffset  int64
+}
+
+func (r *sparseReader) open() error {
+	head := make([]byte, vmdkstream.SECTOR_SIZE)
+	if err := r.readAt(head, 0); err != nil {
+		return fmt.Errorf("failed to read vmdk header: %w", err)
+	}
+	hdr, err := vmdkstream.ParseSparseExtentHeader(head)
+	if err != nil {
+		return err
+	}
+	if hdr.Flags&vmdkstream.SPARSEFLAG_COMPRESSED != 0 || hdr.GdOffset == vmdkstream.SPARSE_GD_AT_END {
+		return fmt.Errorf("vmdk image has compressed grains, read it with the %s subformat", SubformatStreamOptimized)
+	}
+	if hdr.NumGTEsPerGT != gtEntries {
+		return fmt.Errorf("unsupported vmdk grain table size of %d entries", hdr.NumGTEsPerGT)
+	}
+	if hdr.Capacity > math.MaxInt64>>vmdkstream.SECTOR_SIZE_SHIFT {
+		return fmt.Errorf("invalid vmdk capacity of %d sectors", hdr.Capacity)
+	}
+	r.header = hdr
+	r.capacity = int64(hdr.Capacity) << vmdkstream.SECTOR_SIZE_SHIFT
+	r.grainBytes = int64(hdr.GrainSize) << vmdkstream.SECTOR_SIZE_SHIFT
+
+	// Both grain directories describe the same grains. The primary one is
+	// preferred; the redundant one is used when there is no primary one or,
+	// on seekable sources, when its tables cannot be read.
+	rgdOffset := int64(0)
+	if hdr.Flags&vmdkstream.SPARSEFLAG_USE_REDUNDANT != 0 {
+		rgdOffset = int64(hdr.RgdOffset)
+	}
+	switch {
+	case hdr.GdOffset != 0:
+		err = r.readTables(int64(hdr.GdOffset))
+		if err != nil && r.ra != nil && rgdOffset != 0 {
+			err = r.readTables(rgdOffset)
+		}
+	case rgdOffset != 0:
+		err = r.readTables(rgdOffset)
+	default:
+		err = fmt.Errorf("vmdk image has no grain directory")
+	}
+	if err != nil {
+		return err
+	}
+
+	if r.ra == nil {
+		last := uint32(0)
+		for _, t := range r.tables {
+			for j, gte := range t.entries {
+				if !r.allocated(gte) {
+					continue
+				}
+				if gte < last {
+					return fmt.Errorf("vmdk grain %d is stored before the grain preceding it, which requires a seekable source", t.index*gtEntries+int64(j))
+				}
+				last = gte
+			}
+		}
+	}
+	return nil
+}
+
+// gtEntries is the number of entries of a grain table, the only one hosted
+// sparse extents use.
+const gtEntries = 512
+
+// gdChunkSize is the size of the chunks the grain directory is read in.
+const gdChunkSize = 64 << 10
+
+// grainTable is a grain table present in the image: index is its entry in the
+// grain directory, sector where it is stored.
+type grainTable struct {
+	index   int64
+	sector  int64
+	entries []uint32
+}
+
+// readTables reads the grain directory at gdSector and the grain tables it
+// points to, in file order. The directory is read a chunk at a time and only
+// the tables present are kept, which may not overlap, so that memory grows
+// with the size of the source rather than with the capacity in the header.
+func (r *sparseReader) readTables(gdSector int64) error {
+	entries := int64(r.header.GrainDirectoryEntries())
+	if gdSector < 0 || gdSector > math.MaxInt64>>vmdkstream.SECTOR_SIZE_SHIFT {
+		return fmt.Errorf("invalid vmdk grain directory sector %d", gdSector)
+	}
+	gdOffset := gdSector << vmdkstream.SECTOR_SIZE_SHIFT
+	if r.size >= 0 && (gdOffset > r.size || entries > (r.size-gdOffset)/4) {
+		return fmt.Errorf("vmdk grain directory with %d entries at %d does not fit in the %d byte image", entries, gdOffset, r.size)
+	}
+
+	var tables []grainTable
+	gd := make([]byte, min(entries*4, gdChunkSize))
+	for i := int64(0); i < entries; {
+		n := min(entries-i, int64(len(gd))/4)
+		if err := r.readAt(gd[:n*4], gdOffset+i*4); err != nil {
+			return fmt.Errorf("failed to read vmdk grain directory: %w", err)
+		}
+		for j := int64(0); j < n; j++ {
+			if sector := binary.LittleEndian.Uint32(gd[j*4:]); sector != 0 {
+				tables = append(tables, grainTable{index: i + j, sector: int64(sector)})
+			}
+		}
+		i += n
+	}
+	sort.Slice(tables, func(i, j int) bool { return tables[i].sector < tables[j].sector })
+
+	buf := make([]byte, gtEntries*4)
+	end := int64(0)
+	for i := range tables {
+		gt := &tables[i]
+		off := gt.sector << vmdkstream.SECTOR_SIZE_SHIFT
+		if off < end {
+			return fmt.Errorf("vmdk grain table %d overlaps another grain table", gt.index)
+		}
+		end = off + int64(len(buf))
+		if r.size >= 0 && end > r.size {
+			return fmt.Errorf("vmdk grain table %d at %d does not fit in the %d byte image", gt.index, off, r.size)
+		}
+		if err := r.readAt(buf, off); err != nil {
+			return fmt.Errorf("failed to read vmdk grain table %d: %w", gt.index, err)
+		}
+		gt.entries = make([]uint32, gtEntries)
+		for j := range gt.entries {
+			gt.entries[j] = binary.LittleEndian.Uint32(buf[j*4:])
+		}
+	}
+	sort.Slice(tables, func(i, j int) bool { return tables[i].index < tables[j].index })
+
+	// The last grain table may extend past the last grain.
+	grains := int64(r.header.GrainCount())
+	if n := len(tables); n > 0 && tables[n-1].index*gtEntries+gtEntries > grains {
+		t := &tables[n-1]
+		t.entries = t.entries[:grains-t.index*gtEntries]
+	}
+	r.tables = tables
+	return nil
+}
+
+// allocated tells whether a grain table entry points to a stored grain.
+func (r *sparseReader) allocated(gte uint32) bool {
+	if gte == vmdkstream.SPARSE_GTE_EMPTY {
+		return false
+	}
+	return gte != vmdkstream.SPARSE_GTE_ZEROED || r.header.Flags&vmdkstream.SPARSEFLAG_ZEROED_GTE == 0
+}
+
+// nextGrain returns the grain table entry and the index of the next stored
+// grain, in disk order.
+func (r *sparseReader) nextGrain() (uint32, int64, bool) {
+	for ; r.gt < len(r.tables); r.gt, r.entry = r.gt+1, 0 {
+		t := r.tables[r.gt]
+		for r.entry < len(t.entries) {
+			gte := t.entries[r.entry]
+			r.entry++
+			if r.allocated(gte) {
+				return gte, t.index*gtEntries + int64(r.entry-1), true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+func (r *sparseReader) read(p []byte) (int, int64, error) {
+	if r.grainRemain == 0 {
+		gte, index, ok := r.nextGrain()
+		if !ok {
+			return 0, r.capacity, io.EOF
+		}
+		r.grainOffset = int64(gte) << vmdkstream.SECTOR_SIZE_SHIFT
+		r.diskOffset = index * r.grainBytes
+		r.grainRemain = r.grainBytes
+		// The last grain may extend past the end of the disk.
+		if r.diskOffset+r.grainRemain > r.capacity {
+			r.grainRemain = r.capacity - r.diskOffset
+		}
+	}
+
+	if int64(len(p)) > r.grainRemain {
+		p = p[:r.grainRemain]
+	}
+	if err := r.readAt(p, r.grainOffset); err != nil {
+		return 0, 0, fmt.Errorf("failed to read vmdk grain: %w", err)
+	}
+
+	off := r.diskOffset
+	r.grainOffset += int64(len(p))
+	r.diskOffset += int64(len(p))
+	r.grainRemain -= int64(len(p))
+	return len(p), off, nil
+}
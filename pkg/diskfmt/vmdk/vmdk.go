@@ -2,15 +2,33 @@ package vmdk
 
 import (
 	"context"
+	"fmt"
 	vmdkstream "disk-stream-convert/format/vmdk-stream"
 	"disk-stream-convert/pkg/transferio"
 	"io"
 )
 
+// Subformats of vmdk images. The single file layouts are named after the
+// createType of their descriptor; SubformatDescriptor reads any disk described
+// by a separate text descriptor, such as monolithicFlat, twoGbMaxExtentSparse,
+// twoGbMaxExtentFlat and ESXi (vmfs) images.
+const (
+	SubformatStreamOptimized  = "streamOptimized"
+	SubformatMonolithicSparse = "monolithicSparse"
+	SubformatDescriptor       = "descriptor"
+)
+
 type Reader struct {
 	Source transferio.StreamRead
-	vs     *vmdkstream.VMDKStream
-	rc     io.ReadCloser
+	// Subformat selects the image layout, SubformatStreamOptimized if empty.
+	Subformat string
+	// ResolveExtent opens the extent files named in a descriptor.
+	ResolveExtent ExtentResolver
+	vs            *vmdkstream.VMDKStream
+	rc            io.ReadCloser
+	// layout reads the images that are not streamOptimized.
+	layout   extentReader
+	capacity int64
 }
 
 func NewReader(source transferio.StreamRead) *Reader {
@@ -22,6 +40,15 @@ func (r *Reader) Open(ctx context.Context) error {
 	type openable interface {
 		Open(ctx context.Context) (io.ReadCloser, error)
 	}
+	switch r.Subformat {
+	case "", SubformatStreamOptimized:
+	case SubformatMonolithicSparse:
+		return r.openSparse(ctx)
+	case SubformatDescriptor:
+		return r.openDescriptor(ctx)
+	default:
+		return fmt.Errorf("unsupported vmdk subformat: %s", r.Subformat)
+	}
 	if o, ok := r.Source.(openable); ok {
 		rc, err := o.Open(ctx)
 		if err != nil {
@@ -40,7 +67,44 @@ func (r *Reader) Open(ctx context.Context) error {
 	return r.vs.InitStream()
 }
 
+// openSparse opens the source of a monolithicSparse image.
+func (r *Reader) openSparse(ctx context.Context) error {
+	s, err := openExtentSource(ctx, r.Source)
+	if err != nil {
+		return err
+	}
+	sr := &sparseReader{extentSource: s}
+	if err := sr.open(); err != nil {
+		s.close()
+		return err
+	}
+	r.layout = sr
+	r.capacity = sr.capacity
+	return nil
+}
+
+// openDescriptor reads the text descriptor from the source. Its extents are
+// opened one after the other while reading.
+func (r *Reader) openDescriptor(ctx context.Context) error {
+	s, err := openExtentSource(ctx, r.Source)
+	if err != nil {
+		return err
+	}
+	dr := &descriptorReader{resolve: r.ResolveExtent}
+	if err := dr.open(ctx, s.rc); err != nil {
+		s.close()
+		return err
+	}
+	r.rc = s.rc
+	r.layout = dr
+	r.capacity = dr.capacity
+	return nil
+}
+
 func (r *Reader) Read(p []byte) (int, int64, error) {
+	if r.layout != nil {
+		return r.layout.read(p)
+	}
 	// vmdkstream.Next returns offset, n, error
 	off, n, err := r.vs.Next(p)
 	if err != nil {
@@ -50,20 +114,37 @@ func (r *Reader) Read(p []byte) (int, int64, error) {
 }
 
 func (r *Reader) Capacity() int64 {
+	if r.layout != nil {
+		return r.capacity
+	}
 	return int64(r.vs.CapacityBytes())
 }
 
 func (r *Reader) Close() error {
+	var err error
+	if r.layout != nil {
+		err = r.layout.close()
+	}
 	if r.rc != nil {
-		return r.rc.Close()
+		if cerr := r.rc.Close(); err == nil {
+			err = cerr
+		}
 	}
-	return nil
+	return err
 }
 
 type Writer struct {
 	Sink transferio.WriteAtStorage
-	vs   *vmdkstream.VMDKStream
-	adapter *sinkWriterAdapter
+	// Subformat selects the image layout, SubformatStreamOptimized if empty.
+	// SubformatMonolithicSparse needs a sink that supports random writes.
+	Subformat string
+	vs        *vmdkstream.VMDKStream
+	sparse    *vmdkstream.SparseWriter
+	adapter   *sinkWriterAdapter
+	// grain collects the data of the next streamOptimized grain, since
+	// VMDKStream takes one whole grain per Write.
+	grain []byte
+	fill  int
 }
 
 func NewWriter(sink transferio.WriteAtStorage) *Writer {
@@ -71,19 +152,71 @@ func NewWriter(sink transferio.WriteAtStorage) *Writer {
 }
 
 func (w *Writer) Open(ctx context.Context, capacity int64) error {
+	switch w.Subformat {
+	case "", SubformatStreamOptimized:
+	case SubformatMonolithicSparse:
+		// Grain tables are filled in place after their grains are written.
+		if !transferio.SupportsRandomWrite(w.Sink) {
+			return fmt.Errorf("vmdk %s output requires a destination that supports random writes", SubformatMonolithicSparse)
+		}
+		sw, err := vmdkstream.NewSparseWriter(w.Sink, "disk.img", uint64(capacity))
+		if err != nil {
+			return err
+		}
+		w.sparse = sw
+		return nil
+	default:
+		return fmt.Errorf("unsupported vmdk output subformat: %s", w.Subformat)
+	}
 	w.adapter = &sinkWriterAdapter{ctx: ctx, sink: w.Sink}
 	w.vs = vmdkstream.NewVMDKStreamWriter(w.adapter)
 	// VMDK needs a filename in header, we can default it or pass it.
 	// For now default to "disk.img".
-	return w.vs.Create("disk.img", uint64(capacity))
+	if err := w.vs.Create("disk.img", uint64(capacity)); err != nil {
+		return err
+	}
+	w.grain = make([]byte, w.vs.Header.GrainSize<<vmdkstream.SECTOR_SIZE_SHIFT)
+	return nil
 }
 
 func (w *Writer) Write(p []byte) (int, error) {
-	return w.vs.Write(p)
+	if w.sparse != nil {
+		return w.sparse.Write(p)
+	}
+	n := 0
+	for n < len(p) {
+		c := copy(w.grain[w.fill:], p[n:])
+		w.fill += c
+		n += c
+		if w.fill == len(w.grain) {
+			if _, err := w.vs.Write(w.grain); err != nil {
+				return n, err
+			}
+			w.fill = 0
+		}
+	}
+	return n, nil
 }
 
 func (w *Writer) Close() error {
+	if w.sparse != nil {
+		if err := w.sparse.Close(); err != nil {
+			w.Sink.Close()
+			return err
+		}
+		return w.Sink.Close()
+	}
+	// The last grain may be partial when the capacity is not a multiple of
+	// the grain size.
+	if w.fill > 0 {
+		if _, err := w.vs.Write(w.grain[:w.fill]); err != nil {
+			w.Sink.Close()
+			return err
+		}
+		w.fill = 0
+	}
 	if err := w.vs.Close(); err != nil {
+		w.Sink.Close()
 		return err
 	}
 	return w.Sink.Close()
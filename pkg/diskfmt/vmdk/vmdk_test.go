@@ -0,0 +1,72 @@
+package vmdk
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"path/filepath"
+	"testing"
+
+	"disk-stream-convert/pkg/transferio"
+)
+
+// TestStreamOptimizedUnalignedWrites writes a disk whose capacity is not a
+// multiple of the grain size in pieces that are not grain aligned either, and
+// reads it back.
+func TestStreamOptimizedUnalignedWrites(t *testing.T) {
+	const capacity = 3<<16 + 5*512
+	data := make([]byte, capacity)
+	for i := range data {
+		data[i] = byte(i*7 + i>>9)
+	}
+	path := filepath.Join(t.TempDir(), "disk.vmdk")
+	sink, err := transferio.NewFileWriteStorage(path, false)
+	if err != nil {
+		t.Fatalf("new sink: %v", err)
+	}
+	w := NewWriter(sink)
+	if err := w.Open(context.Background(), capacity); err != nil {
+		t.Fatalf("open writer: %v", err)
+	}
+	for p := data; len(p) > 0; {
+		n := min(len(p), 3000)
+		if _, err := w.Write(p[:n]); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		p = p[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close writer: %v", err)
+	}
+
+	source, err := transferio.NewFileReadStorage(path)
+	if err != nil {
+		t.Fatalf("new source: %v", err)
+	}
+	r := NewReader(source)
+	if err := r.Open(context.Background()); err != nil {
+		t.Fatalf("open reader: %v", err)
+	}
+	defer r.Close()
+	if r.Capacity() != capacity {
+		t.Fatalf("capacity=%d, want %d", r.Capacity(), capacity)
+	}
+	got := make([]byte, capacity)
+	buf := make([]byte, 1<<16)
+	for {
+		n, off, err := r.Read(buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if off+int64(n) > capacity {
+			t.Fatalf("grain at %d+%d beyond the capacity", off, n)
+		}
+		copy(got[off:], buf[:n])
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("content mismatch")
+	}
+}
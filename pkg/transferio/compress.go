@@ -0,0 +1,146 @@
+package transferio
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// CompressOptions tunes the encoder of a CompressWrite.
+type CompressOptions struct {
+	// Level is the compression level: 1-9 for gzip and xz, 1-22 for zstd
+	// (mapped to the closest level of the encoder). Zero selects the default.
+	Level int
+	// Concurrency is the number of zstd encoder goroutines. Zero uses one per
+	// CPU, one encodes sequentially. Other compressions use a single one.
+	Concurrency int
+}
+
+// xzDictCap holds the dictionary sizes of the xz presets 1-9.
+var xzDictCap = [...]int{1 << 20, 2 << 20, 4 << 20, 4 << 20, 8 << 20, 8 << 20, 16 << 20, 32 << 20, 64 << 20}
+
+// CompressWrite compresses the data written to it into Sink. The compressed
+// stream is written to the sink sequentially, so any sink works, including
+// HTTP downloads. Like them, it only accepts sequential writes itself.
+type CompressWrite struct {
+	Sink        WriteAtStorage
+	Compression string
+	enc         io.WriteCloser
+	out         *sequentialWriter
+	offset      int64
+}
+
+// NewCompressWrite returns a CompressWrite for the gzip, xz or zstd
+// compression.
+func NewCompressWrite(sink WriteAtStorage, compression string, opts CompressOptions) (*CompressWrite, error) {
+	if opts.Concurrency < 0 {
+		return nil, fmt.Errorf("invalid compression concurrency %d", opts.Concurrency)
+	}
+	if opts.Concurrency > 1 && compression != CompressionZstd {
+		return nil, fmt.Errorf("concurrent compression is only supported for zstd")
+	}
+	out := &sequentialWriter{sink: sink}
+	var enc io.WriteCloser
+	switch compression {
+	case CompressionGzip:
+		level := opts.Level
+		if level == 0 {
+			level = gzip.DefaultCompression
+		} else if level < 1 || level > 9 {
+			return nil, fmt.Errorf("invalid gzip level %d", opts.Level)
+		}
+		zw, err := gzip.NewWriterLevel(out, level)
+		if err != nil {
+			return nil, err
+		}
+		enc = zw
+	case CompressionXz:
+		var cfg xz.WriterConfig
+		if opts.Level != 0 {
+			if opts.Level < 1 || opts.Level > 9 {
+				return nil, fmt.Errorf("invalid xz level %d", opts.Level)
+			}
+			cfg.DictCap = xzDictCap[opts.Level-1]
+		}
+		zw, err := cfg.NewWriter(out)
+		if err != nil {
+			return nil, err
+		}
+		enc = zw
+	case CompressionZstd:
+		zopts := []zstd.EOption{}
+		if opts.Level != 0 {
+			if opts.Level < 1 || opts.Level > 22 {
+				return nil, fmt.Errorf("invalid zstd level %d", opts.Level)
+			}
+			zopts = append(zopts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(opts.Level)))
+		}
+		if opts.Concurrency != 0 {
+			zopts = append(zopts, zstd.WithEncoderConcurrency(opts.Concurrency))
+		}
+		zw, err := zstd.NewWriter(out, zopts...)
+		if err != nil {
+			return nil, err
+		}
+		enc = zw
+	default:
+		return nil, fmt.Errorf("unsupported compression: %s", compression)
+	}
+	return &CompressWrite{Sink: sink, Compression: compression, enc: enc, out: out}, nil
+}
+
+func (c *CompressWrite) Write(p []byte) (int, error) {
+	return c.WriteAt(p, c.offset)
+}
+
+func (c *CompressWrite) WriteAt(p []byte, off int64) (int, error) {
+	if off != c.offset {
+		return 0, errors.New("compressed output does not support random write")
+	}
+	n, err := c.enc.Write(p)
+	c.offset += int64(n)
+	return n, err
+}
+
+// Preallocate does nothing, the size of the compressed data is not known.
+func (c *CompressWrite) Preallocate(ctx context.Context, size int64) error {
+	return nil
+}
+
+// Size returns the number of compressed bytes written so far.
+func (c *CompressWrite) Size() (int64, bool) {
+	return c.out.off, false
+}
+
+// AppendOnly reports that the data can only be written sequentially.
+func (c *CompressWrite) AppendOnly() bool {
+	return true
+}
+
+// Close flushes the encoder and closes the sink.
+func (c *CompressWrite) Close() error {
+	err := c.enc.Close()
+	if cerr := c.Sink.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+var _ StreamWrite = (*CompressWrite)(nil)
+
+// sequentialWriter writes to a sink one chunk after the other.
+type sequentialWriter struct {
+	sink WriteAtStorage
+	off  int64
+}
+
+func (s *sequentialWriter) Write(p []byte) (int, error) {
+	n, err := s.sink.WriteAt(p, s.off)
+	s.off += int64(n)
+	return n, err
+}
@@ -0,0 +1,281 @@
+package transferio
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Compression wrappers understood by DecompressRead.
+const (
+	// CompressionAuto detects the wrapper from the magic bytes of the source.
+	CompressionAuto = "auto"
+	// CompressionNone passes the source through unchanged.
+	CompressionNone  = "none"
+	CompressionGzip  = "gzip"
+	CompressionXz    = "xz"
+	CompressionZstd  = "zstd"
+	CompressionBzip2 = "bzip2"
+)
+
+// magicSize is the number of bytes DetectCompression looks at.
+const magicSize = 10
+
+var (
+	gzipMagic  = []byte{0x1f, 0x8b, 0x08}
+	xzMagic    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	bzip2Magic = []byte{0x31, 0x41, 0x59, 0x26, 0x53, 0x59}
+)
+
+// DetectCompression returns the compression wrapper whose magic bytes start b,
+// or CompressionNone.
+func DetectCompression(b []byte) string {
+	switch {
+	case bytes.HasPrefix(b, gzipMagic):
+		return CompressionGzip
+	case bytes.HasPrefix(b, xzMagic):
+		return CompressionXz
+	case bytes.HasPrefix(b, zstdMagic):
+		return CompressionZstd
+	// "BZh", the block size and the magic of the first block; empty streams
+	// have no block and are not detected.
+	case len(b) >= magicSize && bytes.HasPrefix(b, []byte("BZh")) && b[3] >= '1' && b[3] <= '9' && bytes.Equal(b[4:10], bzip2Magic):
+		return CompressionBzip2
+	}
+	return CompressionNone
+}
+
+// Decompress returns source decompressed according to compression, which is
+// one of the Compression constants; empty means CompressionAuto. Sources with
+// random access that turn out not to be compressed are returned as they are,
+// so that readers keep random access.
+func Decompress(source StreamRead, compression string) (StreamRead, error) {
+	switch compression {
+	case "":
+		compression = CompressionAuto
+	case CompressionNone:
+		return source, nil
+	case CompressionAuto, CompressionGzip, CompressionXz, CompressionZstd, CompressionBzip2:
+	default:
+		return nil, fmt.Errorf("unsupported compression: %s", compression)
+	}
+	if ra, ok := source.(io.ReaderAt); ok && compression == CompressionAuto {
+		magic := make([]byte, magicSize)
+		n, err := ra.ReadAt(magic, 0)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if DetectCompression(magic[:n]) == CompressionNone {
+			return source, nil
+		}
+	}
+	return &DecompressRead{Source: source, Compression: compression}, nil
+}
+
+// DecompressRead is the decompressed data of a compressed source. The wrapper
+// is detected when the source is opened unless it is given explicitly.
+//
+// The size of the source is that of the compressed data, so Size reports the
+// uncompressed size only where the wrapper records it: in the frame header of
+// zstd streams, and in the index of xz streams on sources with random access.
+// Otherwise the size is unknown.
+type DecompressRead struct {
+	Source StreamRead
+	// Compression is one of the Compression constants.
+	Compression string
+
+	rc      io.ReadCloser
+	r       io.Reader
+	decoder io.Closer
+	// detected is the wrapper found in the source.
+	detected  string
+	size      int64
+	sizeKnown bool
+	read      int64
+}
+
+func NewDecompressRead(source StreamRead, compression string) *DecompressRead {
+	return &DecompressRead{Source: source, Compression: compression}
+}
+
+func (d *DecompressRead) Open(ctx context.Context) (io.ReadCloser, error) {
+	type openable interface {
+		Open(ctx context.Context) (io.ReadCloser, error)
+	}
+	if o, ok := d.Source.(openable); ok {
+		rc, err := o.Open(ctx)
+		if err != nil {
+			return nil, err
+		}
+		d.rc = rc
+	} else {
+		d.rc = d.Source
+	}
+	if err := d.init(); err != nil {
+		d.rc.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// init detects the wrapper and sets up its decoder.
+func (d *DecompressRead) init() error {
+	br := bufio.NewReader(d.rc)
+	magic, err := br.Peek(magicSize)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("failed to read source: %w", err)
+	}
+	d.detected = DetectCompression(magic)
+	if d.Compression != "" && d.Compression != CompressionAuto && d.Compression != d.detected {
+		return fmt.Errorf("source is not %s compressed", d.Compression)
+	}
+	d.r = br
+
+	switch d.detected {
+	case CompressionNone:
+		d.size, d.sizeKnown = d.Source.Size()
+	case CompressionGzip:
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("failed to read gzip source: %w", err)
+		}
+		d.r = zr
+		d.decoder = zr
+	case CompressionXz:
+		zr, err := xz.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("failed to read xz source: %w", err)
+		}
+		d.r = zr
+		if ra, ok := d.Source.(io.ReaderAt); ok {
+			if size, ok := d.Source.Size(); ok {
+				d.size, d.sizeKnown = xzUncompressedSize(ra, size)
+			}
+		}
+	case CompressionZstd:
+		var h zstd.Header
+		head, _ := br.Peek(zstd.HeaderMaxSize)
+		if err := h.Decode(head); err == nil && h.HasFCS {
+			d.size, d.sizeKnown = int64(h.FrameContentSize), true
+		}
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("failed to read zstd source: %w", err)
+		}
+		d.r = zr
+		d.decoder = zr.IOReadCloser()
+	case CompressionBzip2:
+		d.r = bzip2.NewReader(br)
+	}
+	return nil
+}
+
+// Detected returns the wrapper found in the source once it has been opened.
+func (d *DecompressRead) Detected() string {
+	return d.detected
+}
+
+func (d *DecompressRead) Read(p []byte) (int, error) {
+	if d.r == nil {
+		return 0, io.EOF
+	}
+	n, err := d.r.Read(p)
+	d.read += int64(n)
+	// A recorded size that does not match the data, e.g. that of the first
+	// of several zstd frames, would give the disk a wrong capacity.
+	if d.sizeKnown && d.detected != CompressionNone {
+		if d.read > d.size {
+			return n, fmt.Errorf("%s source holds more than the %d bytes recorded in its header", d.detected, d.size)
+		}
+		if err == io.EOF && d.read < d.size {
+			return n, fmt.Errorf("%s source ends after %d of %d bytes: %w", d.detected, d.read, d.size, io.ErrUnexpectedEOF)
+		}
+	}
+	return n, err
+}
+
+// Size returns the uncompressed size, if it is known.
+func (d *DecompressRead) Size() (int64, bool) {
+	if d.rc == nil || !d.sizeKnown {
+		return 0, false
+	}
+	return d.size, true
+}
+
+func (d *DecompressRead) Close() error {
+	if d.decoder != nil {
+		d.decoder.Close()
+	}
+	if d.rc != nil {
+		return d.rc.Close()
+	}
+	return nil
+}
+
+var _ StreamRead = (*DecompressRead)(nil)
+
+// xzUncompressedSize sums the uncompressed sizes in the index of an xz file
+// holding a single stream. The index is located through the stream footer
+// at the end of the file.
+func xzUncompressedSize(ra io.ReaderAt, size int64) (int64, bool) {
+	const (
+		headerSize = 12
+		footerSize = 12
+	)
+	if size < headerSize+footerSize {
+		return 0, false
+	}
+	footer := make([]byte, footerSize)
+	if _, err := ra.ReadAt(footer, size-footerSize); err != nil {
+		return 0, false
+	}
+	// Files with stream padding or several streams are not handled.
+	if footer[10] != 'Y' || footer[11] != 'Z' {
+		return 0, false
+	}
+	indexSize := (int64(binary.LittleEndian.Uint32(footer[4:])) + 1) * 4
+	indexStart := size - footerSize - indexSize
+	if indexStart < headerSize {
+		return 0, false
+	}
+	index := make([]byte, indexSize)
+	if _, err := ra.ReadAt(index, indexStart); err != nil {
+		return 0, false
+	}
+	if index[0] != 0 {
+		return 0, false
+	}
+	r := bytes.NewReader(index[1:])
+	records, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, false
+	}
+	var blocks, uncompressed int64
+	for i := uint64(0); i < records; i++ {
+		unpadded, err := binary.ReadUvarint(r)
+		if err != nil {
+			return 0, false
+		}
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return 0, false
+		}
+		blocks += (int64(unpadded) + 3) &^ 3
+		uncompressed += int64(n)
+	}
+	// The blocks must fill the space between the stream header and the
+	// index, otherwise the file holds more than this stream.
+	if headerSize+blocks != indexStart {
+		return 0, false
+	}
+	return uncompressed, true
+}
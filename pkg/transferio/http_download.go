@@ -43,6 +43,11 @@ func (s *HTTPDownload) Size() (int64, bool) {
 	return s.offset, false
 }
 
+// AppendOnly reports that the response body can only be written sequentially.
+func (s *HTTPDownload) AppendOnly() bool {
+	return true
+}
+
 func (s *HTTPDownload) Close() error {
 	if c, ok := s.W.(io.Closer); ok {
 		return c.Close()
@@ -0,0 +1,58 @@
+package transferio
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+)
+
+// SpoolRead is a source copied to a temporary file, which Close removes.
+type SpoolRead struct {
+	*FileReadStorage
+}
+
+// Spool returns source if it has random access, or a copy of it in a
+// temporary file otherwise, for readers that need to read it out of order.
+// source is closed once it has been copied.
+func Spool(ctx context.Context, source StreamRead) (StreamRead, error) {
+	if _, ok := source.(io.ReaderAt); ok {
+		return source, nil
+	}
+	type openable interface {
+		Open(ctx context.Context) (io.ReadCloser, error)
+	}
+	defer source.Close()
+	var r io.Reader = source
+	if o, ok := source.(openable); ok {
+		rc, err := o.Open(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		r = rc
+	}
+
+	tmp, err := os.CreateTemp("", "dsc-spool-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create spool file: %w", err)
+	}
+	size, err := io.Copy(tmp, r)
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, fmt.Errorf("failed to spool source: %w", err)
+	}
+	return &SpoolRead{&FileReadStorage{path: tmp.Name(), file: tmp, size: size}}, nil
+}
+
+func (s *SpoolRead) Close() error {
+	err := s.FileReadStorage.Close()
+	os.Remove(s.path)
+	return err
+}
+
+var _ StreamRead = (*SpoolRead)(nil)
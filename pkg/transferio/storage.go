@@ -41,3 +41,18 @@ type StreamWrite interface {
 	// Preallocate storage space if supported.
 	Preallocate(ctx context.Context, size int64) error
 }
+
+// appendOnly is implemented by sinks whose WriteAt only accepts the current
+// end of the written data.
+type appendOnly interface {
+	AppendOnly() bool
+}
+
+// SupportsRandomWrite reports whether the sink accepts WriteAt at arbitrary
+// offsets. Formats that patch metadata after the data has been written need it.
+func SupportsRandomWrite(s WriteAtStorage) bool {
+	if a, ok := s.(appendOnly); ok {
+		return !a.AppendOnly()
+	}
+	return true
+}